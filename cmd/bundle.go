@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/vkl/rfidplayer/pkg/control"
+)
+
+const exportCardsUsage = `usage: rfidplayer export-cards [-o <file>] [<id>...]
+writes the cards with the given ids, or all of them, as a card bundle
+to file, by default the standard output.
+`
+
+const importCardsUsage = `usage: rfidplayer import-cards [-strategy skip|overwrite|rename] [-chromecast <name>] <file>
+adds the cards of a card bundle. The strategy says what to do with a
+card whose id is taken: keep the card there is, replace it, or store the
+imported card under a new id. The chromecast replaces the devices of
+every imported card.
+`
+
+// openCards opens the cards the player uses, which must not be running
+// when they are changed.
+func openCards() *control.CardController {
+	cardController, err := control.NewCardController(cardsLocation())
+	if err != nil {
+		slog.Error("open cards", "store", cardsLocation(), "error", err)
+		os.Exit(1)
+	}
+	return cardController
+}
+
+// exportCards writes a card bundle.
+func exportCards(args []string) {
+	flags := flag.NewFlagSet("export-cards", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, exportCardsUsage) }
+	output := flags.String("o", "", "file to write the bundle to")
+	flags.Parse(args)
+
+	cardController := openCards()
+	defer cardController.Close()
+	bundle, err := cardController.ExportBundle(flags.Args()...)
+	if err != nil {
+		slog.Error("export cards", "error", err)
+		os.Exit(1)
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := control.WriteCardBundle(w, bundle); err != nil {
+		slog.Error("export cards", "error", err)
+		os.Exit(1)
+	}
+	if *output != "" {
+		fmt.Printf("exported %d cards to %s\n", len(bundle.Cards), *output)
+	}
+}
+
+// importCards adds the cards of a card bundle, checking their devices
+// against the ones the player knows.
+func importCards(args []string) {
+	flags := flag.NewFlagSet("import-cards", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, importCardsUsage) }
+	strategyName := flags.String("strategy", string(control.CONFLICT_SKIP), "what to do with a card whose id is taken")
+	chromecast := flags.String("chromecast", "", "device to play every imported card on")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	strategy, err := control.ParseConflictStrategy(*strategyName)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	bundle, err := control.ReadCardBundle(f, info.Size())
+	if err != nil {
+		slog.Error("import cards", "file", flags.Arg(0), "error", err)
+		os.Exit(1)
+	}
+
+	// the devices are only looked up: casts.json is left as it is
+	castController, err := control.ReadCastController(CASTS_FILE)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	if control.LocalOutputAvailable() {
+		castController.AddCast(control.LocalCast())
+	}
+	cardController := openCards()
+	defer cardController.Close()
+	cardController.CheckDevices(castController)
+	result, err := cardController.ImportBundle(bundle, control.ImportOptions{
+		Strategy:   strategy,
+		Chromecast: *chromecast,
+	})
+	if err != nil {
+		slog.Error("import cards", "error", err)
+		os.Exit(1)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+}
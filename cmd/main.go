@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
 
@@ -9,32 +10,85 @@ import (
 	_ "github.com/vkl/rfidplayer/pkg/logging"
 )
 
+const (
+	CARDS_JSON_FILE = "cards.json"
+	CARDS_DB_FILE   = "cards.db"
+	CASTS_FILE      = "casts.json"
+)
+
 var (
+	events            *control.EventBus
 	cardController    *control.CardController
 	castController    *control.CastController
 	chromecastControl *control.ChromecastControl
+	// hardware is what the player is wired to, nil where there is none
+	hardware control.Hardware
 )
 
-func init() {
+// cardsLocation is the card database once the cards have been migrated
+// to one, and the JSON file before. A JSON file next to the database is
+// not read, which is worth a warning as edits to it do nothing.
+func cardsLocation() string {
+	if _, err := os.Stat(CARDS_DB_FILE); err == nil {
+		if _, err := os.Stat(CARDS_JSON_FILE); err == nil {
+			slog.Warn("cards are read from the database, not the JSON file next to it",
+				"store", CARDS_DB_FILE, "ignored", CARDS_JSON_FILE)
+		}
+		return CARDS_DB_FILE
+	}
+	return CARDS_JSON_FILE
+}
+
+func setup() {
 	var err error
-	cardController, err = control.NewCardController("cards.json")
+	cardController, err = control.NewCardController(cardsLocation())
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
-	slog.Debug(cardController.FileName)
+	slog.Info("card store", "store", cardController.FileName)
 
-	// castController, err = control.NewCastController("casts.json")
-	// if err != nil {
-	// 	slog.Error(err.Error())
-	// 	os.Exit(1)
-	// }
-	// slog.Debug(castController.FileName)
-	castController = &control.CastController{}
+	castController, err = control.NewCastController(CASTS_FILE)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	slog.Debug(castController.FileName)
+	if control.LocalOutputAvailable() {
+		castController.AddCast(control.LocalCast())
+	}
 
-	chromecastControl = control.NewChromeCastControl(castController)
+	events = control.NewEventBus()
+	chromecastControl = control.NewChromeCastControl(castController, events)
+	cardController.CheckDevices(castController)
+	cardController.FollowDevices(events, castController)
+	cardController.WatchStore(context.Background(), events)
 }
 
 func main() {
-	api.StartApp("127.0.0.1", 8080, cardController, chromecastControl)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate-cards":
+			migrateCards(os.Args[2:])
+			return
+		case "export-cards":
+			exportCards(os.Args[2:])
+			return
+		case "import-cards":
+			importCards(os.Args[2:])
+			return
+		}
+	}
+	setup()
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		simulate()
+		return
+	}
+	if hardware != nil {
+		if _, err := control.NewPlayerController(chromecastControl, cardController, events, hardware); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+	api.StartApp("127.0.0.1", 8080, cardController, chromecastControl, events, nil)
 }
@@ -4,14 +4,9 @@
 package main
 
 import (
-	"log"
-
 	"github.com/vkl/rfidplayer/pkg/control"
 )
 
 func init() {
-	_, err := control.NewPlayerController(chromecastControl, cardController)
-	if err != nil {
-		log.Fatal(err)
-	}
+	hardware = control.NewGpioHardware()
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/vkl/rfidplayer/pkg/control"
+)
+
+const migrateCardsUsage = `usage: rfidplayer migrate-cards [<from> <to>]
+copies the cards from one store to another, which must have none yet.
+A store is a bolt database for the .db and .bolt extensions and a JSON
+file otherwise. The default is from cards.json to cards.db, which the
+player then uses; cards.json is then renamed to cards.json.migrated so
+that it is not edited by mistake.
+`
+
+// CARDS_MIGRATED_SUFFIX is added to the name of the JSON file the
+// cards were migrated from.
+const CARDS_MIGRATED_SUFFIX = ".migrated"
+
+// migrateCards copies the cards between stores, by default from the
+// JSON file to the database, putting the JSON file aside.
+func migrateCards(args []string) {
+	from, to := CARDS_JSON_FILE, CARDS_DB_FILE
+	switch len(args) {
+	case 0:
+	case 2:
+		from, to = args[0], args[1]
+	default:
+		fmt.Fprint(os.Stderr, migrateCardsUsage)
+		os.Exit(2)
+	}
+	if _, err := os.Stat(from); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	source, err := control.OpenCardStore(from)
+	if err != nil {
+		slog.Error("open card store", "store", from, "error", err)
+		os.Exit(1)
+	}
+	defer source.Close()
+	destination, err := control.OpenCardStore(to)
+	if err != nil {
+		slog.Error("open card store", "store", to, "error", err)
+		os.Exit(1)
+	}
+	defer destination.Close()
+	count, err := control.MigrateCards(source, destination)
+	if err != nil {
+		slog.Error("migrate cards", "from", from, "to", to, "error", err)
+		os.Exit(1)
+	}
+	fmt.Printf("copied %d cards from %s to %s\n", count, from, to)
+	if len(args) == 0 {
+		// the player reads the database from now on
+		source.Close()
+		if err := os.Rename(from, from+CARDS_MIGRATED_SUFFIX); err != nil {
+			slog.Error("put migrated cards aside", "error", err)
+			os.Exit(1)
+		}
+		fmt.Printf("renamed %s to %s\n", from, from+CARDS_MIGRATED_SUFFIX)
+	}
+}
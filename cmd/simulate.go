@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vkl/rfidplayer/pkg/api"
+	"github.com/vkl/rfidplayer/pkg/control"
+)
+
+const simulatorHelp = `simulator commands:
+  i <card id>   insert a card
+  r             remove the card
+  b [duration]  press the button, e.g. b 2s for next (default 100ms)
+  + [steps]     turn the encoder clockwise (default 5)
+  - [steps]     turn the encoder counterclockwise (default 5)
+  s             show the state
+  h             show this help
+the simulator page is at http://127.0.0.1:8080/simulator
+`
+
+var ledColors = []string{"\x1b[31m", "\x1b[32m", "\x1b[34m"}
+
+// simulate runs the player on virtual hardware, driven from the terminal
+// and from the simulator page of the web UI.
+func simulate() {
+	simulator := control.NewSimulator()
+	simulator.OnLeds(func(values []int) {
+		fmt.Println("leds", renderLeds(values))
+	})
+	if _, err := control.NewPlayerController(chromecastControl, cardController, events, simulator); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	fmt.Print(simulatorHelp)
+	go readCommands(os.Stdin, simulator)
+	api.StartApp("127.0.0.1", 8080, cardController, chromecastControl, events, simulator)
+}
+
+// renderLeds draws lit LEDs in their color. The LEDs light up at 0.
+func renderLeds(values []int) string {
+	leds := make([]string, len(values))
+	for i, value := range values {
+		leds[i] = "○"
+		if value == 0 {
+			leds[i] = ledColors[i] + "●\x1b[0m"
+		}
+	}
+	return strings.Join(leds, " ")
+}
+
+func readCommands(r io.Reader, simulator *control.Simulator) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if err := runCommand(simulator, strings.Fields(scanner.Text())); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func runCommand(simulator *control.Simulator, fields []string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	arg := ""
+	if len(fields) > 1 {
+		arg = fields[1]
+	}
+	switch fields[0] {
+	case "i":
+		if arg == "" {
+			return errors.New("usage: i <card id>")
+		}
+		return simulator.InsertCard(arg)
+	case "r":
+		simulator.RemoveCard()
+	case "b":
+		duration := 100 * time.Millisecond
+		if arg != "" {
+			var err error
+			if duration, err = time.ParseDuration(arg); err != nil {
+				return err
+			}
+		}
+		simulator.PressButton(duration)
+	case "+", "-":
+		steps := 5
+		if arg != "" {
+			var err error
+			if steps, err = strconv.Atoi(arg); err != nil {
+				return err
+			}
+		}
+		if fields[0] == "-" {
+			steps = -steps
+		}
+		simulator.TurnEncoder(steps)
+	case "s":
+		state := simulator.State()
+		fmt.Printf("card: %q reader power: %t leds: %s\n", state.Card, state.ReaderPower, renderLeds(state.Leds))
+	case "h":
+		fmt.Print(simulatorHelp)
+	default:
+		return fmt.Errorf("unknown command %q, h for help", fields[0])
+	}
+	return nil
+}
@@ -3,19 +3,20 @@ module github.com/vkl/rfidplayer
 go 1.21
 
 require (
+	github.com/gogo/protobuf v1.3.2
 	github.com/gorilla/mux v1.8.1
+	github.com/hashicorp/mdns v1.0.5
 	github.com/urfave/cli v1.22.14
 	github.com/vkl/go-cast v0.0.0-20240228052059-b3488d7c5ea0
 	github.com/warthog618/gpiod v0.8.2
 	go.bug.st/serial v1.6.2
+	go.etcd.io/bbolt v1.3.9
 	golang.org/x/net v0.21.0
 )
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
 	github.com/creack/goselect v0.1.2 // indirect
-	github.com/gogo/protobuf v1.3.2 // indirect
-	github.com/hashicorp/mdns v1.0.5 // indirect
 	github.com/miekg/dns v1.1.41 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	golang.org/x/sys v0.17.0 // indirect
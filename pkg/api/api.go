@@ -19,10 +19,16 @@ import (
 	_ "github.com/vkl/rfidplayer/pkg/logging"
 )
 
+const EVENTS_KEEPALIVE_INTERVAL = 30 * time.Second
+
 func GetCards(cardController *control.CardController) func(http.ResponseWriter, *http.Request) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cards := cardController.GetCards()
+		if tags := splitList(r.URL.Query().Get("tag")); len(tags) > 0 {
+			cards = cardController.GetCardsTagged(tags...)
+		}
 		encoder := json.NewEncoder(w)
-		encoder.Encode(cardController.Cards)
+		encoder.Encode(cards)
 	})
 }
 
@@ -30,28 +36,36 @@ func GetCard(cardController *control.CardController) func(http.ResponseWriter, *
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		slog.Debug("", "vars", vars)
-		if _, ok := cardController.Cards[vars["id"]]; !ok {
-			w.WriteHeader(http.StatusNotFound)
+		card, ok := cardController.GetCard(vars["id"])
+		if !ok {
+			writeError(w, fmt.Errorf("%w: %s", control.ErrCardNotFound, vars["id"]))
 			return
 		}
+		w.Header().Set("ETag", card.ETag())
 		encoder := json.NewEncoder(w)
-		encoder.Encode(cardController.Cards[vars["id"]])
+		encoder.Encode(card)
 	})
 }
 
-func AddCard(cardController *control.CardController) func(http.ResponseWriter, *http.Request) {
+func AddCard(
+	cardController *control.CardController,
+	chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 		card := control.Card{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&card); err != nil {
 			slog.Error("add card", "error", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		if err := cardController.AddCard(chromecastControl.ResolveCard(card)); err != nil {
+			slog.Error("add card", "error", err)
+			writeError(w, err)
 			return
 		}
-		cardController.AddCard(card)
 		encoder := json.NewEncoder(w)
-		encoder.Encode(cardController.Cards)
+		encoder.Encode(cardController.GetCards())
 	})
 }
 
@@ -59,9 +73,12 @@ func DelCard(cardController *control.CardController) func(http.ResponseWriter, *
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		slog.Debug("", "vars", vars)
-		cardController.DelCard(vars["id"])
+		if !cardController.DelCard(vars["id"]) {
+			writeError(w, fmt.Errorf("%w: %s", control.ErrCardNotFound, vars["id"]))
+			return
+		}
 		encoder := json.NewEncoder(w)
-		encoder.Encode(cardController.Cards)
+		encoder.Encode(cardController.GetCards())
 	})
 }
 
@@ -70,13 +87,13 @@ func PlayCard(
 	cardController *control.CardController) func(http.ResponseWriter, *http.Request) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		if _, ok := cardController.Cards[vars["id"]]; !ok {
-			w.WriteHeader(http.StatusNotFound)
+		card, ok := cardController.GetCard(vars["id"])
+		if !ok {
+			writeError(w, fmt.Errorf("%w: %s", control.ErrCardNotFound, vars["id"]))
 			return
 		}
-		card := cardController.Cards[vars["id"]]
-		if !chromecastControl.PlayCard(card) {
-			w.WriteHeader(http.StatusNotFound)
+		if err := chromecastControl.PlayCard(card); err != nil {
+			writeError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusAccepted)
@@ -99,6 +116,65 @@ func DiscoverCasts(chromecastControl *control.ChromecastControl) func(http.Respo
 	})
 }
 
+func AddStaticCast(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		vars := mux.Vars(r)
+		castInfo := control.Cast{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&castInfo); err != nil {
+			slog.Error("add cast", "error", err)
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		castInfo.Name = vars["name"]
+		if err := chromecastControl.AddStaticCast(castInfo); err != nil {
+			slog.Error("add cast", "error", err)
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		encoder := json.NewEncoder(w)
+		encoder.Encode(chromecastControl.GetClients())
+	})
+}
+
+// ReceiverApp is the body of a request setting a device's receiver app.
+type ReceiverApp struct {
+	ReceiverAppId string `json:"receiver_app_id"`
+}
+
+func SetReceiverApp(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		vars := mux.Vars(r)
+		app := ReceiverApp{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&app); err != nil {
+			slog.Error("set receiver app", "error", err)
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		if err := chromecastControl.SetReceiverApp(vars["name"], app.ReceiverAppId); err != nil {
+			writeError(w, err)
+			return
+		}
+		encoder := json.NewEncoder(w)
+		encoder.Encode(chromecastControl.GetClients())
+	})
+}
+
+func DelCast(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if !chromecastControl.DelCast(vars["name"]) {
+			writeError(w, fmt.Errorf("%w: %s", control.ErrDeviceNotFound, vars["name"]))
+			return
+		}
+		encoder := json.NewEncoder(w)
+		encoder.Encode(chromecastControl.GetClients())
+	})
+}
+
 func CastStatus(
 	chromecastControl *control.ChromecastControl,
 	cardController *control.CardController) func(http.ResponseWriter, *http.Request) {
@@ -116,11 +192,11 @@ func ControlCasts(chromecastControl *control.ChromecastControl) func(http.Respon
 		defer r.Body.Close()
 		if err := decoder.Decode(&payload); err != nil {
 			slog.Error("control cast", "error", err)
-			w.WriteHeader(http.StatusServiceUnavailable)
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
 			return
 		}
-		if !chromecastControl.ClientControl(payload) {
-			w.WriteHeader(http.StatusNotFound)
+		if err := chromecastControl.ClientControl(payload); err != nil {
+			writeError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusAccepted)
@@ -129,16 +205,77 @@ func ControlCasts(chromecastControl *control.ChromecastControl) func(http.Respon
 
 func GetVolume(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		level, ok := chromecastControl.GetVolume()
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
+		level, err := chromecastControl.GetVolume()
+		if err != nil {
+			writeError(w, err)
 			return
 		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "volume level: %f\n", level)
 	})
 }
 
+// Events streams the player's events as Server-Sent Events, one JSON
+// encoded control.Event per message. The stream starts with the
+// current status so that clients need not fetch it first.
+func Events(
+	events *control.EventBus,
+	chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ch, unsubscribe := events.Subscribe()
+		defer unsubscribe()
+		rc := http.NewResponseController(w)
+		// the stream lives longer than the server's write timeout
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			slog.Error("events", "error", err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+
+		send := func(event control.Event) error {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		status := control.Event{
+			Type: control.EVENT_PLAYER_STATUS,
+			Time: time.Now(),
+			Data: chromecastControl.CastStatus(),
+		}
+		if err := send(status); err != nil {
+			return
+		}
+		keepalive := time.NewTicker(EVENTS_KEEPALIVE_INTERVAL)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := send(event); err != nil {
+					slog.Debug("events", "error", err)
+					return
+				}
+			case <-keepalive.C:
+				// comments keep proxies from closing an idle stream
+				if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+				rc.Flush()
+			}
+		}
+	})
+}
+
 func SiteHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl, err := template.ParseFiles("templates/index.html")
 	if err != nil {
@@ -174,7 +311,9 @@ func StartApp(
 	host string,
 	port int,
 	cardController *control.CardController,
-	chromcastController *control.ChromecastControl) {
+	chromcastController *control.ChromecastControl,
+	events *control.EventBus,
+	simulator *control.Simulator) {
 
 	r := mux.NewRouter()
 	r.Use(noCache)
@@ -184,17 +323,29 @@ func StartApp(
 	r.HandleFunc("/", SiteHandler).Methods("GET")
 	apiPrefix := r.PathPrefix("/api").Subrouter()
 	apiPrefix.Use(ContentJson)
-	apiPrefix.HandleFunc("/cards", GetCards(cardController)).Methods("GET")
-	apiPrefix.HandleFunc("/casts", GetCasts(chromcastController)).Methods("GET")
-	apiPrefix.HandleFunc("/casts", DiscoverCasts(chromcastController)).Methods("POST")
-	apiPrefix.HandleFunc("/control", ControlCasts(chromcastController)).Methods("PUT")
-	apiPrefix.HandleFunc("/cards", AddCard(cardController)).Methods("POST")
-	apiPrefix.HandleFunc("/cards/{id}", DelCard(cardController)).Methods("DELETE")
-	apiPrefix.HandleFunc("/cards/{id}", GetCard(cardController)).Methods("GET")
-	apiPrefix.HandleFunc("/status", CastStatus(chromcastController, cardController)).Methods("GET")
-	apiPrefix.HandleFunc("/volume", GetVolume(chromcastController)).Methods("GET")
-	apiPrefix.HandleFunc("/cards/{id}", PlayCard(chromcastController, cardController)).Methods("POST")
-	apiPrefix.HandleFunc("/debug", Debug).Methods("GET")
+	v1 := apiPrefix.PathPrefix("/v1").Subrouter()
+	v1Routes(v1, cardController, chromcastController, events)
+	// the routes from before /api/v1 stay for existing scripts
+	apiPrefix.HandleFunc("/cards", deprecated("/api/v1/cards", GetCards(cardController))).Methods("GET")
+	apiPrefix.HandleFunc("/casts", deprecated("/api/v1/devices", GetCasts(chromcastController))).Methods("GET")
+	apiPrefix.HandleFunc("/casts", deprecated("/api/v1/devices/discovery", DiscoverCasts(chromcastController))).Methods("POST")
+	apiPrefix.HandleFunc("/casts/{name}", deprecated("/api/v1/devices/{name}", AddStaticCast(chromcastController))).Methods("PUT")
+	apiPrefix.HandleFunc("/casts/{name}", deprecated("/api/v1/devices/{name}", DelCast(chromcastController))).Methods("DELETE")
+	apiPrefix.HandleFunc("/casts/{name}/receiver", deprecated("/api/v1/devices/{name}/receiver", SetReceiverApp(chromcastController))).Methods("PUT")
+	apiPrefix.HandleFunc("/control", deprecated("/api/v1/player/actions", ControlCasts(chromcastController))).Methods("PUT")
+	apiPrefix.HandleFunc("/cards", deprecated("/api/v1/cards", AddCard(cardController, chromcastController))).Methods("POST")
+	apiPrefix.HandleFunc("/cards/{id}", deprecated("/api/v1/cards/{id}", DelCard(cardController))).Methods("DELETE")
+	apiPrefix.HandleFunc("/cards/{id}", deprecated("/api/v1/cards/{id}", GetCard(cardController))).Methods("GET")
+	apiPrefix.HandleFunc("/status", deprecated("/api/v1/player", CastStatus(chromcastController, cardController))).Methods("GET")
+	apiPrefix.HandleFunc("/volume", deprecated("/api/v1/player/volume", GetVolume(chromcastController))).Methods("GET")
+	apiPrefix.HandleFunc("/cards/{id}", deprecated("/api/v1/cards/{id}/play", PlayCard(chromcastController, cardController))).Methods("POST")
+	apiPrefix.HandleFunc("/debug", deprecated("/api/v1/debug", Debug)).Methods("GET")
+	apiPrefix.HandleFunc("/events", deprecated("/api/v1/events", Events(events, chromcastController))).Methods("GET")
+	apiPrefix.HandleFunc("/export", deprecated("/api/v1/export", ExportCards(cardController))).Methods("GET")
+	apiPrefix.HandleFunc("/import", deprecated("/api/v1/import", ImportCards(cardController))).Methods("POST")
+	if simulator != nil {
+		simulatorRoutes(r, v1, simulator)
+	}
 
 	srv := &http.Server{
 		Handler:      r,
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/vkl/rfidplayer/pkg/control"
+	_ "github.com/vkl/rfidplayer/pkg/logging"
+)
+
+var errBadRequest = errors.New("bad request")
+
+// ErrorResponse is the body of every failed API request. Error is a
+// stable code for the kind of failure, Message is for people. Fields
+// tells what is wrong with each field of an invalid card.
+type ErrorResponse struct {
+	Error   string               `json:"error"`
+	Message string               `json:"message"`
+	Fields  []control.FieldError `json:"fields,omitempty"`
+}
+
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{errBadRequest, http.StatusBadRequest, "bad_request"},
+	{control.ErrInvalidAction, http.StatusBadRequest, "invalid_action"},
+	{control.ErrInvalidBundle, http.StatusBadRequest, "invalid_bundle"},
+	{control.ErrInvalidCard, http.StatusUnprocessableEntity, "invalid_card"},
+	{control.ErrCardNotFound, http.StatusNotFound, "card_not_found"},
+	{control.ErrCardExists, http.StatusConflict, "card_exists"},
+	{control.ErrCardChanged, http.StatusPreconditionFailed, "card_changed"},
+	{control.ErrCardsChanged, http.StatusConflict, "cards_changed"},
+	{control.ErrDeviceNotFound, http.StatusNotFound, "device_not_found"},
+	{control.ErrNoActiveSession, http.StatusConflict, "no_active_session"},
+	{control.ErrConnectFailed, http.StatusBadGateway, "connect_failed"},
+	{control.ErrAppLaunchFailed, http.StatusBadGateway, "app_launch_failed"},
+	{control.ErrLoadFailed, http.StatusBadGateway, "load_failed"},
+}
+
+func errorStatus(err error) (int, string) {
+	for _, entry := range errorStatuses {
+		if errors.Is(err, entry.err) {
+			return entry.status, entry.code
+		}
+	}
+	return http.StatusInternalServerError, "internal"
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	slog.Debug("request failed", "status", status, "error", err)
+	w.Header().Set("Content-Type", "application/json")
+	response := ErrorResponse{Error: code, Message: err.Error()}
+	var validationErr *control.ValidationError
+	if errors.As(err, &validationErr) {
+		response.Fields = validationErr.Fields
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/vkl/rfidplayer/pkg/control"
+	_ "github.com/vkl/rfidplayer/pkg/logging"
+)
+
+// SimulatorCard is the body of a request inserting a card.
+type SimulatorCard struct {
+	Id string `json:"id"`
+}
+
+// SimulatorButton is the body of a request pressing the button.
+type SimulatorButton struct {
+	DurationMs int `json:"duration_ms"`
+}
+
+// SimulatorEncoder is the body of a request turning the encoder,
+// clockwise for positive steps.
+type SimulatorEncoder struct {
+	Steps int `json:"steps"`
+}
+
+func SimulatorHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFiles("templates/simulator.html")
+	if err != nil {
+		slog.Error("parse template", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var data interface{}
+	tmpl.Execute(w, data)
+}
+
+func SimulatorState(simulator *control.Simulator) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoder := json.NewEncoder(w)
+		encoder.Encode(simulator.State())
+	})
+}
+
+func SimulatorInsertCard(simulator *control.Simulator) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		card := SimulatorCard{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&card); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		if err := simulator.InsertCard(card.Id); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		encoder := json.NewEncoder(w)
+		encoder.Encode(simulator.State())
+	})
+}
+
+func SimulatorRemoveCard(simulator *control.Simulator) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		simulator.RemoveCard()
+		encoder := json.NewEncoder(w)
+		encoder.Encode(simulator.State())
+	})
+}
+
+func SimulatorPressButton(simulator *control.Simulator) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		button := SimulatorButton{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&button); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		simulator.PressButton(time.Duration(button.DurationMs) * time.Millisecond)
+		encoder := json.NewEncoder(w)
+		encoder.Encode(simulator.State())
+	})
+}
+
+func SimulatorTurnEncoder(simulator *control.Simulator) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		turn := SimulatorEncoder{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&turn); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		simulator.TurnEncoder(turn.Steps)
+		encoder := json.NewEncoder(w)
+		encoder.Encode(simulator.State())
+	})
+}
+
+// simulatorRoutes adds the simulator page and its API.
+func simulatorRoutes(r *mux.Router, v1 *mux.Router, simulator *control.Simulator) {
+	r.HandleFunc("/simulator", SimulatorHandler).Methods("GET")
+	v1.HandleFunc("/simulator", SimulatorState(simulator)).Methods("GET")
+	v1.HandleFunc("/simulator/card", SimulatorInsertCard(simulator)).Methods("PUT")
+	v1.HandleFunc("/simulator/card", SimulatorRemoveCard(simulator)).Methods("DELETE")
+	v1.HandleFunc("/simulator/button", SimulatorPressButton(simulator)).Methods("POST")
+	v1.HandleFunc("/simulator/encoder", SimulatorTurnEncoder(simulator)).Methods("POST")
+}
@@ -0,0 +1,568 @@
+package api
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/vkl/rfidplayer/pkg/control"
+	_ "github.com/vkl/rfidplayer/pkg/logging"
+)
+
+// The handlers below make up /api/v1, described in openapi.json. Every
+// response is JSON: the resource that was read or written, the player
+// status after a playback command, or an ErrorResponse.
+
+//go:embed openapi.json
+var openAPI []byte
+
+// Volume is the body of requests reading and setting the volume.
+type Volume struct {
+	Volume float64 `json:"volume"`
+}
+
+// Room is the body of requests reading and setting the room the player
+// is in, the device cards without one play on. Empty means none.
+type Room struct {
+	Room string `json:"room"`
+}
+
+// CARD_BUNDLE_MAX_SIZE is the largest card bundle that can be imported.
+const CARD_BUNDLE_MAX_SIZE = 32 << 20
+
+// DebugInfo is the body of the debug resource.
+type DebugInfo struct {
+	Goroutines int `json:"goroutines"`
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeAccepted answers a playback command with the player status.
+func writeAccepted(w http.ResponseWriter, chromecastControl *control.ChromecastControl) {
+	writeJson(w, http.StatusAccepted, chromecastControl.CastStatus())
+}
+
+func CreateCard(
+	cardController *control.CardController,
+	chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		card := control.Card{}
+		if err := json.NewDecoder(r.Body).Decode(&card); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		card = chromecastControl.ResolveCard(card)
+		if err := cardController.CreateCard(card); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Location", "/api/v1/cards/"+card.Id)
+		writeCard(w, http.StatusCreated, card)
+	})
+}
+
+// CardsUpdate is the body of a request changing many cards at once:
+// the cards with the ids and the cards with the tag.
+type CardsUpdate struct {
+	Ids []string `json:"ids"`
+	Tag string   `json:"tag"`
+	control.CardsChange
+}
+
+// splitList splits a query parameter listing values separated by
+// commas.
+func splitList(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// UpdateCards changes many cards at once, all of them or none, and
+// answers with the changed cards.
+func UpdateCards(cardController *control.CardController) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		update := CardsUpdate{}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		if len(update.Ids) == 0 && update.Tag == "" {
+			writeError(w, fmt.Errorf("%w: ids or tag is required", errBadRequest))
+			return
+		}
+		ids := append([]string{}, update.Ids...)
+		if update.Tag != "" {
+			for id := range cardController.GetCardsTagged(update.Tag) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		ids = slices.Compact(ids)
+		changed, err := cardController.ChangeCards(ids, update.CardsChange)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		cards := make(map[string]control.Card, len(changed))
+		for _, card := range changed {
+			cards[card.Id] = card
+		}
+		writeJson(w, http.StatusOK, cards)
+	})
+}
+
+func GetTags(cardController *control.CardController) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, cardController.GetTags())
+	})
+}
+
+// CardMove is the body of a request giving a card a new id.
+type CardMove struct {
+	Id string `json:"id"`
+}
+
+func writeCard(w http.ResponseWriter, status int, card control.Card) {
+	w.Header().Set("ETag", card.ETag())
+	writeJson(w, status, card)
+}
+
+// cardIdMismatch is the error for a body naming another card than the
+// URL does.
+func cardIdMismatch() error {
+	return &control.ValidationError{Fields: []control.FieldError{{
+		Field:   "id",
+		Message: "does not match the card's URL; move the card to change its id",
+	}}}
+}
+
+// replaceCard stores a card sent with PUT or PATCH, answering 201 when
+// it is new.
+func replaceCard(
+	w http.ResponseWriter,
+	cardController *control.CardController,
+	chromecastControl *control.ChromecastControl,
+	card control.Card,
+	etag string) {
+	created, err := cardController.ReplaceCard(chromecastControl.ResolveCard(card), etag)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	card, _ = cardController.GetCard(card.Id)
+	status := http.StatusOK
+	if created {
+		w.Header().Set("Location", "/api/v1/cards/"+card.Id)
+		status = http.StatusCreated
+	}
+	writeCard(w, status, card)
+}
+
+// PutCard replaces a card or creates it. With If-Match the card is only
+// replaced when it has not changed since it was read.
+func PutCard(
+	cardController *control.CardController,
+	chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		vars := mux.Vars(r)
+		card := control.Card{}
+		if err := json.NewDecoder(r.Body).Decode(&card); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		if card.Id == "" {
+			card.Id = vars["id"]
+		}
+		if card.Id != vars["id"] {
+			writeError(w, cardIdMismatch())
+			return
+		}
+		replaceCard(w, cardController, chromecastControl, card, r.Header.Get("If-Match"))
+	})
+}
+
+// PatchCard changes the fields of a card given in a JSON merge patch
+// (RFC 7396). Without If-Match the card is still only written when it
+// has not changed while the patch was applied.
+func PatchCard(
+	cardController *control.CardController,
+	chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		vars := mux.Vars(r)
+		patch := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		current, ok := cardController.GetCard(vars["id"])
+		if !ok {
+			writeError(w, fmt.Errorf("%w: %s", control.ErrCardNotFound, vars["id"]))
+			return
+		}
+		etag := r.Header.Get("If-Match")
+		if etag == "" || etag == "*" {
+			etag = current.ETag()
+		}
+		card, err := mergeCard(current, patch)
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		if card.Id != vars["id"] {
+			writeError(w, cardIdMismatch())
+			return
+		}
+		replaceCard(w, cardController, chromecastControl, card, etag)
+	})
+}
+
+// mergeCard applies a JSON merge patch to a card.
+func mergeCard(card control.Card, patch map[string]interface{}) (control.Card, error) {
+	data, err := json.Marshal(card)
+	if err != nil {
+		return card, err
+	}
+	target := make(map[string]interface{})
+	if err := json.Unmarshal(data, &target); err != nil {
+		return card, err
+	}
+	data, err = json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return card, err
+	}
+	merged := control.Card{}
+	err = json.Unmarshal(data, &merged)
+	return merged, err
+}
+
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(target, key)
+		case map[string]interface{}:
+			object, _ := target[key].(map[string]interface{})
+			if object == nil {
+				object = make(map[string]interface{})
+			}
+			target[key] = mergePatch(object, value)
+		default:
+			target[key] = value
+		}
+	}
+	return target
+}
+
+// MoveCard gives a card a new id when its physical card is replaced,
+// keeping everything else about it.
+func MoveCard(cardController *control.CardController) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		vars := mux.Vars(r)
+		move := CardMove{}
+		if err := json.NewDecoder(r.Body).Decode(&move); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		card, err := cardController.MoveCard(vars["id"], move.Id, r.Header.Get("If-Match"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Location", "/api/v1/cards/"+card.Id)
+		writeCard(w, http.StatusOK, card)
+	})
+}
+
+func DeleteCard(cardController *control.CardController) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if !cardController.DelCard(vars["id"]) {
+			writeError(w, fmt.Errorf("%w: %s", control.ErrCardNotFound, vars["id"]))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ExportCards answers with a card bundle of the cards listed in ids,
+// separated by commas, or of all cards.
+func ExportCards(cardController *control.CardController) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bundle, err := cardController.ExportBundle(splitList(r.URL.Query().Get("ids"))...)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		buf := bytes.Buffer{}
+		if err := control.WriteCardBundle(&buf, bundle); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cards-%s.zip"`,
+			bundle.Exported.Format("20060102-150405")))
+		w.Write(buf.Bytes())
+	})
+}
+
+// ImportCards adds the cards of the bundle in the body, settling
+// conflicts by the strategy query parameter.
+func ImportCards(cardController *control.CardController) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		query := r.URL.Query()
+		strategy, err := control.ParseConflictStrategy(query.Get("strategy"))
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, CARD_BUNDLE_MAX_SIZE))
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		bundle, err := control.ReadCardBundle(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		result, err := cardController.ImportBundle(bundle, control.ImportOptions{
+			Strategy:   strategy,
+			Chromecast: query.Get("chromecast"),
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, result)
+	})
+}
+
+func StartCard(
+	chromecastControl *control.ChromecastControl,
+	cardController *control.CardController) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		card, ok := cardController.GetCard(vars["id"])
+		if !ok {
+			writeError(w, fmt.Errorf("%w: %s", control.ErrCardNotFound, vars["id"]))
+			return
+		}
+		if err := chromecastControl.PlayCard(card); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeAccepted(w, chromecastControl)
+	})
+}
+
+func StartDiscovery(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chromecastControl.StartDiscovery(control.DISCOVERY_DURATION * time.Second)
+		writeJson(w, http.StatusAccepted, chromecastControl.GetClients())
+	})
+}
+
+func GetDevice(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		device, ok := chromecastControl.GetClient(vars["name"])
+		if !ok {
+			writeError(w, fmt.Errorf("%w: %s", control.ErrDeviceNotFound, vars["name"]))
+			return
+		}
+		writeJson(w, http.StatusOK, device)
+	})
+}
+
+func PutDevice(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		vars := mux.Vars(r)
+		castInfo := control.Cast{}
+		if err := json.NewDecoder(r.Body).Decode(&castInfo); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		castInfo.Name = vars["name"]
+		if err := chromecastControl.AddStaticCast(castInfo); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		GetDevice(chromecastControl)(w, r)
+	})
+}
+
+func DeleteDevice(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if !chromecastControl.DelCast(vars["name"]) {
+			writeError(w, fmt.Errorf("%w: %s", control.ErrDeviceNotFound, vars["name"]))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func PutReceiverApp(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		vars := mux.Vars(r)
+		app := ReceiverApp{}
+		if err := json.NewDecoder(r.Body).Decode(&app); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		if err := chromecastControl.SetReceiverApp(vars["name"], app.ReceiverAppId); err != nil {
+			writeError(w, err)
+			return
+		}
+		GetDevice(chromecastControl)(w, r)
+	})
+}
+
+func PlayerAction(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		payload := control.ClientAction{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		if err := chromecastControl.ClientControl(payload); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeAccepted(w, chromecastControl)
+	})
+}
+
+func PlayerVolume(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		level, err := chromecastControl.GetVolume()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, Volume{Volume: level})
+	})
+}
+
+func SetPlayerVolume(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		volume := Volume{}
+		if err := json.NewDecoder(r.Body).Decode(&volume); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		if volume.Volume < 0 || volume.Volume > 1 {
+			writeError(w, fmt.Errorf("%w: volume %v is not between 0 and 1", errBadRequest, volume.Volume))
+			return
+		}
+		if err := chromecastControl.SetVolume(volume.Volume); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, volume)
+	})
+}
+
+func PlayerRoom(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, Room{Room: chromecastControl.Room()})
+	})
+}
+
+func SetPlayerRoom(chromecastControl *control.ChromecastControl) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		room := Room{}
+		if err := json.NewDecoder(r.Body).Decode(&room); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+			return
+		}
+		if err := chromecastControl.SetRoom(room.Room); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, room)
+	})
+}
+
+func GetDebugInfo(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, DebugInfo{Goroutines: runtime.NumGoroutine()})
+}
+
+func OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+}
+
+// v1Routes adds the routes of /api/v1 to its subrouter.
+func v1Routes(
+	v1 *mux.Router,
+	cardController *control.CardController,
+	chromecastControl *control.ChromecastControl,
+	events *control.EventBus) {
+	v1.HandleFunc("/openapi.json", OpenAPI).Methods("GET")
+	v1.HandleFunc("/cards", GetCards(cardController)).Methods("GET")
+	v1.HandleFunc("/cards", CreateCard(cardController, chromecastControl)).Methods("POST")
+	v1.HandleFunc("/cards/bulk", UpdateCards(cardController)).Methods("POST")
+	v1.HandleFunc("/tags", GetTags(cardController)).Methods("GET")
+	v1.HandleFunc("/cards/{id}", GetCard(cardController)).Methods("GET")
+	v1.HandleFunc("/cards/{id}", PutCard(cardController, chromecastControl)).Methods("PUT")
+	v1.HandleFunc("/cards/{id}", PatchCard(cardController, chromecastControl)).Methods("PATCH")
+	v1.HandleFunc("/cards/{id}", DeleteCard(cardController)).Methods("DELETE")
+	v1.HandleFunc("/cards/{id}/move", MoveCard(cardController)).Methods("POST")
+	v1.HandleFunc("/cards/{id}/play", StartCard(chromecastControl, cardController)).Methods("POST")
+	v1.HandleFunc("/export", ExportCards(cardController)).Methods("GET")
+	v1.HandleFunc("/import", ImportCards(cardController)).Methods("POST")
+	v1.HandleFunc("/devices", GetCasts(chromecastControl)).Methods("GET")
+	v1.HandleFunc("/devices/discovery", StartDiscovery(chromecastControl)).Methods("POST")
+	v1.HandleFunc("/devices/{name}", GetDevice(chromecastControl)).Methods("GET")
+	v1.HandleFunc("/devices/{name}", PutDevice(chromecastControl)).Methods("PUT")
+	v1.HandleFunc("/devices/{name}", DeleteDevice(chromecastControl)).Methods("DELETE")
+	v1.HandleFunc("/devices/{name}/receiver", PutReceiverApp(chromecastControl)).Methods("PUT")
+	v1.HandleFunc("/player", CastStatus(chromecastControl, cardController)).Methods("GET")
+	v1.HandleFunc("/player/actions", PlayerAction(chromecastControl)).Methods("POST")
+	v1.HandleFunc("/player/volume", PlayerVolume(chromecastControl)).Methods("GET")
+	v1.HandleFunc("/player/volume", SetPlayerVolume(chromecastControl)).Methods("PUT")
+	v1.HandleFunc("/player/room", PlayerRoom(chromecastControl)).Methods("GET")
+	v1.HandleFunc("/player/room", SetPlayerRoom(chromecastControl)).Methods("PUT")
+	v1.HandleFunc("/events", Events(events, chromecastControl)).Methods("GET")
+	v1.HandleFunc("/debug", GetDebugInfo).Methods("GET")
+}
+
+// deprecated marks a route from before /api/v1, pointing clients to the
+// route that replaces it.
+func deprecated(successor string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		handler(w, r)
+	}
+}
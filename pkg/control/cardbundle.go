@@ -0,0 +1,439 @@
+package control
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A card bundle is a zip archive moving cards between players. It
+// holds manifest.json, a CardBundle, and the artwork of the cards that
+// have a file for it under artwork/, named by card id. Entries it does
+// not know are left alone by readers.
+const (
+	CARD_BUNDLE_FORMAT   = "rfidplayer-cards"
+	CARD_BUNDLE_VERSION  = 1
+	CARD_BUNDLE_MANIFEST = "manifest.json"
+	// CARD_ARTWORK_DIR is where artwork is kept in a bundle, and next
+	// to the card store of a player that imported it.
+	CARD_ARTWORK_DIR = "artwork"
+	// CARD_ARTWORK_MAX_SIZE is the largest artwork file a bundle
+	// carries.
+	CARD_ARTWORK_MAX_SIZE = 4 << 20
+)
+
+// ConflictStrategy says what importing does with a card whose id is
+// taken.
+type ConflictStrategy string
+
+const (
+	// CONFLICT_SKIP keeps the card there is.
+	CONFLICT_SKIP ConflictStrategy = "skip"
+	// CONFLICT_OVERWRITE replaces it with the imported one.
+	CONFLICT_OVERWRITE ConflictStrategy = "overwrite"
+	// CONFLICT_RENAME keeps both, storing the imported card under the
+	// first free id made by appending a byte to its own, such as
+	// 0a1b01. It can then be moved to a physical card.
+	CONFLICT_RENAME ConflictStrategy = "rename"
+)
+
+func ParseConflictStrategy(name string) (ConflictStrategy, error) {
+	switch strategy := ConflictStrategy(name); strategy {
+	case CONFLICT_SKIP, CONFLICT_OVERWRITE, CONFLICT_RENAME:
+		return strategy, nil
+	case "":
+		return CONFLICT_SKIP, nil
+	}
+	return "", fmt.Errorf("unknown conflict strategy %q, use skip, overwrite or rename", name)
+}
+
+// CardBundle is the manifest of a card bundle.
+type CardBundle struct {
+	Format   string       `json:"format"`
+	Version  int          `json:"version"`
+	Exported time.Time    `json:"exported"`
+	Cards    []BundleCard `json:"cards"`
+}
+
+// BundleCard is a card with the media it refers to in the local
+// library of the player it was exported from, which the importing
+// player needs to have at the same place: absolute paths on the player
+// itself, and paths relative to the music directory of its MPD device.
+type BundleCard struct {
+	Card
+	LocalMedia []string `json:"local_media,omitempty"`
+	// ArtworkFile is the entry of the bundle with the card's artwork,
+	// when it is a file on the player rather than a URL.
+	ArtworkFile string `json:"artwork_file,omitempty"`
+	artwork     []byte
+}
+
+// ImportOptions says how to import a bundle. Chromecast, when set,
+// replaces the devices of every imported card, for players whose
+// devices are named differently.
+type ImportOptions struct {
+	Strategy   ConflictStrategy
+	Chromecast string
+}
+
+// ImportResult tells what became of each card of a bundle. Renamed
+// maps the ids of the renamed cards to their new ones, Invalid the
+// ids of cards that were not imported to what is wrong with them.
+// MissingMedia lists the local media of imported cards this player
+// does not have, looking up library paths on the MPD device each card
+// plays on. UnknownDevices maps the ids of imported cards to devices
+// this player does not know yet; the cards play on them once found.
+type ImportResult struct {
+	Added          []string            `json:"added"`
+	Overwritten    []string            `json:"overwritten"`
+	Renamed        map[string]string   `json:"renamed"`
+	Skipped        []string            `json:"skipped"`
+	Invalid        map[string]string   `json:"invalid"`
+	MissingMedia   []string            `json:"missing_media"`
+	UnknownDevices map[string][]string `json:"unknown_devices"`
+}
+
+// localMedia returns the path of a media link in the local library,
+// either absolute or relative to the MPD music directory, or an empty
+// string for media on the network.
+func localMedia(link string) string {
+	if strings.HasPrefix(link, "/") {
+		return link
+	}
+	u, err := url.Parse(link)
+	switch {
+	case err != nil:
+		return ""
+	case u.Scheme == "file":
+		return u.Path
+	case u.Scheme == "" && u.Host == "":
+		return u.Path
+	}
+	return ""
+}
+
+// isLibraryPath reports whether a local media path is relative to the
+// MPD music directory.
+func isLibraryPath(path string) bool {
+	return !strings.HasPrefix(path, "/")
+}
+
+// ExportBundle returns the cards with the given ids, or all of them
+// when there are none, as a bundle.
+func (c *CardController) ExportBundle(ids ...string) (CardBundle, error) {
+	cards := c.GetCards()
+	if len(ids) == 0 {
+		for id := range cards {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	bundle := CardBundle{
+		Format:   CARD_BUNDLE_FORMAT,
+		Version:  CARD_BUNDLE_VERSION,
+		Exported: time.Now().UTC(),
+		Cards:    make([]BundleCard, 0, len(ids)),
+	}
+	for _, id := range ids {
+		card, ok := cards[id]
+		if !ok {
+			return CardBundle{}, fmt.Errorf("%w: %s", ErrCardNotFound, id)
+		}
+		bundleCard := BundleCard{Card: card}
+		for _, link := range card.MediaLinks {
+			if path := localMedia(link.Link); path != "" {
+				bundleCard.LocalMedia = append(bundleCard.LocalMedia, path)
+			}
+		}
+		if file := localMedia(card.Artwork); file != "" {
+			data, err := readArtwork(file)
+			if err != nil {
+				slog.Warn("export: artwork left out", "card", id, "error", err)
+			} else {
+				bundleCard.ArtworkFile = path.Join(CARD_ARTWORK_DIR, id+filepath.Ext(file))
+				bundleCard.artwork = data
+			}
+		}
+		bundle.Cards = append(bundle.Cards, bundleCard)
+	}
+	return bundle, nil
+}
+
+// readArtwork reads an artwork file, up to CARD_ARTWORK_MAX_SIZE.
+func readArtwork(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readArtworkFrom(f, file)
+}
+
+func readArtworkFrom(r io.Reader, name string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, CARD_ARTWORK_MAX_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > CARD_ARTWORK_MAX_SIZE {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, CARD_ARTWORK_MAX_SIZE)
+	}
+	return data, nil
+}
+
+// ImportBundle adds the cards of a bundle in one change to the store.
+// Cards that are not valid on this player are left out and reported.
+// Artwork the bundle carries is stored under CARD_ARTWORK_DIR next to
+// the card store.
+func (c *CardController) ImportBundle(bundle CardBundle, options ImportOptions) (ImportResult, error) {
+	result, library, err := c.importBundle(bundle, options)
+	if err != nil {
+		return result, err
+	}
+	// the MPD devices are asked without holding the cards
+	ctx, cancel := context.WithTimeout(context.Background(), MPD_REQUEST_TIMEOUT)
+	defer cancel()
+	addresses := make([]string, 0, len(library))
+	for address := range library {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		media := library[address]
+		missing, err := missingMpdMedia(ctx, media.castInfo, media.paths)
+		if err != nil {
+			slog.Warn("import: library media not checked", "error", err, "device", media.castInfo.Name)
+			missing = media.paths
+		}
+		result.MissingMedia = append(result.MissingMedia, missing...)
+	}
+	return result, nil
+}
+
+// libraryMedia are the library paths of imported cards to look up on
+// an MPD device.
+type libraryMedia struct {
+	castInfo Cast
+	paths    []string
+}
+
+// libraryDevice returns the MPD device a card plays its library paths
+// on: its own, or the room's for a card without one.
+func libraryDevice(castControl *CastController, card Card) (Cast, bool) {
+	if castControl == nil {
+		return Cast{}, false
+	}
+	castInfo, ok := castControl.DefaultCast()
+	if card.Chromecast != "" {
+		castInfo, ok = castControl.GetCastByTarget(CardTarget{Id: card.ChromecastId, Name: card.Chromecast})
+	}
+	return castInfo, ok && castInfo.Kind == KIND_MPD
+}
+
+// importBundle stores the cards of a bundle, and returns the library
+// paths to look up by MPD address. Absolute paths are looked up here.
+func (c *CardController) importBundle(bundle CardBundle, options ImportOptions) (ImportResult, map[string]*libraryMedia, error) {
+	library := make(map[string]*libraryMedia)
+	result := ImportResult{
+		Added:          []string{},
+		Overwritten:    []string{},
+		Renamed:        map[string]string{},
+		Skipped:        []string{},
+		Invalid:        map[string]string{},
+		MissingMedia:   []string{},
+		UnknownDevices: map[string][]string{},
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	put := make([]Card, 0, len(bundle.Cards))
+	taken := func(id string) bool {
+		if _, ok := c.cards[id]; ok {
+			return true
+		}
+		for _, card := range put {
+			if card.Id == id {
+				return true
+			}
+		}
+		return false
+	}
+	for _, bundleCard := range bundle.Cards {
+		card := bundleCard.Card
+		if options.Chromecast != "" {
+			card.Chromecast, card.ChromecastId = options.Chromecast, ""
+			card.Chromecasts, card.ChromecastIds = nil, nil
+		}
+		if c.devices != nil {
+			card, _ = c.devices.ResolveCard(card)
+		}
+		id := card.Id
+		conflict := taken(id)
+		if conflict {
+			switch options.Strategy {
+			case CONFLICT_OVERWRITE:
+			case CONFLICT_RENAME:
+				for i := 1; i < 256 && taken(card.Id); i++ {
+					card.Id = fmt.Sprintf("%s%02x", id, i)
+				}
+				if taken(card.Id) {
+					result.Invalid[id] = "no free id to rename the card to"
+					continue
+				}
+			default:
+				result.Skipped = append(result.Skipped, id)
+				continue
+			}
+		}
+		unknown, err := card.validateLoaded(c.devices)
+		if err != nil {
+			result.Invalid[id] = err.Error()
+			continue
+		}
+		if len(unknown) > 0 {
+			result.UnknownDevices[card.Id] = unknown
+		}
+		if bundleCard.ArtworkFile != "" {
+			file, err := c.storeArtwork(card.Id, bundleCard.ArtworkFile, bundleCard.artwork)
+			if err != nil {
+				return result, nil, fmt.Errorf("artwork of card %s: %w", id, err)
+			}
+			card.Artwork = file
+		}
+		put = append(put, card)
+		switch {
+		case !conflict:
+			result.Added = append(result.Added, id)
+		case card.Id != id:
+			result.Renamed[id] = card.Id
+		default:
+			result.Overwritten = append(result.Overwritten, id)
+		}
+		for _, path := range bundleCard.LocalMedia {
+			if !isLibraryPath(path) {
+				if _, err := os.Stat(path); err != nil {
+					result.MissingMedia = append(result.MissingMedia, path)
+				}
+				continue
+			}
+			castInfo, ok := libraryDevice(c.devices, card)
+			if !ok {
+				// no MPD device to find it on
+				result.MissingMedia = append(result.MissingMedia, path)
+				continue
+			}
+			address := mpdAddress(castInfo)
+			if library[address] == nil {
+				library[address] = &libraryMedia{castInfo: castInfo}
+			}
+			library[address].paths = append(library[address].paths, path)
+		}
+	}
+	if len(put) == 0 {
+		return result, nil, nil
+	}
+	return result, library, c.update(put, nil)
+}
+
+// storeArtwork writes the artwork of an imported card next to the card
+// store and returns its path. Callers hold the mutex.
+func (c *CardController) storeArtwork(id string, name string, data []byte) (string, error) {
+	if c.FileName == "" {
+		return "", errors.New("the cards are not kept in a file to keep artwork next to")
+	}
+	dir, err := filepath.Abs(filepath.Join(filepath.Dir(c.FileName), CARD_ARTWORK_DIR))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, id+path.Ext(name))
+	return file, os.WriteFile(file, data, 0644)
+}
+
+// WriteCardBundle writes a bundle as a zip archive.
+func WriteCardBundle(w io.Writer, bundle CardBundle) error {
+	archive := zip.NewWriter(w)
+	f, err := archive.Create(CARD_BUNDLE_MANIFEST)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(bundle); err != nil {
+		return err
+	}
+	for _, card := range bundle.Cards {
+		if card.ArtworkFile == "" {
+			continue
+		}
+		f, err := archive.Create(card.ArtworkFile)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(card.artwork); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// ReadCardBundle reads a bundle written by WriteCardBundle, by this
+// version or an earlier one.
+func ReadCardBundle(r io.ReaderAt, size int64) (CardBundle, error) {
+	bundle := CardBundle{}
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return bundle, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	f, err := archive.Open(CARD_BUNDLE_MANIFEST)
+	if err != nil {
+		return bundle, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&bundle); err != nil {
+		return bundle, fmt.Errorf("%w: %s: %v", ErrInvalidBundle, CARD_BUNDLE_MANIFEST, err)
+	}
+	if bundle.Format != CARD_BUNDLE_FORMAT {
+		return bundle, fmt.Errorf("%w: format %q is not %q", ErrInvalidBundle, bundle.Format, CARD_BUNDLE_FORMAT)
+	}
+	if bundle.Version < 1 || bundle.Version > CARD_BUNDLE_VERSION {
+		return bundle, fmt.Errorf("%w: version %d is not supported, this player reads up to %d",
+			ErrInvalidBundle, bundle.Version, CARD_BUNDLE_VERSION)
+	}
+	for i, card := range bundle.Cards {
+		if card.ArtworkFile == "" {
+			continue
+		}
+		data, err := readBundleArtwork(archive, card.ArtworkFile)
+		if err != nil {
+			return bundle, fmt.Errorf("%w: artwork of card %s: %v", ErrInvalidBundle, card.Id, err)
+		}
+		bundle.Cards[i].artwork = data
+	}
+	return bundle, nil
+}
+
+// readBundleArtwork reads an artwork entry, which must be in
+// CARD_ARTWORK_DIR.
+func readBundleArtwork(archive *zip.Reader, name string) ([]byte, error) {
+	if path.Dir(name) != CARD_ARTWORK_DIR || path.Clean(name) != name {
+		return nil, fmt.Errorf("%q is not in %s/", name, CARD_ARTWORK_DIR)
+	}
+	f, err := archive.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readArtworkFrom(f, name)
+}
@@ -0,0 +1,261 @@
+package control
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func bundleBytes(t *testing.T, bundle CardBundle) *bytes.Reader {
+	buf := bytes.Buffer{}
+	if err := WriteCardBundle(&buf, bundle); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestCardBundleRoundTrip(t *testing.T) {
+	from, err := NewCardController(filepath.Join(t.TempDir(), "cards.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cards := testCards()
+	cards[1].MediaLinks = append(cards[1].MediaLinks, MediaLink{Link: "file:///music/missing.mp3"})
+	cover := filepath.Join(t.TempDir(), "cover.jpg")
+	if err := os.WriteFile(cover, []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cards[0].Artwork = cover
+	cards[1].Artwork = "http://media/cover.png"
+	for _, card := range cards {
+		if err := from.AddCard(card); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := from.ExportBundle("0a1b", "ffff"); !errors.Is(err, ErrCardNotFound) {
+		t.Fatalf("expected an unknown card to fail the export, got %v", err)
+	}
+	bundle, err := from.ExportBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bundleBytes(t, bundle)
+	read, err := ReadCardBundle(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Cards) != 2 || !reflect.DeepEqual(read.Cards[1].LocalMedia, []string{"/music/missing.mp3"}) {
+		t.Fatalf("unexpected bundle %+v", read)
+	}
+	if read.Cards[0].ArtworkFile != "artwork/0a1b.jpg" || string(read.Cards[0].artwork) != "jpeg" ||
+		read.Cards[1].ArtworkFile != "" {
+		t.Fatalf("unexpected artwork in the bundle %+v", read)
+	}
+
+	fname := filepath.Join(t.TempDir(), "cards.json")
+	to, err := NewCardController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := to.ImportBundle(read, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Added, []string{"0a1b", "0c0d"}) ||
+		!reflect.DeepEqual(result.MissingMedia, []string{"/music/missing.mp3"}) {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	to, err = NewCardController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the artwork file is kept next to the cards
+	cards[0].Artwork = filepath.Join(filepath.Dir(fname), CARD_ARTWORK_DIR, "0a1b.jpg")
+	if data, err := os.ReadFile(cards[0].Artwork); err != nil || string(data) != "jpeg" {
+		t.Fatalf("expected the artwork to be stored: %q %v", data, err)
+	}
+	for _, card := range cards {
+		if stored, _ := to.GetCard(card.Id); !reflect.DeepEqual(stored, card) {
+			t.Fatalf("expected %+v stored, got %+v", card, stored)
+		}
+	}
+}
+
+func TestImportLibraryMedia(t *testing.T) {
+	server := newFakeMpd(t)
+	addr := server.listener.Addr().(*net.TCPAddr)
+	castController := &CastController{}
+	castController.UpdateCast(Cast{Name: "Living room", IPAddr: addr.IP, Port: addr.Port, Kind: KIND_MPD})
+	castController.UpdateCast(Cast{Name: "Attic", IPAddr: net.IPv4(127, 0, 0, 1), Port: 1, Kind: KIND_MPD})
+	from, err := NewCardController(filepath.Join(t.TempDir(), "cards.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from.CheckDevices(castController)
+	cards := []Card{
+		{Id: "0a1b", Name: "Book", Chromecast: "Living room", MaxVolume: 1, MediaLinks: []MediaLink{
+			{Link: "Audiobooks/Chapter 1.mp3"},
+			{Link: "Audiobooks/missing.mp3"},
+			{Link: "http://media/1.mp3"},
+		}},
+		{Id: "0c0d", Name: "Attic", Chromecast: "Attic", MaxVolume: 1, MediaLinks: []MediaLink{
+			{Link: "Music/Song.mp3"},
+		}},
+	}
+	for _, card := range cards {
+		if err := from.AddCard(card); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundle, err := from.ExportBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media := bundle.Cards[0].LocalMedia; !reflect.DeepEqual(media, []string{"Audiobooks/Chapter 1.mp3", "Audiobooks/missing.mp3"}) {
+		t.Fatalf("expected the library paths as local media, got %v", media)
+	}
+
+	to, err := NewCardController(filepath.Join(t.TempDir(), "cards.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	to.CheckDevices(castController)
+	result, err := to.ImportBundle(bundle, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the Attic cannot be reached, so its media cannot be found either
+	if !reflect.DeepEqual(result.Added, []string{"0a1b", "0c0d"}) ||
+		!reflect.DeepEqual(result.MissingMedia, []string{"Music/Song.mp3", "Audiobooks/missing.mp3"}) {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	imported := testCards()
+	imported[0].Name = "Imported"
+	imported[1].Id = "lost"
+	bundle := CardBundle{Format: CARD_BUNDLE_FORMAT, Version: CARD_BUNDLE_VERSION}
+	for _, card := range imported {
+		bundle.Cards = append(bundle.Cards, BundleCard{Card: card})
+	}
+
+	for _, test := range []struct {
+		strategy ConflictStrategy
+		id       string
+		check    func(ImportResult) bool
+	}{
+		{CONFLICT_SKIP, "0a1b", func(r ImportResult) bool {
+			return reflect.DeepEqual(r.Skipped, []string{"0a1b"})
+		}},
+		{CONFLICT_OVERWRITE, "0a1b", func(r ImportResult) bool {
+			return reflect.DeepEqual(r.Overwritten, []string{"0a1b"})
+		}},
+		{CONFLICT_RENAME, "0a1b01", func(r ImportResult) bool {
+			return reflect.DeepEqual(r.Renamed, map[string]string{"0a1b": "0a1b01"})
+		}},
+	} {
+		t.Run(string(test.strategy), func(t *testing.T) {
+			cardController, err := NewCardController(filepath.Join(t.TempDir(), "cards.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cardController.AddCard(testCards()[0]); err != nil {
+				t.Fatal(err)
+			}
+			result, err := cardController.ImportBundle(bundle, ImportOptions{Strategy: test.strategy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(result) {
+				t.Fatalf("unexpected result %+v", result)
+			}
+			if _, ok := result.Invalid["lost"]; !ok {
+				t.Fatalf("expected the card with an invalid id to be reported, got %+v", result)
+			}
+			card, _ := cardController.GetCard(test.id)
+			wantName := "Imported"
+			if test.strategy == CONFLICT_SKIP {
+				wantName = "Songs"
+			}
+			if card.Name != wantName {
+				t.Fatalf("expected %s to be %q, got %+v", test.id, wantName, card)
+			}
+		})
+	}
+}
+
+func TestImportChromecast(t *testing.T) {
+	castController := &CastController{}
+	castController.UpdateCast(Cast{
+		Name:   "Living Room",
+		IPAddr: net.IPv4(192, 168, 1, 22),
+		Port:   8009,
+		Info:   map[string]string{"id": "uuid-living"},
+	})
+	cardController, err := NewCardController(filepath.Join(t.TempDir(), "cards.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cardController.CheckDevices(castController)
+	bundle := CardBundle{Format: CARD_BUNDLE_FORMAT, Version: CARD_BUNDLE_VERSION}
+	for _, card := range testCards() {
+		bundle.Cards = append(bundle.Cards, BundleCard{Card: card})
+	}
+
+	result, err := cardController.ImportBundle(bundle, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cards for devices not found yet are added and play on them later
+	want := map[string][]string{"0a1b": {"Kitchen"}, "0c0d": {"Bedroom", "Attic"}}
+	if len(result.Added) != 2 || !reflect.DeepEqual(result.UnknownDevices, want) {
+		t.Fatalf("expected the unknown devices to be reported, got %+v", result)
+	}
+	result, err = cardController.ImportBundle(bundle, ImportOptions{
+		Strategy:   CONFLICT_OVERWRITE,
+		Chromecast: "Living Room",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Overwritten) != 2 || len(result.UnknownDevices) != 0 {
+		t.Fatalf("expected both cards to be replaced, got %+v", result)
+	}
+	card, _ := cardController.GetCard("0c0d")
+	if card.Chromecast != "Living Room" || card.ChromecastId != "uuid-living" || card.Chromecasts != nil {
+		t.Fatalf("expected the card to play on Living Room, got %+v", card)
+	}
+}
+
+func TestReadCardBundleErrors(t *testing.T) {
+	if _, err := ReadCardBundle(bytes.NewReader([]byte("not a zip")), 9); !errors.Is(err, ErrInvalidBundle) {
+		t.Fatalf("expected a broken archive to fail, got %v", err)
+	}
+	empty := bytes.Buffer{}
+	zip.NewWriter(&empty).Close()
+	if _, err := ReadCardBundle(bytes.NewReader(empty.Bytes()), int64(empty.Len())); !errors.Is(err, ErrInvalidBundle) {
+		t.Fatalf("expected an archive without a manifest to fail, got %v", err)
+	}
+	for _, bundle := range []CardBundle{
+		{Format: "other", Version: CARD_BUNDLE_VERSION},
+		{Format: CARD_BUNDLE_FORMAT, Version: CARD_BUNDLE_VERSION + 1},
+		{Format: CARD_BUNDLE_FORMAT},
+		{Format: CARD_BUNDLE_FORMAT, Version: CARD_BUNDLE_VERSION, Cards: []BundleCard{
+			{Card: testCards()[0], ArtworkFile: "../cover.jpg"},
+		}},
+		{Format: CARD_BUNDLE_FORMAT, Version: CARD_BUNDLE_VERSION, Cards: []BundleCard{
+			{Card: testCards()[0], ArtworkFile: "artwork/0a1b.jpg", artwork: make([]byte, CARD_ARTWORK_MAX_SIZE+1)},
+		}},
+	} {
+		r := bundleBytes(t, bundle)
+		if _, err := ReadCardBundle(r, r.Size()); !errors.Is(err, ErrInvalidBundle) {
+			t.Fatalf("expected %+v to be refused, got %v", bundle, err)
+		}
+	}
+}
@@ -1,92 +1,559 @@
 package control
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log/slog"
-	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/vkl/rfidplayer/pkg/logging"
 )
 
+type MediaLink struct {
+	Link        string `json:"link"`
+	ContentType string `json:"content_type"`
+}
+
 type Card struct {
-	Id         string `json:"id"`
-	Name       string `json:"name"`
-	MediaLinks []struct {
-		Link        string `json:"link"`
-		ContentType string `json:"content_type"`
-	} `json:"media_links"`
-	Chromecast string  `json:"chromecast"`
-	MaxVolume  float64 `json:"maxvolume"`
+	Id         string      `json:"id"`
+	Name       string      `json:"name"`
+	MediaLinks []MediaLink `json:"media_links"`
+	Chromecast string      `json:"chromecast"`
+	// ChromecastId is the UUID of the Chromecast device. It is filled
+	// in once the device has been seen and is what the card is played
+	// on; the name is only a fallback.
+	ChromecastId string `json:"chromecast_id,omitempty"`
+	// Chromecasts lists further devices the card plays on together
+	// with Chromecast, and ChromecastIds their UUIDs in the same order.
+	Chromecasts   []string `json:"chromecasts,omitempty"`
+	ChromecastIds []string `json:"chromecast_ids,omitempty"`
+	MaxVolume     float64  `json:"maxvolume"`
+	// ReceiverAppId is the Cast receiver app to play the card with
+	// instead of the device's, for example a custom receiver showing
+	// the card's artwork.
+	ReceiverAppId string `json:"receiver_app_id,omitempty"`
+	// Artwork is an image for the card, such as an album cover: an
+	// http or https URL, or a file on the player, which card bundles
+	// carry along.
+	Artwork string `json:"artwork,omitempty"`
+	// Tags put the card in collections such as Bedtime or Audiobooks.
+	// The first one is the collection the card is listed under.
+	Tags []string `json:"tags,omitempty"`
+	// Type makes the card a command card, one of the COMMAND_ types,
+	// instead of playing media. SleepMinutes and Volume are what sleep
+	// and volume cards set; output cards switch to Chromecast.
+	Type         string  `json:"type,omitempty"`
+	SleepMinutes int     `json:"sleep_minutes,omitempty"`
+	Volume       float64 `json:"volume,omitempty"`
+}
+
+// HasTag reports whether the card has the tag, ignoring case.
+func (c Card) HasTag(tag string) bool {
+	return hasTag(c.Tags, tag)
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// ETag identifies this version of the card for conditional requests.
+func (c Card) ETag() string {
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("\"%x\"", sum[:8])
 }
 
+// CardTarget is a device a card plays on.
+type CardTarget struct {
+	Id   string
+	Name string
+}
+
+func (t CardTarget) String() string {
+	if t.Name == "" {
+		return t.Id
+	}
+	return t.Name
+}
+
+// Targets returns all devices the card plays on.
+func (c Card) Targets() []CardTarget {
+	targets := make([]CardTarget, 0, len(c.Chromecasts)+1)
+	seen := make(map[string]bool)
+	add := func(target CardTarget) {
+		key := target.Id
+		if key == "" {
+			key = target.Name
+		}
+		if key == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		targets = append(targets, target)
+	}
+	add(CardTarget{Id: c.ChromecastId, Name: c.Chromecast})
+	for i, name := range c.Chromecasts {
+		target := CardTarget{Name: name}
+		if i < len(c.ChromecastIds) {
+			target.Id = c.ChromecastIds[i]
+		}
+		add(target)
+	}
+	return targets
+}
+
+// CARD_WATCH_INTERVAL is how often the card store is checked for
+// changes made from outside.
+const CARD_WATCH_INTERVAL = 2 * time.Second
+
+// CardController holds the cards. It is safe for concurrent use:
+// readers get copies, and cards are replaced rather than modified, so
+// the slices of a card handed out are never written to.
 type CardController struct {
 	FileName string
-	Cards    map[string]Card
-	mutex    sync.Mutex
+	store    CardStore
+	cards    map[string]Card
+	devices  *CastController
+	// events are where WatchStore publishes reloads
+	events *EventBus
+	mutex  sync.Mutex
 }
 
+// NewCardController opens the card store at fname, as OpenCardStore
+// does.
 func NewCardController(fname string) (*CardController, error) {
-	cardController := &CardController{
-		FileName: fname,
-		Cards:    make(map[string]Card, 0),
+	store, err := OpenCardStore(fname)
+	if err != nil {
+		return &CardController{}, err
 	}
-	if err := cardController.updateCardList(); err != nil {
+	cardController, err := NewCardControllerWithStore(store)
+	if err != nil {
+		store.Close()
 		return &CardController{}, err
 	}
+	cardController.FileName = fname
 	return cardController, nil
 }
 
-func (c *CardController) updateCardList() error {
+func NewCardControllerWithStore(store CardStore) (*CardController, error) {
+	cards, err := store.Load()
+	if err != nil {
+		return &CardController{}, err
+	}
+	return &CardController{store: store, cards: cards}, nil
+}
+
+// Close closes the card store.
+func (c *CardController) Close() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	f, err := os.OpenFile(c.FileName, os.O_CREATE|os.O_RDONLY, 0644)
-	if err != nil {
-		return err
+	return c.store.Close()
+}
+
+// GetCards returns a copy of all cards.
+func (c *CardController) GetCards() map[string]Card {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cards := make(map[string]Card, len(c.cards))
+	for id, card := range c.cards {
+		cards[id] = card
 	}
-	defer f.Close()
-	decoder := json.NewDecoder(f)
-	if err := decoder.Decode(&c.Cards); err != nil {
-		if err != io.EOF {
-			return err
+	return cards
+}
+
+func (c *CardController) GetCard(id string) (Card, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	card, ok := c.cards[id]
+	return card, ok
+}
+
+// GetCardsTagged returns a copy of the cards having any of the tags.
+func (c *CardController) GetCardsTagged(tags ...string) map[string]Card {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cards := make(map[string]Card)
+	for id, card := range c.cards {
+		for _, tag := range tags {
+			if card.HasTag(tag) {
+				cards[id] = card
+				break
+			}
 		}
 	}
-	return nil
+	return cards
 }
 
-func (c *CardController) GetCards() map[string]Card {
-	if err := c.updateCardList(); err != nil {
-		slog.Error("", "error", err)
+// GetTags returns how many cards have each tag. Tags differing only in
+// case are counted as one, under the spelling seen first in id order.
+func (c *CardController) GetTags() map[string]int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ids := make([]string, 0, len(c.cards))
+	for id := range c.cards {
+		ids = append(ids, id)
 	}
-	return c.Cards
+	sort.Strings(ids)
+	tags := make(map[string]int)
+	spelling := make(map[string]string)
+	for _, id := range ids {
+		for _, tag := range c.cards[id].Tags {
+			key := strings.ToLower(tag)
+			if _, ok := spelling[key]; !ok {
+				spelling[key] = tag
+			}
+			tags[spelling[key]]++
+		}
+	}
+	return tags
+}
+
+// CheckDevices makes AddCard refuse cards naming devices castControl
+// does not know.
+func (c *CardController) CheckDevices(castControl *CastController) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.devices = castControl
 }
 
+// AddCard adds or replaces a card after validating it. The error of an
+// invalid card is a *ValidationError.
 func (c *CardController) AddCard(card Card) error {
-	c.Cards[card.Id] = card
-	return c.save()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := card.Validate(c.devices); err != nil {
+		return err
+	}
+	return c.update([]Card{card}, nil)
+}
+
+// CreateCard adds a card that does not exist yet.
+func (c *CardController) CreateCard(card Card) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.cards[card.Id]; ok {
+		return fmt.Errorf("%w: %s", ErrCardExists, card.Id)
+	}
+	if err := card.Validate(c.devices); err != nil {
+		return err
+	}
+	return c.update([]Card{card}, nil)
+}
+
+// ReplaceCard stores the card in place of the one with its id, or adds
+// it, and reports whether it was added. A non-empty etag must be the
+// ETag of the card being replaced, or "*" for any card, so that changes
+// made since the caller read the card are not lost.
+func (c *CardController) ReplaceCard(card Card, etag string) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	current, ok := c.cards[card.Id]
+	if err := checkETag(card.Id, current, ok, etag); err != nil {
+		return false, err
+	}
+	if err := card.Validate(c.devices); err != nil {
+		return false, err
+	}
+	return !ok, c.update([]Card{card}, nil)
+}
+
+// MoveCard gives a card a new id, for when a physical card is replaced.
+// Everything else about the card stays as it was. The etag is checked
+// as by ReplaceCard.
+func (c *CardController) MoveCard(id string, newId string, etag string) (Card, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	card, ok := c.cards[id]
+	if !ok {
+		return Card{}, fmt.Errorf("%w: %s", ErrCardNotFound, id)
+	}
+	if err := checkETag(id, card, ok, etag); err != nil {
+		return Card{}, err
+	}
+	if _, ok := c.cards[newId]; ok {
+		return Card{}, fmt.Errorf("%w: %s", ErrCardExists, newId)
+	}
+	card.Id = newId
+	if err := card.Validate(c.devices); err != nil {
+		return Card{}, err
+	}
+	if err := c.update([]Card{card}, []string{id}); err != nil {
+		return Card{}, err
+	}
+	return card, nil
+}
+
+// UpdateCards applies change to each of the cards with the given ids,
+// for changing many cards at once. Either all the changed cards are
+// valid and stored or none is. The cards are returned as stored.
+func (c *CardController) UpdateCards(ids []string, change func(Card) Card) ([]Card, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	put := make([]Card, 0, len(ids))
+	for _, id := range ids {
+		card, ok := c.cards[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrCardNotFound, id)
+		}
+		card = change(card)
+		if card.Id != id {
+			return nil, fmt.Errorf("%w: %s: the id cannot be changed", ErrInvalidCard, id)
+		}
+		if c.devices != nil {
+			card, _ = c.devices.ResolveCard(card)
+		}
+		if err := card.Validate(c.devices); err != nil {
+			return nil, fmt.Errorf("card %s: %w", id, err)
+		}
+		put = append(put, card)
+	}
+	if len(put) == 0 {
+		return put, nil
+	}
+	return put, c.update(put, nil)
+}
+
+// CardsChange is a change made to many cards at once. What is left
+// empty is not changed.
+type CardsChange struct {
+	// Chromecast is the device the cards are to play on alone. Without
+	// one, Room makes them play in the room the player is in.
+	Chromecast string  `json:"chromecast,omitempty"`
+	Room       bool    `json:"room,omitempty"`
+	MaxVolume  float64 `json:"maxvolume,omitempty"`
+	// AddTags are added to the cards not having them yet, RemoveTags
+	// removed, ignoring case.
+	AddTags    []string `json:"add_tags,omitempty"`
+	RemoveTags []string `json:"remove_tags,omitempty"`
+}
+
+// Apply returns the card with the change made.
+func (change CardsChange) Apply(card Card) Card {
+	if change.Chromecast != "" || change.Room {
+		card.Chromecast, card.ChromecastId = change.Chromecast, ""
+		card.Chromecasts, card.ChromecastIds = nil, nil
+	}
+	if change.MaxVolume != 0 {
+		card.MaxVolume = change.MaxVolume
+	}
+	if len(change.AddTags)+len(change.RemoveTags) > 0 {
+		tags := make([]string, 0, len(card.Tags)+len(change.AddTags))
+		for _, tag := range card.Tags {
+			if !hasTag(change.RemoveTags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		for _, tag := range change.AddTags {
+			if !hasTag(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			tags = nil
+		}
+		card.Tags = tags
+	}
+	return card
+}
+
+// ChangeCards makes the change to the cards with the given ids, as
+// UpdateCards does.
+func (c *CardController) ChangeCards(ids []string, change CardsChange) ([]Card, error) {
+	return c.UpdateCards(ids, change.Apply)
+}
+
+// checkETag checks the etag a caller has for the current card.
+func checkETag(id string, current Card, ok bool, etag string) error {
+	switch {
+	case etag == "":
+		return nil
+	case !ok:
+		return fmt.Errorf("%w: %s no longer exists", ErrCardChanged, id)
+	case etag != "*" && etag != current.ETag():
+		return fmt.Errorf("%w: %s", ErrCardChanged, id)
+	}
+	return nil
 }
 
 func (c *CardController) DelCard(id string) bool {
-	if _, ok := c.Cards[id]; !ok {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.cards[id]; !ok {
 		return false
 	}
-	delete(c.Cards, id)
-	c.save()
+	if err := c.update(nil, []string{id}); err != nil {
+		slog.Error("delete card", "error", err, "card", id)
+	}
 	return true
 }
 
-func (c *CardController) save() error {
+// ResolveDevices records the UUID of the devices of every card that
+// have been seen, and follows devices renamed since. Cards written
+// before devices were referenced by UUID are migrated this way.
+func (c *CardController) ResolveDevices(castControl *CastController) (int, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	f, err := os.OpenFile(c.FileName, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
-	if err != nil {
-		return err
+	resolved := make([]Card, 0)
+	for _, card := range c.cards {
+		if card, changed := castControl.ResolveCard(card); changed {
+			resolved = append(resolved, card)
+		}
+	}
+	if len(resolved) == 0 {
+		return 0, nil
+	}
+	return len(resolved), c.update(resolved, nil)
+}
+
+// FollowDevices resolves card devices now and again whenever a device
+// is found, renamed or moved.
+func (c *CardController) FollowDevices(events *EventBus, castControl *CastController) {
+	if count, err := c.ResolveDevices(castControl); err != nil {
+		slog.Error("resolve card devices", "error", err)
+	} else if count > 0 {
+		slog.Info("card devices resolved", "cards", count)
+	}
+	ch, _ := events.Subscribe()
+	go func() {
+		for event := range ch {
+			if event.Type == EVENT_DEVICE_OFFLINE {
+				continue
+			}
+			if _, ok := event.Data.(DeviceEvent); !ok {
+				continue
+			}
+			count, err := c.ResolveDevices(castControl)
+			if err != nil {
+				slog.Error("resolve card devices", "error", err)
+			} else if count > 0 {
+				slog.Info("card devices resolved", "cards", count, "event", event.Type)
+			}
+		}
+	}()
+}
+
+// WatchStore reloads the cards when the store is changed from outside,
+// such as a cards.json edited over SSH, until ctx is done. The cards
+// added or changed must be valid, or the ones held are kept. Reloads
+// are published as EVENT_CARDS_RELOADED and failures as EVENT_ERROR.
+func (c *CardController) WatchStore(ctx context.Context, events *EventBus) {
+	store, ok := c.store.(ReloadableCardStore)
+	if !ok {
+		return
+	}
+	c.mutex.Lock()
+	c.events = events
+	c.mutex.Unlock()
+	go func() {
+		ticker := time.NewTicker(CARD_WATCH_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.reload(store, events)
+			}
+		}
+	}()
+}
+
+func (c *CardController) reload(store ReloadableCardStore, events *EventBus) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reloadLocked(store, events)
+}
+
+// reloadLocked is reload for callers holding the mutex.
+func (c *CardController) reloadLocked(store ReloadableCardStore, events *EventBus) {
+	var diff CardsReloadedEvent
+	reloaded, err := store.Reload(func(cards map[string]Card) error {
+		diff = diffCards(c.cards, cards)
+		invalid := make([]string, 0)
+		for _, id := range append(append([]string{}, diff.Added...), diff.Changed...) {
+			unknown, err := cards[id].validateLoaded(c.devices)
+			if err != nil {
+				invalid = append(invalid, fmt.Sprintf("card %s: %v", id, err))
+			} else if len(unknown) > 0 {
+				slog.Warn("reload cards: devices not found yet", "card", id, "devices", unknown)
+			}
+			if cards[id].Id != id {
+				invalid = append(invalid, fmt.Sprintf("card %s: has id %q", id, cards[id].Id))
+			}
+		}
+		if len(invalid) > 0 {
+			return errors.New(strings.Join(invalid, "; "))
+		}
+		c.cards = make(map[string]Card, len(cards))
+		for id, card := range cards {
+			c.cards[id] = card
+		}
+		return nil
+	})
+	switch {
+	case !reloaded:
+	case err != nil:
+		slog.Error("reload cards, keeping the previous ones", "error", err)
+		events.Publish(EVENT_ERROR, ErrorEvent{Source: "cards", Message: err.Error()})
+	case len(diff.Added)+len(diff.Changed)+len(diff.Removed) > 0:
+		slog.Info("cards reloaded", "added", diff.Added, "changed", diff.Changed, "removed", diff.Removed)
+		events.Publish(EVENT_CARDS_RELOADED, diff)
+	}
+}
+
+// diffCards returns the ids of the cards added, changed and removed
+// going from before to after, in order.
+func diffCards(before map[string]Card, after map[string]Card) CardsReloadedEvent {
+	diff := CardsReloadedEvent{Added: []string{}, Changed: []string{}, Removed: []string{}}
+	for id, card := range after {
+		previous, ok := before[id]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, id)
+		case !reflect.DeepEqual(previous, card):
+			diff.Changed = append(diff.Changed, id)
+		}
 	}
-	defer f.Close()
-	encoder := json.NewEncoder(f)
-	if err := encoder.Encode(c.Cards); err != nil {
+	for id := range before {
+		if _, ok := after[id]; !ok {
+			diff.Removed = append(diff.Removed, id)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Changed)
+	sort.Strings(diff.Removed)
+	return diff
+}
+
+// update writes the changes to the store, then makes them. When the
+// store was changed from outside, nothing is written and the change is
+// reloaded instead, so that the caller can retry on the cards as they
+// are now. Callers hold the mutex.
+func (c *CardController) update(put []Card, del []string) error {
+	if err := c.store.Update(put, del); err != nil {
+		if store, ok := c.store.(ReloadableCardStore); ok && errors.Is(err, ErrCardsChanged) {
+			slog.Warn("cards changed outside the player, not written", "error", err)
+			c.reloadLocked(store, c.events)
+		}
 		return err
 	}
+	for _, id := range del {
+		delete(c.cards, id)
+	}
+	for _, card := range put {
+		c.cards[card.Id] = card
+	}
 	return nil
 }
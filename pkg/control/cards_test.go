@@ -0,0 +1,484 @@
+package control
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResolveDevices(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "cards.json")
+	err := os.WriteFile(fname, []byte(`{
+		"card1": {"id": "card1", "chromecast": "Kitchen", "chromecasts": ["Bedroom", "Attic"]},
+		"card2": {"id": "card2", "chromecast": "Attic"}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cardController, err := NewCardController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	castControl := &CastController{}
+	castControl.UpdateCast(Cast{
+		Name:   "Kitchen",
+		IPAddr: net.IPv4(192, 168, 1, 20),
+		Port:   8009,
+		Info:   map[string]string{"id": "uuid-kitchen"},
+	})
+	castControl.UpdateCast(Cast{
+		Name:   "Bedroom",
+		IPAddr: net.IPv4(192, 168, 1, 21),
+		Port:   8009,
+		Info:   map[string]string{"id": "uuid-bedroom"},
+	})
+
+	if count, err := cardController.ResolveDevices(castControl); err != nil || count != 1 {
+		t.Fatalf("expected one card migrated, got %d %v", count, err)
+	}
+	cardController, err = NewCardController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, _ := cardController.GetCard("card1")
+	if card.ChromecastId != "uuid-kitchen" ||
+		len(card.ChromecastIds) != 2 ||
+		card.ChromecastIds[0] != "uuid-bedroom" ||
+		card.ChromecastIds[1] != "" {
+		t.Fatalf("card was not migrated: %+v", card)
+	}
+
+	// the card follows the device when it is renamed
+	castControl.UpdateCast(Cast{
+		Name:   "Kitchen speaker",
+		IPAddr: net.IPv4(192, 168, 1, 20),
+		Port:   8009,
+		Info:   map[string]string{"id": "uuid-kitchen"},
+	})
+	cast, ok := castControl.GetCastByTarget(card.Targets()[0])
+	if !ok || cast.Name != "Kitchen speaker" {
+		t.Fatalf("renamed device was not found by UUID: %+v", cast)
+	}
+	if count, _ := cardController.ResolveDevices(castControl); count != 1 {
+		t.Fatalf("expected one card updated, got %d", count)
+	}
+	if card, _ := cardController.GetCard("card1"); card.Chromecast != "Kitchen speaker" {
+		t.Fatalf("card name was not updated: %+v", card)
+	}
+	if count, _ := cardController.ResolveDevices(castControl); count != 0 {
+		t.Fatalf("expected nothing to migrate, got %d", count)
+	}
+}
+
+func TestCardValidation(t *testing.T) {
+	castControl := &CastController{}
+	castControl.UpdateCast(Cast{Name: "Kitchen", IPAddr: net.IPv4(192, 168, 1, 20), Port: 8009})
+	castControl.UpdateCast(Cast{Name: "Study", Kind: KIND_MPD, IPAddr: net.IPv4(192, 168, 1, 30), Port: MPD_DEFAULT_PORT})
+	valid := Card{
+		Id:         "0a1b",
+		Chromecast: "Kitchen",
+		MaxVolume:  0.5,
+		MediaLinks: []MediaLink{
+			{Link: "http://media/1.mp3", ContentType: "audio/mpeg"},
+			{Link: "/music/2.flac"},
+		},
+	}
+	tests := []struct {
+		name   string
+		change func(card *Card)
+		fields []string
+	}{
+		{"valid", func(card *Card) {}, nil},
+		{"no id", func(card *Card) { card.Id = "" }, []string{"id"}},
+		{"id not hex", func(card *Card) { card.Id = "card1" }, []string{"id"}},
+		{"id upper case", func(card *Card) { card.Id = "0A1B" }, []string{"id"}},
+		{"zero max volume", func(card *Card) { card.MaxVolume = 0 }, []string{"maxvolume"}},
+		{"no media", func(card *Card) { card.MediaLinks = nil }, []string{"media_links"}},
+		{"bad links", func(card *Card) {
+			card.MediaLinks = []MediaLink{
+				{Link: "media/1.mp3"},
+				{Link: "http://media/2.mp3", ContentType: "text/html"},
+				{Link: "ftp://media/3.mp3"},
+			}
+		}, []string{"media_links[0].link", "media_links[1].content_type", "media_links[2].link"}},
+		{"mpd library paths", func(card *Card) {
+			card.Chromecast = "Study"
+			card.MediaLinks = []MediaLink{{Link: "Albums/Blue/01 Track.flac"}, {Link: "http://media/2.mp3"}}
+		}, nil},
+		{"library path on a cast device", func(card *Card) {
+			card.MediaLinks = []MediaLink{{Link: "Albums/Blue/01 Track.flac"}}
+		}, []string{"media_links[0].link"}},
+		{"unknown device", func(card *Card) { card.Chromecast = "Attic" }, []string{"chromecast"}},
+		{"room device", func(card *Card) { card.Chromecast = "" }, nil},
+		{"group without device", func(card *Card) {
+			card.Chromecast, card.Chromecasts = "", []string{"Kitchen"}
+		}, []string{"chromecast"}},
+		{"unknown group member", func(card *Card) {
+			card.Chromecasts = []string{"Kitchen", "Attic"}
+		}, []string{"chromecasts[0]", "chromecasts[1]"}},
+		{"bad receiver app", func(card *Card) { card.ReceiverAppId = "app" }, []string{"receiver_app_id"}},
+		{"artwork", func(card *Card) { card.Artwork = "http://media/cover.jpg" }, nil},
+		{"bad artwork", func(card *Card) { card.Artwork = "cover.jpg" }, []string{"artwork"}},
+		{"bad tags", func(card *Card) {
+			card.Tags = []string{"Bedtime", "", " Music", "a,b", "bedtime"}
+		}, []string{"tags[1]", "tags[2]", "tags[3]", "tags[4]"}},
+		{"stop card", func(card *Card) {
+			*card = Card{Id: "0a1b", Type: COMMAND_STOP}
+		}, nil},
+		{"unknown command", func(card *Card) { card.Type = "eject" }, []string{"type"}},
+		{"unknown output device", func(card *Card) {
+			*card = Card{Id: "0a1b", Type: COMMAND_OUTPUT, Chromecast: "Attic"}
+		}, []string{"chromecast"}},
+		{"room card without device", func(card *Card) {
+			*card = Card{Id: "0a1b", Type: COMMAND_ROOM}
+		}, []string{"chromecast"}},
+		{"bad sleep card", func(card *Card) {
+			*card = Card{Id: "0a1b", Type: COMMAND_SLEEP, SleepMinutes: MAX_SLEEP_MINUTES + 1}
+		}, []string{"sleep_minutes"}},
+		{"bad volume card", func(card *Card) {
+			*card = Card{Id: "0a1b", Type: COMMAND_VOLUME}
+		}, []string{"volume"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			card := valid
+			test.change(&card)
+			err := card.Validate(castControl)
+			if test.fields == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) || !errors.Is(err, ErrInvalidCard) {
+				t.Fatalf("expected a validation error, got %v", err)
+			}
+			fields := make([]string, 0)
+			for _, field := range validationErr.Fields {
+				fields = append(fields, field.Field)
+			}
+			if !reflect.DeepEqual(fields, test.fields) {
+				t.Fatalf("expected errors for %v, got %v", test.fields, validationErr.Fields)
+			}
+		})
+	}
+}
+
+func TestAddCardValidates(t *testing.T) {
+	cardController, err := NewCardController(filepath.Join(t.TempDir(), "cards.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cardController.CheckDevices(&CastController{})
+	err = cardController.AddCard(Card{
+		Id:         "0a1b",
+		Chromecast: "Kitchen",
+		MaxVolume:  1,
+		MediaLinks: []MediaLink{{Link: "http://media/1.mp3"}},
+	})
+	if !errors.Is(err, ErrInvalidCard) {
+		t.Fatalf("expected the unknown device to be refused, got %v", err)
+	}
+	if _, ok := cardController.GetCard("0a1b"); ok {
+		t.Fatal("invalid card was stored")
+	}
+}
+
+func TestChangeCards(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "cards.json")
+	cardController, err := NewCardController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cards := testCards()
+	cards[0].Tags = []string{"Music"}
+	cards[1].Tags = []string{"Bedtime", "music"}
+	for _, card := range cards {
+		if err := cardController.AddCard(card); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tagged := cardController.GetCardsTagged("MUSIC"); len(tagged) != 2 {
+		t.Fatalf("expected both cards tagged music, got %v", tagged)
+	}
+	if tagged := cardController.GetCardsTagged("bedtime", "audiobooks"); len(tagged) != 1 {
+		t.Fatalf("expected one card tagged bedtime, got %v", tagged)
+	}
+	if tags := cardController.GetTags(); !reflect.DeepEqual(tags, map[string]int{"Music": 2, "Bedtime": 1}) {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+
+	ids := []string{"0a1b", "0c0d"}
+	if _, err := cardController.ChangeCards(ids, CardsChange{MaxVolume: 2}); !errors.Is(err, ErrInvalidCard) {
+		t.Fatalf("expected an invalid max volume to be refused, got %v", err)
+	}
+	if _, err := cardController.ChangeCards([]string{"0a1b", "ffff"}, CardsChange{MaxVolume: 0.2}); !errors.Is(err, ErrCardNotFound) {
+		t.Fatalf("expected an unknown card to be refused, got %v", err)
+	}
+	if card, _ := cardController.GetCard("0a1b"); card.MaxVolume != 0.5 {
+		t.Fatalf("expected no card changed by a failed change, got %+v", card)
+	}
+	changed, err := cardController.ChangeCards(ids, CardsChange{
+		Chromecast: "Attic",
+		MaxVolume:  0.3,
+		AddTags:    []string{"Kids", "bedtime"},
+		RemoveTags: []string{"MUSIC"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Card{cards[0], cards[1]}
+	want[0].Tags = []string{"Kids", "bedtime"}
+	want[1].Tags = []string{"Bedtime", "Kids"}
+	for i := range want {
+		want[i].Chromecast, want[i].Chromecasts, want[i].MaxVolume = "Attic", nil, 0.3
+	}
+	if !reflect.DeepEqual(changed, want) {
+		t.Fatalf("expected %+v, got %+v", want, changed)
+	}
+
+	cardController, err = NewCardController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, card := range want {
+		if stored, _ := cardController.GetCard(card.Id); !reflect.DeepEqual(stored, card) {
+			t.Fatalf("expected %+v stored, got %+v", card, stored)
+		}
+	}
+}
+
+func TestReplaceCardETag(t *testing.T) {
+	cardController, err := NewCardController(filepath.Join(t.TempDir(), "cards.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	card := Card{
+		Id:         "0a1b",
+		Name:       "Songs",
+		Chromecast: "Kitchen",
+		MaxVolume:  1,
+		MediaLinks: []MediaLink{{Link: "http://media/1.mp3"}},
+	}
+	if err := cardController.CreateCard(card); err != nil {
+		t.Fatal(err)
+	}
+	if err := cardController.CreateCard(card); !errors.Is(err, ErrCardExists) {
+		t.Fatalf("expected the card to exist, got %v", err)
+	}
+	etag := card.ETag()
+
+	// someone else changes the card after it was read
+	changed := card
+	changed.Name = "Other songs"
+	if created, err := cardController.ReplaceCard(changed, etag); err != nil || created {
+		t.Fatalf("expected the card replaced, got %t %v", created, err)
+	}
+	card.MaxVolume = 0.5
+	if _, err := cardController.ReplaceCard(card, etag); !errors.Is(err, ErrCardChanged) {
+		t.Fatalf("expected a stale ETag to be refused, got %v", err)
+	}
+	if _, err := cardController.ReplaceCard(card, changed.ETag()); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := cardController.GetCard("0a1b"); stored.MaxVolume != 0.5 {
+		t.Fatalf("card was not replaced: %+v", stored)
+	}
+
+	card.Id = "0c0d"
+	if _, err := cardController.ReplaceCard(card, "*"); !errors.Is(err, ErrCardChanged) {
+		t.Fatalf("expected If-Match * to need a card, got %v", err)
+	}
+	if created, err := cardController.ReplaceCard(card, ""); err != nil || !created {
+		t.Fatalf("expected the card created, got %t %v", created, err)
+	}
+}
+
+func TestMoveCard(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "cards.json")
+	cardController, err := NewCardController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card := Card{
+		Id:           "0a1b",
+		Name:         "Songs",
+		Chromecast:   "Kitchen",
+		ChromecastId: "uuid-kitchen",
+		MaxVolume:    0.5,
+		MediaLinks:   []MediaLink{{Link: "http://media/1.mp3"}},
+	}
+	other := card
+	other.Id = "0c0d"
+	cardController.AddCard(card)
+	cardController.AddCard(other)
+
+	if _, err := cardController.MoveCard("0a1b", "0c0d", ""); !errors.Is(err, ErrCardExists) {
+		t.Fatalf("expected moving onto a card to fail, got %v", err)
+	}
+	if _, err := cardController.MoveCard("0a1b", "lost", ""); !errors.Is(err, ErrInvalidCard) {
+		t.Fatalf("expected an invalid id to be refused, got %v", err)
+	}
+	if _, err := cardController.MoveCard("0a1b", "0e0f", `"stale"`); !errors.Is(err, ErrCardChanged) {
+		t.Fatalf("expected a stale ETag to be refused, got %v", err)
+	}
+	moved, err := cardController.MoveCard("0a1b", "0e0f", card.ETag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	card.Id = "0e0f"
+	if !reflect.DeepEqual(moved, card) {
+		t.Fatalf("expected %+v, got %+v", card, moved)
+	}
+
+	cardController, err = NewCardController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cardController.GetCard("0a1b"); ok {
+		t.Fatal("card is still under its old id")
+	}
+	if stored, _ := cardController.GetCard("0e0f"); !reflect.DeepEqual(stored, card) {
+		t.Fatalf("expected %+v stored, got %+v", card, stored)
+	}
+}
+
+func TestReloadCards(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "cards.json")
+	cardController, err := NewCardController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, card := range testCards() {
+		if err := cardController.AddCard(card); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := cardController.store.(ReloadableCardStore)
+	events := NewEventBus()
+	ch, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+	edit := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cardController.reload(store, events)
+	}
+	nextEvent := func() Event {
+		t.Helper()
+		select {
+		case event := <-ch:
+			return event
+		default:
+			t.Fatal("no event")
+		}
+		return Event{}
+	}
+
+	// nothing happens until the file changes
+	cardController.reload(store, events)
+	if len(ch) > 0 {
+		t.Fatalf("unexpected event %+v", <-ch)
+	}
+
+	edit(`{
+		"0a1b": {"id": "0a1b", "name": "Songs", "chromecast": "Kitchen", "maxvolume": 0.8,
+			"media_links": [{"link": "http://media/1.mp3", "content_type": "audio/mpeg"}]},
+		"0e0f": {"id": "0e0f", "name": "New", "chromecast": "Kitchen", "maxvolume": 1,
+			"media_links": [{"link": "http://media/3.mp3"}]}
+	}`)
+	event := nextEvent()
+	want := CardsReloadedEvent{Added: []string{"0e0f"}, Changed: []string{"0a1b"}, Removed: []string{"0c0d"}}
+	if event.Type != EVENT_CARDS_RELOADED || !reflect.DeepEqual(event.Data, want) {
+		t.Fatalf("expected %+v, got %+v", want, event)
+	}
+	if card, _ := cardController.GetCard("0a1b"); card.MaxVolume != 0.8 {
+		t.Fatalf("card was not reloaded: %+v", card)
+	}
+
+	// a card for a device not found yet is reloaded
+	cardController.CheckDevices(&CastController{})
+	edit(`{
+		"0a1b": {"id": "0a1b", "name": "Songs", "chromecast": "Kitchen", "maxvolume": 0.8,
+			"media_links": [{"link": "http://media/1.mp3", "content_type": "audio/mpeg"}]},
+		"0e0f": {"id": "0e0f", "name": "New", "chromecast": "Attic", "maxvolume": 1,
+			"media_links": [{"link": "http://media/3.mp3"}]}
+	}`)
+	event = nextEvent()
+	want = CardsReloadedEvent{Added: []string{}, Changed: []string{"0e0f"}, Removed: []string{}}
+	if event.Type != EVENT_CARDS_RELOADED || !reflect.DeepEqual(event.Data, want) {
+		t.Fatalf("expected %+v, got %+v", want, event)
+	}
+	if card, _ := cardController.GetCard("0e0f"); card.Chromecast != "Attic" {
+		t.Fatalf("card was not reloaded: %+v", card)
+	}
+	cardController.CheckDevices(nil)
+	edit(`{
+		"0a1b": {"id": "0a1b", "name": "Songs", "chromecast": "Kitchen", "maxvolume": 0.8,
+			"media_links": [{"link": "http://media/1.mp3", "content_type": "audio/mpeg"}]},
+		"0e0f": {"id": "0e0f", "name": "New", "chromecast": "Kitchen", "maxvolume": 1,
+			"media_links": [{"link": "http://media/3.mp3"}]}
+	}`)
+	nextEvent()
+
+	// a broken file or an invalid card keeps the cards as they were
+	for _, content := range []string{
+		`{"0a1b": {"id": "0a1b", `,
+		`{"0a1b": {"id": "0a1b", "chromecast": "Kitchen", "maxvolume": 0, "media_links": [{"link": "http://media/1.mp3"}]}}`,
+	} {
+		edit(content)
+		if event := nextEvent(); event.Type != EVENT_ERROR {
+			t.Fatalf("expected an error, got %+v", event)
+		}
+		if cards := cardController.GetCards(); len(cards) != 2 || cards["0a1b"].MaxVolume != 0.8 {
+			t.Fatalf("expected the previous cards, got %+v", cards)
+		}
+	}
+
+	// a change through the player does not write over an edit it has
+	// not reloaded yet, but reloads it
+	cardController.events = events
+	if err := os.WriteFile(fname, []byte(`{
+		"0a1b": {"id": "0a1b", "name": "Songs", "chromecast": "Kitchen", "maxvolume": 0.8,
+			"media_links": [{"link": "http://media/1.mp3", "content_type": "audio/mpeg"}]},
+		"0e0f": {"id": "0e0f", "name": "New", "chromecast": "Kitchen", "maxvolume": 1,
+			"media_links": [{"link": "http://media/3.mp3"}]},
+		"0a0b": {"id": "0a0b", "name": "Edited", "chromecast": "Kitchen", "maxvolume": 1,
+			"media_links": [{"link": "http://media/4.mp3"}]}
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	extra := Card{Id: "0c0e", Name: "Extra", Chromecast: "Kitchen", MaxVolume: 1,
+		MediaLinks: []MediaLink{{Link: "http://media/5.mp3"}}}
+	if err := cardController.AddCard(extra); !errors.Is(err, ErrCardsChanged) {
+		t.Fatalf("expected the edit to be reported, got %v", err)
+	}
+	event = nextEvent()
+	want = CardsReloadedEvent{Added: []string{"0a0b"}, Changed: []string{}, Removed: []string{}}
+	if event.Type != EVENT_CARDS_RELOADED || !reflect.DeepEqual(event.Data, want) {
+		t.Fatalf("expected %+v, got %+v", want, event)
+	}
+	if err := cardController.AddCard(extra); err != nil {
+		t.Fatal(err)
+	}
+	if !cardController.DelCard("0a0b") || !cardController.DelCard("0c0e") {
+		t.Fatal("card was not deleted")
+	}
+
+	// the next change through the player writes the good cards back
+	if !cardController.DelCard("0e0f") {
+		t.Fatal("card was not deleted")
+	}
+	cardController, err = NewCardController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cards := cardController.GetCards(); len(cards) != 1 || cards["0a1b"].MaxVolume != 0.8 {
+		t.Fatalf("expected the good card written back, got %+v", cards)
+	}
+}
@@ -0,0 +1,275 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/vkl/rfidplayer/pkg/logging"
+)
+
+// CARD_STORE_BACKUPS is how many earlier versions of a JSON card file
+// are kept next to it, as cards.json.1 for the newest.
+const CARD_STORE_BACKUPS = 3
+
+// CARD_STORE_CORRUPT_SUFFIX is added to the name of a JSON card file
+// that cannot be read when its backup is used instead.
+const CARD_STORE_CORRUPT_SUFFIX = ".corrupt"
+
+// CardStore keeps the cards between runs. The CardController owning a
+// store makes one call at a time.
+type CardStore interface {
+	// Load returns all stored cards by id.
+	Load() (map[string]Card, error)
+	// Update stores the cards in put and removes the ids in del, all
+	// of it or none.
+	Update(put []Card, del []string) error
+	Close() error
+}
+
+// ReloadableCardStore is a CardStore that is also changed from outside
+// the player, such as a card file edited by hand.
+type ReloadableCardStore interface {
+	CardStore
+	// Reload reads the cards again when they were changed from outside
+	// since they were last read or written, and reports whether they
+	// were. The cards read are handed to accept and only replace the
+	// store's when it returns nil.
+	Reload(accept func(cards map[string]Card) error) (bool, error)
+}
+
+// OpenCardStore opens the card store at location, a bolt database for
+// the .db and .bolt extensions and a JSON file otherwise.
+func OpenCardStore(location string) (CardStore, error) {
+	switch strings.ToLower(filepath.Ext(location)) {
+	case ".db", ".bolt":
+		return openBoltCardStore(location)
+	default:
+		return openJsonCardStore(location)
+	}
+}
+
+// MigrateCards copies every card from one store to another, which must
+// not have any cards yet, and returns how many were copied.
+func MigrateCards(from CardStore, to CardStore) (int, error) {
+	existing, err := to.Load()
+	if err != nil {
+		return 0, err
+	}
+	if len(existing) > 0 {
+		return 0, fmt.Errorf("destination already has %d cards", len(existing))
+	}
+	cards, err := from.Load()
+	if err != nil {
+		return 0, err
+	}
+	put := make([]Card, 0, len(cards))
+	for _, card := range cards {
+		put = append(put, card)
+	}
+	if err := to.Update(put, nil); err != nil {
+		return 0, err
+	}
+	return len(put), nil
+}
+
+// jsonCardStore keeps the cards in a JSON file, the way they have
+// always been kept. Every change writes a new file next to the old one
+// and renames it into place, so a crash leaves either version whole.
+type jsonCardStore struct {
+	fileName string
+	cards    map[string]Card
+	// modTime and size tell whether the file was changed since it was
+	// last read or written.
+	modTime time.Time
+	size    int64
+}
+
+func openJsonCardStore(fileName string) (*jsonCardStore, error) {
+	s := &jsonCardStore{fileName: fileName}
+	cards, err := readCardFile(fileName)
+	if err != nil {
+		// fall back to the newest backup that can be read
+		for i := 1; i <= CARD_STORE_BACKUPS; i++ {
+			backup := s.backup(i)
+			if cards, backupErr := readCardFile(backup); backupErr == nil {
+				slog.Warn("card file unreadable, using backup", "file", fileName, "backup", backup, "error", err)
+				// keep the file aside, so that the next write neither
+				// rotates it over the backups nor loses it
+				corrupt := fileName + CARD_STORE_CORRUPT_SUFFIX
+				if renameErr := os.Rename(fileName, corrupt); renameErr != nil {
+					slog.Warn("card file unreadable, not moved", "file", fileName, "error", renameErr)
+				} else {
+					slog.Warn("card file unreadable, moved aside", "file", fileName, "to", corrupt)
+				}
+				s.cards = cards
+				s.stat()
+				return s, nil
+			}
+		}
+		return nil, err
+	}
+	s.cards = cards
+	s.stat()
+	return s, nil
+}
+
+// stat remembers the file as it is now, and reports whether it was
+// changed since it was last remembered. A missing file counts as
+// unchanged, as the next write creates it.
+func (s *jsonCardStore) stat() bool {
+	info, changed := s.changed()
+	if info != nil {
+		s.modTime, s.size = info.ModTime(), info.Size()
+	}
+	return changed
+}
+
+// changed reports whether the file was changed since it was last
+// remembered, without remembering it.
+func (s *jsonCardStore) changed() (os.FileInfo, bool) {
+	info, err := os.Stat(s.fileName)
+	if err != nil {
+		return nil, false
+	}
+	return info, !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+func readCardFile(fileName string) (map[string]Card, error) {
+	cards := make(map[string]Card)
+	f, err := os.Open(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return cards, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&cards); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	if cards == nil {
+		cards = make(map[string]Card)
+	}
+	return cards, nil
+}
+
+func (s *jsonCardStore) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.fileName, i)
+}
+
+func (s *jsonCardStore) Load() (map[string]Card, error) {
+	cards := make(map[string]Card, len(s.cards))
+	for id, card := range s.cards {
+		cards[id] = card
+	}
+	return cards, nil
+}
+
+// Update fails with ErrCardsChanged when the file was changed since it
+// was last read or written, rather than write over the change; Reload
+// reads it.
+func (s *jsonCardStore) Update(put []Card, del []string) error {
+	if _, changed := s.changed(); changed {
+		return fmt.Errorf("%w: %s", ErrCardsChanged, s.fileName)
+	}
+	cards, _ := s.Load()
+	for _, id := range del {
+		delete(cards, id)
+	}
+	for _, card := range put {
+		cards[card.Id] = card
+	}
+	if err := s.write(cards); err != nil {
+		return err
+	}
+	s.cards = cards
+	s.stat()
+	return nil
+}
+
+// Reload reads the file again when it was changed. A file that cannot
+// be read is reported once, not again until it changes.
+func (s *jsonCardStore) Reload(accept func(cards map[string]Card) error) (bool, error) {
+	if !s.stat() {
+		return false, nil
+	}
+	cards, err := readCardFile(s.fileName)
+	if err != nil {
+		return true, err
+	}
+	if err := accept(cards); err != nil {
+		return true, err
+	}
+	s.cards = cards
+	return true, nil
+}
+
+// write replaces the file with the cards, keeping the file it replaces
+// as the newest backup.
+func (s *jsonCardStore) write(cards map[string]Card) error {
+	dir := filepath.Dir(s.fileName)
+	f, err := os.CreateTemp(dir, filepath.Base(s.fileName)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := json.NewEncoder(f).Encode(cards); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	if err := s.rotateBackups(); err != nil {
+		slog.Warn("card file backup", "file", s.fileName, "error", err)
+	}
+	if err := os.Rename(f.Name(), s.fileName); err != nil {
+		return err
+	}
+	// make the rename itself survive a crash
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// rotateBackups shifts the backups up by one and copies the current
+// file to the first. A file that is not valid JSON is not kept, so it
+// never pushes out a good backup.
+func (s *jsonCardStore) rotateBackups() error {
+	data, err := os.ReadFile(s.fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 && !json.Valid(data) {
+		return fmt.Errorf("%s is not valid JSON, not kept as a backup", s.fileName)
+	}
+	for i := CARD_STORE_BACKUPS - 1; i >= 1; i-- {
+		if err := os.Rename(s.backup(i), s.backup(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.WriteFile(s.backup(1), data, 0644)
+}
+
+func (s *jsonCardStore) Close() error {
+	return nil
+}
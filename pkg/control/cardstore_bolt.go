@@ -0,0 +1,77 @@
+package control
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// CARD_STORE_OPEN_TIMEOUT is how long opening a bolt card store waits
+// for another process holding it.
+const CARD_STORE_OPEN_TIMEOUT = 5 * time.Second
+
+var cardsBucket = []byte("cards")
+
+// boltCardStore keeps the cards in an embedded bolt database, one JSON
+// encoded card per key. Changes are written in transactions, so only
+// the cards that changed are written and a crash loses none.
+type boltCardStore struct {
+	db *bolt.DB
+}
+
+func openBoltCardStore(fileName string) (*boltCardStore, error) {
+	db, err := bolt.Open(fileName, 0644, &bolt.Options{Timeout: CARD_STORE_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(cardsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltCardStore{db: db}, nil
+}
+
+func (s *boltCardStore) Load() (map[string]Card, error) {
+	cards := make(map[string]Card)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(cardsBucket).ForEach(func(k, v []byte) error {
+			card := Card{}
+			if err := json.Unmarshal(v, &card); err != nil {
+				return err
+			}
+			cards[string(k)] = card
+			return nil
+		})
+	})
+	return cards, err
+}
+
+func (s *boltCardStore) Update(put []Card, del []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(cardsBucket)
+		for _, id := range del {
+			if err := bucket.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		for _, card := range put {
+			data, err := json.Marshal(card)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(card.Id), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltCardStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,143 @@
+package control
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testCards() []Card {
+	return []Card{
+		{Id: "0a1b", Name: "Songs", Chromecast: "Kitchen", MaxVolume: 0.5,
+			MediaLinks: []MediaLink{{Link: "http://media/1.mp3", ContentType: "audio/mpeg"}}},
+		{Id: "0c0d", Name: "Story", Chromecast: "Bedroom", Chromecasts: []string{"Attic"}, MaxVolume: 1,
+			MediaLinks: []MediaLink{{Link: "http://media/2.mp3"}}},
+	}
+}
+
+func TestCardStores(t *testing.T) {
+	for _, name := range []string{"cards.json", "cards.db"} {
+		t.Run(name, func(t *testing.T) {
+			location := filepath.Join(t.TempDir(), name)
+			store, err := OpenCardStore(location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cards := testCards()
+			if err := store.Update(cards, nil); err != nil {
+				t.Fatal(err)
+			}
+			moved := cards[0]
+			moved.Id = "0e0f"
+			if err := store.Update([]Card{moved}, []string{"0a1b"}); err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+
+			store, err = OpenCardStore(location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			loaded, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]Card{"0e0f": moved, "0c0d": cards[1]}
+			if !reflect.DeepEqual(loaded, want) {
+				t.Fatalf("expected %+v, got %+v", want, loaded)
+			}
+		})
+	}
+}
+
+func TestJsonCardStoreBackups(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "cards.json")
+	store, err := OpenCardStore(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, card := range testCards() {
+		if err := store.Update([]Card{card}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if _, err := os.Stat(fname + ".1"); !os.IsNotExist(err) {
+				t.Fatalf("expected no backup of a new file, got %v", err)
+			}
+		}
+	}
+	if leftovers, _ := filepath.Glob(fname + ".tmp*"); len(leftovers) > 0 {
+		t.Fatalf("temporary files left behind: %v", leftovers)
+	}
+
+	// a torn write falls back to the newest backup
+	if err := os.WriteFile(fname, []byte(`{"0a1b": {"id": "0a`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err = OpenCardStore(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := store.Load()
+	if len(loaded) != 1 || loaded["0a1b"].Name != "Songs" {
+		t.Fatalf("expected the backup with the first card, got %+v", loaded)
+	}
+	if data, err := os.ReadFile(fname + CARD_STORE_CORRUPT_SUFFIX); err != nil || string(data) != `{"0a1b": {"id": "0a` {
+		t.Fatalf("expected the torn file to be kept aside: %q %v", data, err)
+	}
+	if changed, err := store.(ReloadableCardStore).Reload(func(map[string]Card) error { return nil }); changed || err != nil {
+		t.Fatalf("expected no reload after falling back: %v %v", changed, err)
+	}
+	backup, _ := os.ReadFile(fname + ".1")
+	if err := store.Update([]Card{testCards()[1]}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(fname + ".1"); string(data) != string(backup) {
+		t.Fatalf("expected the good backup to be kept, got %q", data)
+	}
+
+	// nor is a torn file that stays in place kept as a backup
+	if err := os.WriteFile(fname, []byte(`{"0a1b": {"id": "0a`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backup, _ = os.ReadFile(fname + ".1")
+	if err := store.Update([]Card{testCards()[0]}, nil); !errors.Is(err, ErrCardsChanged) {
+		t.Fatalf("expected the change to be reported, got %v", err)
+	}
+	if _, err := store.(ReloadableCardStore).Reload(func(map[string]Card) error { return nil }); err == nil {
+		t.Fatal("expected the torn file not to be reloaded")
+	}
+	if err := store.Update([]Card{testCards()[0]}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(fname + ".1"); string(data) != string(backup) {
+		t.Fatalf("expected the torn file not to be kept as a backup, got %q", data)
+	}
+}
+
+func TestMigrateCards(t *testing.T) {
+	dir := t.TempDir()
+	from, err := OpenCardStore(filepath.Join(dir, "cards.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from.Update(testCards(), nil)
+	to, err := OpenCardStore(filepath.Join(dir, "cards.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+	if count, err := MigrateCards(from, to); err != nil || count != 2 {
+		t.Fatalf("expected 2 cards migrated, got %d %v", count, err)
+	}
+	want, _ := from.Load()
+	if got, _ := to.Load(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if _, err := MigrateCards(from, to); err == nil {
+		t.Fatal("expected migrating onto cards to fail")
+	}
+}
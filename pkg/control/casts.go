@@ -2,21 +2,53 @@ package control
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"sort"
 	"sync"
+	"time"
 
 	_ "github.com/vkl/rfidplayer/pkg/logging"
 )
 
+const (
+	CAST_SAVE_INTERVAL      = 1 * time.Minute
+	CHROMECAST_DEFAULT_PORT = 8009
+)
+
 type Cast struct {
 	Name   string `json:"name"`
 	IPAddr net.IP
 	Port   int
 	Info   map[string]string
+	Kind   string `json:"kind,omitempty"`
+	// LastSeen is when discovery last found the device.
+	LastSeen time.Time `json:"last_seen"`
+	// Static entries are added by hand for networks where discovery
+	// does not work.
+	Static bool `json:"static,omitempty"`
+	Online bool `json:"online"`
+	// ReceiverAppId is the Cast receiver app cards are played with on
+	// this device when they do not name one. Empty means the Default
+	// Media Receiver.
+	ReceiverAppId string `json:"receiver_app_id,omitempty"`
+	// Default marks the device cards without one of their own play on,
+	// the room the player is in. At most one device is the default.
+	Default bool `json:"default,omitempty"`
+}
+
+// Id returns the device UUID from the TXT record, which stays the same
+// when the device is renamed or changes address.
+func (c Cast) Id() string {
+	return c.Info["id"]
+}
+
+// IsGroup reports whether the cast is a Google Home speaker group.
+func (c Cast) IsGroup() bool {
+	return c.Info["md"] == CAST_GROUP_MODEL
 }
 
 type Casts []Cast
@@ -33,16 +65,19 @@ func (c Casts) Swap(i, j int) {
 	c[i], c[j] = c[j], c[i]
 }
 
+// CastController holds the device list. It is safe for concurrent use:
+// readers get copies, and entries are replaced rather than modified, so
+// the Info maps handed out are never written to.
 type CastController struct {
 	FileName string
-	Casts    Casts
+	casts    Casts
 	mutex    sync.Mutex
 }
 
 func NewCastController(fname string) (*CastController, error) {
 	castController := &CastController{
 		FileName: fname,
-		Casts:    make(Casts, 0),
+		casts:    make(Casts, 0),
 	}
 	if err := castController.updateCastList(); err != nil {
 		return &CastController{}, err
@@ -50,6 +85,26 @@ func NewCastController(fname string) (*CastController, error) {
 	return castController, nil
 }
 
+// ReadCastController reads the device list of the file without
+// creating or ever saving it, for tools that only look devices up. A
+// missing file is an empty list.
+func ReadCastController(fname string) (*CastController, error) {
+	castController := &CastController{casts: make(Casts, 0)}
+	f, err := os.Open(fname)
+	if errors.Is(err, os.ErrNotExist) {
+		return castController, nil
+	}
+	if err != nil {
+		return &CastController{}, err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	if err := decoder.Decode(&castController.casts); err != nil && err != io.EOF {
+		return &CastController{}, err
+	}
+	return castController, nil
+}
+
 func (c *CastController) updateCastList() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -59,7 +114,7 @@ func (c *CastController) updateCastList() error {
 	}
 	defer f.Close()
 	decoder := json.NewDecoder(f)
-	if err := decoder.Decode(&c.Casts); err != nil {
+	if err := decoder.Decode(&c.casts); err != nil {
 		if err != io.EOF {
 			return err
 		}
@@ -68,7 +123,29 @@ func (c *CastController) updateCastList() error {
 }
 
 func (c *CastController) GetCastByName(name string) (Cast, bool) {
-	for _, cast := range c.Casts {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.castByName(name)
+}
+
+func (c *CastController) GetCastById(id string) (Cast, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.castById(id)
+}
+
+// GetCastByTarget finds a card target by UUID, falling back to the
+// name for devices not seen since the card was written.
+func (c *CastController) GetCastByTarget(target CardTarget) (Cast, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.castByTarget(target)
+}
+
+// castByName, castById and castByTarget are the lookups for callers
+// that hold the mutex.
+func (c *CastController) castByName(name string) (Cast, bool) {
+	for _, cast := range c.casts {
 		if cast.Name == name {
 			return cast, true
 		}
@@ -76,57 +153,223 @@ func (c *CastController) GetCastByName(name string) (Cast, bool) {
 	return Cast{}, false
 }
 
+func (c *CastController) castById(id string) (Cast, bool) {
+	if id == "" {
+		return Cast{}, false
+	}
+	for _, cast := range c.casts {
+		if cast.Id() == id {
+			return cast, true
+		}
+	}
+	return Cast{}, false
+}
+
+func (c *CastController) castByTarget(target CardTarget) (Cast, bool) {
+	if cast, ok := c.castById(target.Id); ok {
+		return cast, true
+	}
+	return c.castByName(target.Name)
+}
+
+// ResolveCard fills in the UUIDs of the card devices that are known and
+// updates their names to the current ones.
+func (c *CastController) ResolveCard(card Card) (Card, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	changed := false
+	resolve := func(id, name *string) {
+		cast, ok := c.castByTarget(CardTarget{Id: *id, Name: *name})
+		if !ok || cast.Id() == "" {
+			return
+		}
+		if *id != cast.Id() || *name != cast.Name {
+			*id, *name = cast.Id(), cast.Name
+			changed = true
+		}
+	}
+	resolve(&card.ChromecastId, &card.Chromecast)
+	if len(card.Chromecasts) > 0 {
+		names := append([]string{}, card.Chromecasts...)
+		ids := make([]string, len(names))
+		copy(ids, card.ChromecastIds)
+		for i := range names {
+			resolve(&ids[i], &names[i])
+		}
+		card.Chromecasts, card.ChromecastIds = names, ids
+	}
+	return card, changed
+}
+
+// GetCasts returns a copy of the device list sorted by name.
 func (c *CastController) GetCasts() Casts {
-	// if err := c.updateCastList(); err != nil {
-	// 	slog.Error("", "error", err)
-	// }
-	sort.Sort(c.Casts)
-	return c.Casts
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	casts := make(Casts, len(c.casts))
+	copy(casts, c.casts)
+	sort.Sort(casts)
+	return casts
 }
 
 func (c *CastController) AddCast(cast Cast) error {
-	if _, ok := c.GetCastByName(cast.Name); ok {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.castByName(cast.Name); ok {
 		return fmt.Errorf("the cast %s already exists", cast.Name)
 	}
-	c.Casts = append(c.Casts, cast)
-	return nil // c.save()
+	c.casts = append(c.casts, cast)
+	return c.save()
 }
 
-func (c *CastController) UpdateCast(cast Cast) error {
+// AddStaticCast adds or replaces a device entered by hand.
+func (c *CastController) AddStaticCast(cast Cast) error {
+	if cast.Port == 0 {
+		switch cast.Kind {
+		case "", KIND_CHROMECAST:
+			cast.Port = CHROMECAST_DEFAULT_PORT
+		case KIND_MPD:
+			cast.Port = MPD_DEFAULT_PORT
+		}
+	}
 	if cast.Name == "" || cast.IPAddr == nil || cast.Port == 0 {
 		return fmt.Errorf("cast validation error: %v", cast)
 	}
-	for i, value := range c.Casts {
+	info := make(map[string]string, len(cast.Info)+1)
+	for key, value := range cast.Info {
+		info[key] = value
+	}
+	if info["fn"] == "" {
+		info["fn"] = cast.Name
+	}
+	cast.Info = info
+	cast.Static = true
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, value := range c.casts {
 		if cast.Name == value.Name {
-			c.Casts[i] = cast
-			return nil // c.save()
+			cast.LastSeen = value.LastSeen
+			cast.Default = value.Default
+			c.casts[i] = cast
+			return c.save()
+		}
+	}
+	c.casts = append(c.casts, cast)
+	return c.save()
+}
+
+// UpdateCast records a device found by discovery, matching it by UUID
+// first so that a renamed device replaces its old entry. The list is
+// only written out when the device is new, has changed, or was last
+// saved more than CAST_SAVE_INTERVAL ago, as discovery reports every
+// device many times a minute.
+func (c *CastController) UpdateCast(cast Cast) error {
+	if cast.Name == "" || cast.IPAddr == nil || cast.Port == 0 {
+		return fmt.Errorf("cast validation error: %v", cast)
+	}
+	cast.LastSeen = time.Now()
+	cast.Online = true
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, value := range c.casts {
+		if (cast.Id() != "" && cast.Id() == value.Id()) || cast.Name == value.Name {
+			cast.Static = value.Static
+			cast.ReceiverAppId = value.ReceiverAppId
+			cast.Default = value.Default
+			changed := !cast.IPAddr.Equal(value.IPAddr) ||
+				cast.Port != value.Port ||
+				cast.Kind != value.Kind ||
+				cast.Name != value.Name ||
+				!value.Online ||
+				cast.LastSeen.Sub(value.LastSeen) > CAST_SAVE_INTERVAL
+			c.casts[i] = cast
+			if !changed {
+				return nil
+			}
+			return c.save()
 		}
 	}
-	c.Casts = append(c.Casts, cast)
-	return nil // c.save()
+	c.casts = append(c.casts, cast)
+	return c.save()
+}
+
+// SetReceiverApp sets the receiver app cards without one are played
+// with on the device.
+func (c *CastController) SetReceiverApp(name string, appId string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, cast := range c.casts {
+		if cast.Name == name {
+			c.casts[i].ReceiverAppId = appId
+			return c.save()
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrDeviceNotFound, name)
+}
+
+// SetDefaultCast makes the named device the one cards without a device
+// play on, or leaves them without one for an empty name.
+func (c *CastController) SetDefaultCast(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.castByName(name); !ok && name != "" {
+		return fmt.Errorf("%w: %s", ErrDeviceNotFound, name)
+	}
+	for i := range c.casts {
+		c.casts[i].Default = c.casts[i].Name == name
+	}
+	return c.save()
+}
+
+// DefaultCast returns the device cards without one play on.
+func (c *CastController) DefaultCast() (Cast, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, cast := range c.casts {
+		if cast.Default {
+			return cast, true
+		}
+	}
+	return Cast{}, false
+}
+
+// SetOffline marks a device discovery has not seen for a while.
+func (c *CastController) SetOffline(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, cast := range c.casts {
+		if cast.Name == name {
+			c.casts[i].Online = false
+			return c.save()
+		}
+	}
+	return fmt.Errorf("no such cast: %s", name)
 }
 
 func (c *CastController) DelCast(name string) bool {
-	for i, cast := range c.Casts {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, cast := range c.casts {
 		if cast.Name == name {
-			c.Casts = append(c.Casts[:i], c.Casts[i+1:]...)
-			// c.save()
+			c.casts = append(c.casts[:i], c.casts[i+1:]...)
+			c.save()
 			return true
 		}
 	}
 	return false
 }
 
+// save writes the device list out. Callers hold the mutex.
 func (c *CastController) save() error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	if c.FileName == "" {
+		return nil
+	}
 	f, err := os.OpenFile(c.FileName, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 	encoder := json.NewEncoder(f)
-	if err := encoder.Encode(c.Casts); err != nil {
+	if err := encoder.Encode(c.casts); err != nil {
 		return err
 	}
 	return nil
@@ -1,13 +1,17 @@
 package control
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestCasts(t *testing.T) {
-	c, err := NewCastController("debug.json")
+	fname := filepath.Join(t.TempDir(), "debug.json")
+	c, err := NewCastController(fname)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -21,3 +25,141 @@ func TestCasts(t *testing.T) {
 	}
 	fmt.Println(c.GetCasts())
 }
+
+func TestCastsPersisted(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "casts.json")
+	c, err := NewCastController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateCast(Cast{
+		Name:   "Kitchen",
+		IPAddr: net.IPv4(192, 168, 1, 20),
+		Port:   8009,
+		Info:   map[string]string{"fn": "Kitchen"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddStaticCast(Cast{
+		Name:   "Garage",
+		IPAddr: net.IPv4(10, 0, 0, 5),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddStaticCast(Cast{Name: "Nowhere"}); err == nil {
+		t.Fatal("expected validation error for a static cast without address")
+	}
+
+	c, err = NewCastController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kitchen, ok := c.GetCastByName("Kitchen")
+	if !ok || kitchen.LastSeen.IsZero() || kitchen.Static {
+		t.Fatalf("discovered cast was not restored: %+v", kitchen)
+	}
+	garage, ok := c.GetCastByName("Garage")
+	if !ok || !garage.Static || garage.Port != CHROMECAST_DEFAULT_PORT || garage.Info["fn"] != "Garage" {
+		t.Fatalf("static cast was not restored: %+v", garage)
+	}
+
+	// rediscovering a static entry keeps it static
+	if err := c.UpdateCast(Cast{
+		Name:   "Garage",
+		IPAddr: net.IPv4(10, 0, 0, 6),
+		Port:   8009,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if garage, _ := c.GetCastByName("Garage"); !garage.Static || !garage.IPAddr.Equal(net.IPv4(10, 0, 0, 6)) {
+		t.Fatalf("unexpected cast after rediscovery: %+v", garage)
+	}
+	if !c.DelCast("Garage") {
+		t.Fatal("could not delete static cast")
+	}
+	c, _ = NewCastController(fname)
+	if _, ok := c.GetCastByName("Garage"); ok {
+		t.Fatal("deleted cast was restored")
+	}
+}
+
+func TestDefaultCast(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "casts.json")
+	c, err := NewCastController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Kitchen", "Bedroom"} {
+		if err := c.AddStaticCast(Cast{Name: name, IPAddr: net.IPv4(10, 0, 0, 5)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := c.DefaultCast(); ok {
+		t.Fatal("expected no default device")
+	}
+	if err := c.SetDefaultCast("Attic"); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("expected an unknown device to be refused, got %v", err)
+	}
+	c.SetDefaultCast("Kitchen")
+	if err := c.SetDefaultCast("Bedroom"); err != nil {
+		t.Fatal(err)
+	}
+	// rediscovering the device keeps it the default
+	c.UpdateCast(Cast{Name: "Bedroom", IPAddr: net.IPv4(10, 0, 0, 6), Port: 8009})
+
+	c, err = NewCastController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cast, ok := c.DefaultCast(); !ok || cast.Name != "Bedroom" {
+		t.Fatalf("expected Bedroom to be the default, got %+v", cast)
+	}
+	if kitchen, _ := c.GetCastByName("Kitchen"); kitchen.Default {
+		t.Fatal("expected one default device")
+	}
+	if err := c.SetDefaultCast(""); err != nil {
+		t.Fatal(err)
+	}
+	if cast, ok := c.DefaultCast(); ok {
+		t.Fatalf("expected no default device, got %+v", cast)
+	}
+}
+
+func TestReadCastController(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "casts.json")
+	c, err := ReadCastController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.GetCasts()) != 0 {
+		t.Fatalf("expected no devices, got %v", c.GetCasts())
+	}
+	if _, err := os.Stat(fname); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the file not to be created, got %v", err)
+	}
+
+	saved, err := NewCastController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saved.AddStaticCast(Cast{Name: "Kitchen", IPAddr: net.IPv4(10, 0, 0, 5)}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = ReadCastController(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.GetCastByName("Kitchen"); !ok {
+		t.Fatal("expected the saved device")
+	}
+	if err := c.AddCast(LocalCast()); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(fname); string(after) != string(before) {
+		t.Fatalf("expected the file to be left as it is, got %s", after)
+	}
+}
@@ -0,0 +1,445 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vkl/go-cast"
+	"github.com/vkl/go-cast/api"
+	"github.com/vkl/go-cast/controllers"
+	_ "github.com/vkl/rfidplayer/pkg/logging"
+)
+
+const (
+	CAST_HEARTBEAT_INTERVAL  = 10 * time.Second
+	CAST_STATUS_INTERVAL     = 2 * time.Second
+	CAST_REQUEST_TIMEOUT     = 10 * time.Second
+	CAST_PROBE_TIMEOUT       = 3 * time.Second
+	CAST_RECONNECT_MIN_DELAY = 1 * time.Second
+	CAST_RECONNECT_MAX_DELAY = 1 * time.Minute
+)
+
+const castNamespaceConnection = "urn:x-cast:com.google.cast.tp.connection"
+
+// reconnectDelay is the backoff before the next attempt after the
+// given number of failed connection attempts.
+func reconnectDelay(failures int) time.Duration {
+	delay := CAST_RECONNECT_MIN_DELAY
+	for i := 1; i < failures && delay < CAST_RECONNECT_MAX_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > CAST_RECONNECT_MAX_DELAY {
+		delay = CAST_RECONNECT_MAX_DELAY
+	}
+	return delay
+}
+
+// ConnectionManager keeps one session per Cast device so that commands
+// do not pay for a new TLS connection and app join every time.
+type ConnectionManager struct {
+	mutex    sync.Mutex
+	events   *EventBus
+	ctx      context.Context
+	cancel   context.CancelFunc
+	sessions map[string]*castSession
+}
+
+func NewConnectionManager(events *EventBus) *ConnectionManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ConnectionManager{
+		events:   events,
+		ctx:      ctx,
+		cancel:   cancel,
+		sessions: make(map[string]*castSession),
+	}
+}
+
+func castAddress(castInfo Cast) string {
+	return net.JoinHostPort(castInfo.IPAddr.String(), strconv.Itoa(castInfo.Port))
+}
+
+// Session returns the session for a device, starting one if needed.
+// Devices are told apart by UUID, so a device that has moved keeps its
+// session and reconnects at the new address.
+func (m *ConnectionManager) Session(castInfo Cast) *castSession {
+	key := castInfo.Id()
+	if key == "" {
+		key = castAddress(castInfo)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if session, ok := m.sessions[key]; ok {
+		session.update(castInfo)
+		return session
+	}
+	session := &castSession{castInfo: castInfo, events: m.events, closed: make(chan *cast.Client, 1)}
+	m.sessions[key] = session
+	go session.keepalive(m.ctx)
+	return session
+}
+
+func (m *ConnectionManager) Close() {
+	m.cancel()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for key, session := range m.sessions {
+		session.mutex.Lock()
+		session.drop()
+		session.mutex.Unlock()
+		delete(m.sessions, key)
+	}
+}
+
+// castSession is the connection to one Cast device. Commands are run
+// one at a time; in between, a heartbeat checks the connection and
+// reconnects with backoff when it has gone away. While the session owns
+// the media it started, the heartbeat also follows the media status.
+type castSession struct {
+	mutex    sync.Mutex
+	events   *EventBus
+	castInfo Cast
+	client   *cast.Client
+	failures int
+	// closed receives the client the device sent CLOSE to.
+	closed chan *cast.Client
+	// appId is the receiver app the client's media controller belongs
+	// to, empty until one is joined.
+	appId string
+	owned *mediaOwnership
+}
+
+// mediaOwnership identifies the receiver app session and media session
+// a card was loaded into.
+type mediaOwnership struct {
+	appId        string
+	appSession   string
+	mediaSession int
+}
+
+func (s *castSession) update(castInfo Cast) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if castAddress(castInfo) != castAddress(s.castInfo) {
+		slog.Info("cast moved", "name", castInfo.Name, "addr", castAddress(castInfo))
+		s.drop()
+	}
+	s.castInfo = castInfo
+}
+
+// connect opens the connection and re-attaches to a media session
+// that is already running on the device. Callers hold the mutex.
+func (s *castSession) connect(ctx context.Context) error {
+	if s.client != nil && s.client.IsConnected() {
+		return nil
+	}
+	if err := s.dial(ctx); err != nil {
+		return err
+	}
+	status, err := s.client.Receiver().GetStatus(ctx)
+	if err != nil {
+		s.drop()
+		return fmt.Errorf("%w: %v", ErrConnectFailed, err)
+	}
+	// custom receivers speak the media namespace too
+	if app := status.GetSessionByNamespace(controllers.NamespaceMedia); app != nil {
+		media, err := s.client.Media(ctx, *app.AppID)
+		if err == nil {
+			_, err = media.GetStatus(ctx)
+		}
+		if err != nil {
+			slog.Warn("attach media session", "error", err, "name", s.client.Name())
+		} else {
+			s.appId = *app.AppID
+			slog.Info("media session attached", "name", s.client.Name(), "app", s.appId, "session", media.MediaSessionID)
+		}
+	}
+	return nil
+}
+
+// dial opens the connection. Callers hold the mutex.
+func (s *castSession) dial(ctx context.Context) error {
+	// the client dials without a timeout when its context has no
+	// deadline, so check the device is reachable first
+	conn, err := net.DialTimeout("tcp", castAddress(s.castInfo), CAST_PROBE_TIMEOUT)
+	if err != nil {
+		s.failures++
+		return fmt.Errorf("%w: %v", ErrConnectFailed, err)
+	}
+	conn.Close()
+	client := cast.NewClient(s.castInfo.IPAddr, s.castInfo.Port)
+	client.SetName(s.castInfo.Info["fn"])
+	client.SetInfo(s.castInfo.Info)
+	// the connection outlives the request that opens it: cancelling
+	// its context stops the receive loop. The TLS handshake still keeps
+	// to the request's deadline, so a device that accepts connections
+	// but never answers cannot hold the session.
+	deadline, ok := ctx.Deadline()
+	if err := client.Connect(dialContext{context.WithoutCancel(ctx), deadline, ok}); err != nil {
+		s.failures++
+		if client.IsConnected() {
+			client.Close()
+		}
+		return fmt.Errorf("%w: %v", ErrConnectFailed, err)
+	}
+	client.NewChannel(cast.DefaultSender, cast.DefaultReceiver, castNamespaceConnection).OnMessage("CLOSE", func(*api.CastMessage) {
+		// the receive loop calls this, so leave the mutex to keepalive
+		select {
+		case s.closed <- client:
+		default:
+		}
+	})
+	s.client = client
+	s.failures = 0
+	slog.Info("cast connected", "name", client.Name())
+	return nil
+}
+
+// dialContext is a context that is never cancelled but has a deadline,
+// which the client only uses to dial.
+type dialContext struct {
+	context.Context
+	deadline time.Time
+	ok       bool
+}
+
+func (c dialContext) Deadline() (time.Time, bool) {
+	return c.deadline, c.ok
+}
+
+// media returns the media controller of a receiver app, launching the
+// app when it is not the one running. An empty appId stands for the
+// app already joined, or else the Default Media Receiver. Callers hold
+// the mutex.
+func (s *castSession) media(ctx context.Context, appId string) (*controllers.MediaController, error) {
+	if appId == "" {
+		appId = s.appId
+	}
+	if appId == "" {
+		appId = cast.AppMedia
+	}
+	if s.appId != "" && s.appId != appId {
+		// the client keeps the media controller of the first app it
+		// joined, so switching apps takes a new connection
+		slog.Info("switch receiver app", "name", s.castInfo.Name, "app", appId, "previous", s.appId)
+		s.drop()
+		if err := s.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	media, err := s.client.Media(ctx, appId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrAppLaunchFailed, appId, err)
+	}
+	s.appId = appId
+	return media, nil
+}
+
+// drop closes the connection. Callers hold the mutex.
+func (s *castSession) drop() {
+	if s.client != nil {
+		if s.client.IsConnected() {
+			s.client.Close()
+		}
+		s.client = nil
+	}
+	s.appId = ""
+}
+
+// probe checks that the device still answers. Callers hold the mutex.
+func (s *castSession) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, CAST_PROBE_TIMEOUT)
+	defer cancel()
+	_, err := s.client.Receiver().GetStatus(ctx)
+	return err
+}
+
+// Do runs fn with a connected client. When fn fails and the device no
+// longer answers, the connection is dropped so the next command or
+// heartbeat reconnects.
+func (s *castSession) Do(ctx context.Context, fn func(ctx context.Context, client *cast.Client) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CAST_REQUEST_TIMEOUT)
+		defer cancel()
+	}
+	if err := s.connect(ctx); err != nil {
+		return err
+	}
+	err := fn(ctx, s.client)
+	if err != nil && s.probe(context.Background()) != nil {
+		slog.Warn("cast connection lost", "name", s.castInfo.Name, "error", err)
+		s.drop()
+		return fmt.Errorf("%w: %v", ErrConnectFailed, err)
+	}
+	return err
+}
+
+func (s *castSession) Status() cast.DisplayStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == nil {
+		return cast.DisplayStatus{Name: s.castInfo.Info["fn"]}
+	}
+	return s.client.DisplayStatus()
+}
+
+// claim records the media session just loaded as the player's own, so
+// that the heartbeat follows it. Callers hold the mutex.
+func (s *castSession) claim(ctx context.Context, media *controllers.MediaController) error {
+	status, err := s.client.Receiver().GetStatus(ctx)
+	if err != nil {
+		return err
+	}
+	app := status.GetSessionByAppId(s.appId)
+	if app == nil || app.SessionID == nil {
+		return fmt.Errorf("receiver app %s is not running", s.appId)
+	}
+	// the status also settles the media session id, which LOAD only
+	// updates once its reply has been handed over
+	mediaStatus, err := media.GetStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if len(mediaStatus.Status) == 0 {
+		return fmt.Errorf("no media session")
+	}
+	s.owned = &mediaOwnership{
+		appId:        s.appId,
+		appSession:   *app.SessionID,
+		mediaSession: mediaStatus.Status[0].MediaSessionID,
+	}
+	return nil
+}
+
+// release stops following the media session. Callers hold the mutex.
+func (s *castSession) release() {
+	s.owned = nil
+}
+
+// Release stops following the media session, leaving it playing.
+func (s *castSession) Release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.release()
+}
+
+// follow checks that the media session the player started is still
+// there and still its own. Callers hold the mutex.
+func (s *castSession) follow(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, CAST_PROBE_TIMEOUT)
+	defer cancel()
+	status, err := s.client.Receiver().GetStatus(ctx)
+	if err != nil {
+		return err
+	}
+	app := status.GetSessionByAppId(s.owned.appId)
+	switch {
+	case app == nil && len(status.Applications) == 0:
+		s.lost(EVENT_PLAYBACK_TAKEN_OVER, "stopped")
+		return nil
+	case app == nil:
+		s.lost(EVENT_PLAYBACK_TAKEN_OVER, "app: "+appName(status.Applications[0]))
+		return nil
+	case app.SessionID == nil || *app.SessionID != s.owned.appSession:
+		s.lost(EVENT_PLAYBACK_TAKEN_OVER, "new session")
+		return nil
+	}
+	media, err := s.media(ctx, s.owned.appId)
+	if err != nil {
+		return err
+	}
+	mediaStatus, err := media.GetStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if len(mediaStatus.Status) == 0 {
+		s.lost(EVENT_PLAYBACK_FINISHED, "ended")
+		return nil
+	}
+	current := mediaStatus.Status[0]
+	switch {
+	case current.MediaSessionID != s.owned.mediaSession:
+		s.lost(EVENT_PLAYBACK_TAKEN_OVER, "new media")
+	case current.PlayerState != "IDLE" || current.IdleReason == "":
+	case current.IdleReason == "INTERRUPTED":
+		s.lost(EVENT_PLAYBACK_TAKEN_OVER, "interrupted")
+	default:
+		s.lost(EVENT_PLAYBACK_FINISHED, strings.ToLower(current.IdleReason))
+	}
+	return nil
+}
+
+// appName is the display name of a receiver app, or its id when the
+// device does not say.
+func appName(app *controllers.ApplicationSession) string {
+	switch {
+	case app.DisplayName != nil && *app.DisplayName != "":
+		return *app.DisplayName
+	case app.AppID != nil && *app.AppID != "":
+		return *app.AppID
+	default:
+		return "unknown app"
+	}
+}
+
+// lost gives up the media session and reports why. A session taken
+// over is reconnected, as the client still points at the old app.
+// Callers hold the mutex.
+func (s *castSession) lost(eventType string, reason string) {
+	slog.Info("media session lost", "name", s.castInfo.Name, "event", eventType, "reason", reason)
+	s.release()
+	if eventType == EVENT_PLAYBACK_TAKEN_OVER {
+		s.drop()
+	}
+	s.events.Publish(eventType, PlaybackEvent{Device: s.castInfo.Name, Reason: reason})
+}
+
+func (s *castSession) keepalive(ctx context.Context) {
+	delay := CAST_HEARTBEAT_INTERVAL
+	for {
+		var closed *cast.Client
+		select {
+		case <-ctx.Done():
+			return
+		case closed = <-s.closed:
+		case <-time.After(delay):
+		}
+		s.mutex.Lock()
+		delay = CAST_HEARTBEAT_INTERVAL
+		if s.owned != nil {
+			delay = CAST_STATUS_INTERVAL
+		}
+		if closed != nil && closed == s.client {
+			slog.Warn("cast connection closed by the device", "name", s.castInfo.Name)
+			s.drop()
+		} else if s.client != nil {
+			check := s.probe
+			if s.owned != nil {
+				check = s.follow
+			}
+			if err := check(ctx); err != nil {
+				slog.Warn("cast heartbeat", "error", err, "name", s.castInfo.Name)
+				s.drop()
+			}
+		}
+		if s.client == nil {
+			// commands wait for the mutex, so reconnecting keeps to
+			// their timeout
+			connectCtx, cancel := context.WithTimeout(ctx, CAST_REQUEST_TIMEOUT)
+			if err := s.connect(connectCtx); err != nil {
+				delay = reconnectDelay(s.failures)
+				slog.Debug("cast reconnect", "error", err, "name", s.castInfo.Name, "retry", delay)
+			}
+			cancel()
+		}
+		s.mutex.Unlock()
+	}
+}
@@ -0,0 +1,116 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vkl/go-cast"
+	"github.com/vkl/go-cast/controllers"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		0:  CAST_RECONNECT_MIN_DELAY,
+		1:  CAST_RECONNECT_MIN_DELAY,
+		2:  2 * CAST_RECONNECT_MIN_DELAY,
+		4:  8 * CAST_RECONNECT_MIN_DELAY,
+		50: CAST_RECONNECT_MAX_DELAY,
+	} {
+		if delay := reconnectDelay(failures); delay != expected {
+			t.Fatalf("%d failures: expected %v, got %v", failures, expected, delay)
+		}
+	}
+}
+
+func TestConnectionManager(t *testing.T) {
+	sessions := NewConnectionManager(nil)
+	defer sessions.Close()
+
+	// nothing listens on the port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+	castInfo := Cast{
+		Name:   "Kitchen",
+		IPAddr: addr.IP,
+		Port:   addr.Port,
+		Info:   map[string]string{"id": "uuid-1", "fn": "Kitchen"},
+	}
+	session := sessions.Session(castInfo)
+	err = session.Do(context.Background(), func(ctx context.Context, client *cast.Client) error {
+		t.Fatal("command run without a connection")
+		return nil
+	})
+	if !errors.Is(err, ErrConnectFailed) || session.failures != 1 {
+		t.Fatalf("expected a connect error, got %v", err)
+	}
+
+	// the device moved: it keeps its session
+	castInfo.IPAddr = net.IPv4(127, 0, 0, 2)
+	if sessions.Session(castInfo) != session || !session.castInfo.IPAddr.Equal(castInfo.IPAddr) {
+		t.Fatal("moved device did not keep its session")
+	}
+	if status := session.Status(); status.Name != "Kitchen" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestCastSessionConnectTimeout(t *testing.T) {
+	// the device accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	session := &castSession{castInfo: Cast{Name: "Kitchen", IPAddr: addr.IP, Port: addr.Port}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		session.mutex.Lock()
+		defer session.mutex.Unlock()
+		done <- session.connect(ctx)
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrConnectFailed) {
+			t.Fatalf("expected a connect error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect did not keep to its deadline")
+	}
+}
+
+func TestAppName(t *testing.T) {
+	name, appId, empty := "Spotify", "CC32E753", ""
+	for _, test := range []struct {
+		app      controllers.ApplicationSession
+		expected string
+	}{
+		{controllers.ApplicationSession{AppID: &appId, DisplayName: &name}, "Spotify"},
+		{controllers.ApplicationSession{AppID: &appId}, "CC32E753"},
+		{controllers.ApplicationSession{AppID: &appId, DisplayName: &empty}, "CC32E753"},
+		{controllers.ApplicationSession{}, "unknown app"},
+	} {
+		if name := appName(&test.app); name != test.expected {
+			t.Fatalf("expected %q, got %q", test.expected, name)
+		}
+	}
+}
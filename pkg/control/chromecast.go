@@ -2,17 +2,24 @@ package control
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/vkl/go-cast"
 	"github.com/vkl/go-cast/api"
 	"github.com/vkl/go-cast/controllers"
-	"github.com/vkl/go-cast/discovery"
 	_ "github.com/vkl/rfidplayer/pkg/logging"
 )
 
+// STATUS_WATCH_INTERVAL is how often the status of the current output
+// is looked at for changes to publish.
+const STATUS_WATCH_INTERVAL = 2 * time.Second
+
 type Action byte
 
 const (
@@ -46,8 +53,6 @@ func (action Action) String() string {
 	}
 }
 
-const DISCOVERY_DURATION = 30
-
 type ClientAction struct {
 	Action string  `json:"action"`
 	Volume float64 `json:"volume"`
@@ -61,97 +66,511 @@ type ChromecastClient struct {
 	Volume      float64 `json:"volume"`
 }
 
+// PlayerStatus is the status of the output in use, with the room the
+// player is in: the name of the device cards without one play on.
+type PlayerStatus struct {
+	cast.DisplayStatus
+	Room string `json:"room"`
+}
+
+// ChromecastControl is safe for concurrent use. Commands are run one
+// at a time per device, so that a card being started is not interleaved
+// with a button press or a volume change for the same device.
 type ChromecastControl struct {
-	discoveryService  *discovery.Service
-	castControl       *CastController
-	isDiscovering     bool
-	currentChromecast *cast.Client
+	discovery   *DiscoveryManager
+	castControl *CastController
+	events      *EventBus
+	sessions    *ConnectionManager
+	devices     deviceLocks
+	mutex       sync.Mutex
+	// currentOutput is what the last card was played on and
+	// currentDevices the keys of its devices in devices.
+	currentOutput  Output
+	currentDevices []string
+	// commands is what command cards set for the cards played next.
+	commands commandState
+	// statusChanged wakes watchStatus up after a command.
+	statusChanged chan struct{}
 }
 
-func NewChromeCastControl(castControl *CastController) *ChromecastControl {
+func NewChromeCastControl(castControl *CastController, events *EventBus) *ChromecastControl {
 	chromecastControl := ChromecastControl{
-		castControl:   castControl,
-		isDiscovering: false,
+		castControl: castControl,
+		discovery:   NewDiscoveryManager(castControl, events),
+		events:      events,
+		sessions:    NewConnectionManager(events),
+		// statusChanged holds one wake-up; more would be the same
+		statusChanged: make(chan struct{}, 1),
 	}
-	chromecastControl.StartDiscovery(DISCOVERY_DURATION * time.Second)
+	go chromecastControl.discovery.Run(context.Background())
+	chromecastControl.followPlayback()
+	go chromecastControl.watchStatus(context.Background())
 	return &chromecastControl
 }
 
-func (cc *ChromecastControl) StartDiscovery(timeout time.Duration) {
-	if cc.isDiscovering {
-		slog.Warn("discovery already started early")
+// followPlayback lets go of a device another sender has taken over,
+// so that the player's commands no longer reach it.
+func (cc *ChromecastControl) followPlayback() {
+	if cc.events == nil {
 		return
 	}
-	cc.isDiscovering = true
+	events, _ := cc.events.Subscribe()
 	go func() {
-		ctx, cancelFunc := context.WithTimeout(context.Background(), timeout)
-		cc.discoveryService = discovery.NewService(context.Background())
-		go func() {
-			slog.Info("Discovery started")
-			cc.discoveryService.Run(ctx, 4*time.Second)
-		}()
-		for {
-			select {
-			case client := <-cc.discoveryService.Found():
-				err := cc.castControl.UpdateCast(Cast{
-					Name:   client.Name(),
-					IPAddr: client.IP(),
-					Port:   client.Port(),
-					Info:   client.GetInfo(),
-				})
-				if err != nil {
-					slog.Error(err.Error())
-				}
-			case <-ctx.Done():
-				slog.Info("Discovery complete")
-				cancelFunc()
-				goto COMPLETE
+		for event := range events {
+			if event.Type != EVENT_PLAYBACK_TAKEN_OVER {
+				continue
 			}
+			cc.mutex.Lock()
+			cc.dropTakenOver(event.Data.(PlaybackEvent).Device)
+			cc.mutex.Unlock()
 		}
-	COMPLETE:
-		cc.isDiscovering = false
 	}()
 }
 
+// dropTakenOver stops using the named Cast device. The output in use is
+// dropped when it is that device, and a group it belongs to goes on
+// without it. Callers hold the mutex.
+func (cc *ChromecastControl) dropTakenOver(name string) {
+	switch output := cc.currentOutput.(type) {
+	case *chromecastOutput:
+		if output.castInfo.Name == name {
+			slog.Info("output taken over", "name", output.Name())
+			cc.currentOutput, cc.currentDevices = nil, nil
+		}
+	case *groupOutput:
+		rest, member := output.without(name)
+		if member == nil {
+			return
+		}
+		slog.Info("group member taken over", "name", member.Name(), "group", output.Name())
+		if rest == nil {
+			cc.currentOutput, cc.currentDevices = nil, nil
+			return
+		}
+		key := deviceKey(member.castInfo)
+		devices := make([]string, 0, len(cc.currentDevices))
+		for _, device := range cc.currentDevices {
+			if device != key {
+				devices = append(devices, device)
+			}
+		}
+		cc.currentOutput, cc.currentDevices = rest, devices
+	}
+}
+
+// watchStatus publishes the status of the current output whenever it
+// changes, and the volume when that does, so that clients can follow
+// the player without polling it.
+func (cc *ChromecastControl) watchStatus(ctx context.Context) {
+	if cc.events == nil {
+		return
+	}
+	ticker := time.NewTicker(STATUS_WATCH_INTERVAL)
+	defer ticker.Stop()
+	var last PlayerStatus
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-cc.statusChanged:
+		}
+		status := cc.CastStatus()
+		if status == last {
+			continue
+		}
+		cc.events.Publish(EVENT_PLAYER_STATUS, status)
+		if status.Volume != last.Volume {
+			cc.events.Publish(EVENT_PLAYER_VOLUME, VolumeEvent{Device: status.Name, Volume: status.Volume})
+		}
+		last = status
+	}
+}
+
+// nudge has watchStatus look at the status now rather than at its next
+// tick.
+func (cc *ChromecastControl) nudge() {
+	select {
+	case cc.statusChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (cc *ChromecastControl) publishError(source string, err error) {
+	cc.events.Publish(EVENT_ERROR, ErrorEvent{Source: source, Message: err.Error()})
+}
+
+// current returns the output in use and the keys of its devices.
+func (cc *ChromecastControl) current() (Output, []string) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.currentOutput, cc.currentDevices
+}
+
+// StartDiscovery asks for an early discovery pass on top of the
+// periodic ones.
+func (cc *ChromecastControl) StartDiscovery(timeout time.Duration) {
+	cc.discovery.Trigger(timeout)
+}
+
 func (cc *ChromecastControl) GetClients() Casts {
 	return cc.castControl.GetCasts()
 }
 
-func (cc *ChromecastControl) CastStatus() cast.DisplayStatus {
-	if cc.currentChromecast == nil {
+func (cc *ChromecastControl) GetClient(name string) (Cast, bool) {
+	return cc.castControl.GetCastByName(name)
+}
+
+// AddStaticCast adds a device by address for networks where discovery
+// does not reach it. DLNA renderers are given by their description
+// location in Info["location"].
+func (cc *ChromecastControl) AddStaticCast(castInfo Cast) error {
+	if castInfo.Kind == KIND_DLNA {
+		if castInfo.Info["location"] == "" {
+			return fmt.Errorf("cast validation error: no location for %s", castInfo.Name)
+		}
+		renderer, err := fetchRenderer(context.Background(), castInfo.Info["location"])
+		if err != nil {
+			return err
+		}
+		if castInfo.Name != "" {
+			renderer.Name = castInfo.Name
+		}
+		castInfo = renderer
+	}
+	return cc.castControl.AddStaticCast(castInfo)
+}
+
+// ResolveCard fills in the UUIDs of the card devices that are known.
+func (cc *ChromecastControl) ResolveCard(card Card) Card {
+	card, _ = cc.castControl.ResolveCard(card)
+	return card
+}
+
+// SetReceiverApp sets the Cast receiver app cards are played with on a
+// device when they do not name their own.
+func (cc *ChromecastControl) SetReceiverApp(name string, appId string) error {
+	return cc.castControl.SetReceiverApp(name, appId)
+}
+
+func (cc *ChromecastControl) DelCast(name string) bool {
+	return cc.castControl.DelCast(name)
+}
+
+func (cc *ChromecastControl) CastStatus() PlayerStatus {
+	status := PlayerStatus{Room: cc.Room()}
+	output, _ := cc.current()
+	if output == nil {
 		slog.Debug("chromecast not used")
-		return cast.DisplayStatus{}
+		return status
+	}
+	status.DisplayStatus = output.Status()
+	return status
+}
+
+// Room returns the name of the device cards without one play on, or
+// an empty string when there is none.
+func (cc *ChromecastControl) Room() string {
+	castInfo, _ := cc.castControl.DefaultCast()
+	return castInfo.Name
+}
+
+// SetRoom makes the named device the one cards without one play on,
+// or leaves them without one for an empty name.
+func (cc *ChromecastControl) SetRoom(name string) error {
+	if err := cc.castControl.SetDefaultCast(name); err != nil {
+		return err
 	}
-	return cc.currentChromecast.DisplayStatus()
+	slog.Info("room", "device", name)
+	cc.nudge()
+	return nil
 }
 
-func (cc *ChromecastControl) PlayCard(card Card) bool {
-	var castInfo Cast
-	var ok bool
-	if castInfo, ok = cc.castControl.GetCastByName(card.Chromecast); !ok {
+// PlayCard plays the card on its devices. When only some devices of
+// a group can be reached the card still plays and no error is returned.
+// Command cards are run instead, as by RunCommand.
+func (cc *ChromecastControl) PlayCard(card Card) error {
+	if card.IsCommand() {
+		return cc.RunCommand(card)
+	}
+	card, volume := cc.applyCommands(card)
+	output, devices, err := cc.outputFor(card)
+	if err != nil {
+		slog.Error("play card", "error", err, "card", card.Id)
+		cc.publishError("play card", err)
 		cc.StartDiscovery(DISCOVERY_DURATION * time.Second)
-		return false
-	}
-	if cc.currentChromecast != nil {
-		cc.currentChromecast.Close()
-	}
-	cc.currentChromecast = cast.NewClient(castInfo.IPAddr, castInfo.Port)
-	cc.currentChromecast.SetName(castInfo.Info["fn"])
-	cc.currentChromecast.SetInfo(castInfo.Info)
-	client := cc.currentChromecast
-	ctx := context.Background()
-	if !client.IsConnected() {
-		if err := client.Connect(ctx); err != nil {
-			cc.currentChromecast = nil
-			slog.Error(err.Error())
+		return err
+	}
+	unlock := cc.devices.lock(devices)
+	defer unlock()
+	cc.mutex.Lock()
+	previous := cc.currentOutput
+	cc.currentOutput, cc.currentDevices = output, devices
+	cc.mutex.Unlock()
+	if previous != nil {
+		closeUnused(previous, output)
+	}
+	err = output.PlayCard(context.Background(), card)
+	var groupErr *GroupError
+	if errors.As(err, &groupErr) && groupErr.Partial() {
+		slog.Warn("play card", "error", err, "output", output.Name())
+		cc.publishError("play card", err)
+		cc.StartDiscovery(DISCOVERY_DURATION * time.Second)
+		err = nil
+	}
+	if err != nil {
+		slog.Error("play card", "error", err, "output", output.Name())
+		cc.publishError("play card", err)
+		if errors.Is(err, ErrConnectFailed) {
+			cc.mutex.Lock()
+			if cc.currentOutput == output {
+				cc.currentOutput, cc.currentDevices = nil, nil
+			}
+			cc.mutex.Unlock()
 			cc.StartDiscovery(DISCOVERY_DURATION * time.Second)
-			return false
+		}
+		return err
+	}
+	if volume > 0 {
+		if err := output.Control(context.Background(), ClientAction{Action: SETVOLUME.String(), Volume: volume}); err != nil {
+			slog.Warn("start volume", "error", err, "output", output.Name())
 		}
 	}
-	media, err := client.Media(ctx, cast.AppMedia)
+	cc.events.Publish(EVENT_PLAYER_NOW_PLAYING, NowPlayingEvent{Card: card.Id, Name: card.Name, Output: output.Name()})
+	cc.nudge()
+	return nil
+}
+
+// outputFor resolves the devices a card targets, or the room's device
+// for a card without any. A card with several targets gets an ad-hoc
+// group of whichever of them are known. The keys of the devices found
+// are returned for locking.
+func (cc *ChromecastControl) outputFor(card Card) (Output, []string, error) {
+	targets := card.Targets()
+	if len(targets) == 0 {
+		castInfo, ok := cc.castControl.DefaultCast()
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: card has no device and no room is set", ErrDeviceNotFound)
+		}
+		targets = []CardTarget{{Id: castInfo.Id(), Name: castInfo.Name}}
+	}
+	outputs := make([]Output, 0, len(targets))
+	devices := make([]string, 0, len(targets))
+	missing := make([]string, 0)
+	for _, target := range targets {
+		castInfo, ok := cc.castControl.GetCastByTarget(target)
+		if !ok {
+			missing = append(missing, target.String())
+			continue
+		}
+		if castInfo.IsGroup() {
+			slog.Debug("speaker group", "name", castInfo.Name, "addr", castInfo.IPAddr, "port", castInfo.Port)
+		}
+		outputs = append(outputs, newOutput(castInfo, cc.sessions))
+		devices = append(devices, deviceKey(castInfo))
+	}
+	if len(outputs) == 0 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, strings.Join(missing, ", "))
+	}
+	if len(targets) == 1 {
+		return outputs[0], devices, nil
+	}
+	return newGroupOutput(outputs, missing), devices, nil
+}
+
+// closeUnused closes the devices of previous that output does not play
+// on. Devices kept in a rebuilt group stay as they are, and the local
+// output is never closed: its player is shared and kept running.
+func closeUnused(previous Output, output Output) {
+	kept := make(map[string]bool)
+	for _, member := range outputMembers(output) {
+		kept[member.Name()] = true
+	}
+	for _, member := range outputMembers(previous) {
+		if _, ok := member.(*localOutput); ok || kept[member.Name()] {
+			continue
+		}
+		if err := member.Close(); err != nil {
+			slog.Debug("close output", "error", err, "output", member.Name())
+		}
+	}
+}
+
+// outputMembers returns the devices an output plays on.
+func outputMembers(output Output) []Output {
+	if group, ok := output.(*groupOutput); ok {
+		return group.outputs
+	}
+	return []Output{output}
+}
+
+func deviceKey(castInfo Cast) string {
+	if castInfo.Id() != "" {
+		return castInfo.Id()
+	}
+	return castInfo.Name
+}
+
+// deviceLocks hands out a mutex per device.
+type deviceLocks struct {
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock takes the locks of all given devices, in a fixed order so that
+// overlapping groups cannot deadlock, and returns the function that
+// releases them.
+func (d *deviceLocks) lock(keys []string) func() {
+	keys = append([]string{}, keys...)
+	sort.Strings(keys)
+	d.mutex.Lock()
+	if d.locks == nil {
+		d.locks = make(map[string]*sync.Mutex)
+	}
+	locks := make([]*sync.Mutex, 0, len(keys))
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		lock, ok := d.locks[key]
+		if !ok {
+			lock = &sync.Mutex{}
+			d.locks[key] = lock
+		}
+		locks = append(locks, lock)
+	}
+	d.mutex.Unlock()
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+func (cc *ChromecastControl) Control(action Action) error {
+	payload := ClientAction{
+		Action: action.String(),
+	}
+	return cc.ClientControl(payload)
+}
+
+func (cc *ChromecastControl) SetVolume(volume float64) error {
+	payload := ClientAction{
+		Action: SETVOLUME.String(),
+		Volume: volume,
+	}
+	return cc.ClientControl(payload)
+}
+
+func (cc *ChromecastControl) GetVolume() (float64, error) {
+	var level float64
+	err := cc.withOutput(GETVOLUME.String(), func(ctx context.Context, output Output) error {
+		var err error
+		level, err = output.GetVolume(ctx)
+		return err
+	})
+	slog.Debug("Volume", "level", level)
+	return level, err
+}
+
+func (cc *ChromecastControl) ClientControl(payload ClientAction) error {
+	if !isAction(payload.Action) {
+		return fmt.Errorf("%w: %q", ErrInvalidAction, payload.Action)
+	}
+	if payload.Action == GETVOLUME.String() {
+		_, err := cc.GetVolume()
+		return err
+	}
+	return cc.withOutput(payload.Action, func(ctx context.Context, output Output) error {
+		return output.Control(ctx, payload)
+	})
+}
+
+func isAction(name string) bool {
+	for action := PLAY; action <= GETVOLUME; action++ {
+		if action.String() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withOutput runs a command on the output in use with its devices
+// locked. A command that only some devices of a group carried out
+// counts as done.
+func (cc *ChromecastControl) withOutput(command string, fn func(ctx context.Context, output Output) error) error {
+	output, devices := cc.current()
+	slog.Debug("client control", "current", output)
+	if output == nil {
+		slog.Debug("chromecast not used")
+		return ErrNoActiveSession
+	}
+	unlock := cc.devices.lock(devices)
+	defer unlock()
+	err := fn(context.Background(), output)
+	var groupErr *GroupError
+	if errors.As(err, &groupErr) && groupErr.Partial() {
+		slog.Warn("media control", "error", err, "command", command)
+		cc.publishError(command, err)
+		err = nil
+	}
 	if err != nil {
-		slog.Error("play media", "error", err)
-		return false
+		slog.Error("media control", "error", err, "command", command)
+		cc.publishError(command, err)
+		if errors.Is(err, ErrConnectFailed) {
+			cc.StartDiscovery(DISCOVERY_DURATION * time.Second)
+		}
+		return err
+	}
+	cc.nudge()
+	return nil
+}
+
+// chromecastOutput plays cards on a Cast device through the Default
+// Media Receiver, or the receiver app the card or device asks for. The
+// connection belongs to the device's session, so it outlives the output.
+type chromecastOutput struct {
+	castInfo Cast
+	session  *castSession
+}
+
+func newChromecastOutput(castInfo Cast, sessions *ConnectionManager) *chromecastOutput {
+	return &chromecastOutput{castInfo: castInfo, session: sessions.Session(castInfo)}
+}
+
+func (o *chromecastOutput) Name() string {
+	return o.castInfo.Info["fn"]
+}
+
+func (o *chromecastOutput) String() string {
+	return fmt.Sprintf("%s (%s)", o.Name(), castAddress(o.castInfo))
+}
+
+func (o *chromecastOutput) PlayCard(ctx context.Context, card Card) error {
+	return o.session.Do(ctx, func(ctx context.Context, _ *cast.Client) error {
+		return o.playCard(ctx, card)
+	})
+}
+
+// receiverApp returns the receiver app to play the card with: the
+// card's own, the device's, or the Default Media Receiver.
+func (o *chromecastOutput) receiverApp(card Card) string {
+	if card.ReceiverAppId != "" {
+		return card.ReceiverAppId
+	}
+	if o.castInfo.ReceiverAppId != "" {
+		return o.castInfo.ReceiverAppId
+	}
+	return cast.AppMedia
+}
+
+func (o *chromecastOutput) playCard(ctx context.Context, card Card) error {
+	media, err := o.session.media(ctx, o.receiverApp(card))
+	if err != nil {
+		return err
 	}
 
 	if len(card.MediaLinks) > 0 {
@@ -174,7 +593,7 @@ func (cc *ChromecastControl) PlayCard(card Card) bool {
 		}
 		_, err := media.LoadMedia(ctx, mediaItem, 0, true, nil)
 		if err != nil {
-			slog.Error("play media", "error", err, "media", mediaItem.ContentId)
+			return fmt.Errorf("%w: %s: %v", ErrLoadFailed, mediaItem.ContentId, err)
 		}
 		if len(card.MediaLinks) > 1 {
 			mediaItems := make([]controllers.MediaItemQueue, 0)
@@ -195,61 +614,24 @@ func (cc *ChromecastControl) PlayCard(card Card) bool {
 				slog.Error("queue insert media items", "error", err)
 			}
 		}
+		if err := o.session.claim(ctx, media); err != nil {
+			slog.Warn("follow media session", "error", err, "name", o.Name())
+		}
 	}
-	return true
-}
-
-func (cc *ChromecastControl) Control(action Action) bool {
-	payload := ClientAction{
-		Action: action.String(),
-	}
-	return cc.ClientControl(payload)
-}
-
-func (cc *ChromecastControl) SetVolume(volume float64) bool {
-	payload := ClientAction{
-		Action: SETVOLUME.String(),
-		Volume: volume,
-	}
-	return cc.ClientControl(payload)
+	return nil
 }
 
-func (cc *ChromecastControl) GetVolume() (float64, bool) {
-	payload := ClientAction{
-		Action: GETVOLUME.String(),
-	}
-	volume := &controllers.Volume{
-		Level: new(float64),
-		Muted: new(bool),
-	}
-	cc.ClientControl(payload, volume)
-	slog.Debug("Volume", "level", *volume.Level)
-	return *volume.Level, true
+func (o *chromecastOutput) Control(ctx context.Context, payload ClientAction) error {
+	return o.session.Do(ctx, func(ctx context.Context, client *cast.Client) error {
+		return o.control(ctx, client, payload)
+	})
 }
 
-func (cc *ChromecastControl) ClientControl(payload ClientAction, args ...interface{}) bool {
-	slog.Debug("client control", "current", cc.currentChromecast)
-	if cc.currentChromecast == nil {
-		slog.Debug("chromecast not used")
-		return false
-	}
-	ctx := context.Background()
-	client := cc.currentChromecast
-	if !client.IsConnected() {
-		err := client.Connect(ctx)
-		if err != nil {
-			slog.Error(err.Error())
-			cc.StartDiscovery(DISCOVERY_DURATION * time.Second)
-			return false
-		}
-	}
+func (o *chromecastOutput) control(ctx context.Context, client *cast.Client, payload ClientAction) error {
 	receiver := client.Receiver()
-	var media *controllers.MediaController
-	var err error
-	media, err = client.Media(ctx, cast.AppMedia)
+	media, err := o.session.media(ctx, "")
 	if err != nil {
-		slog.Error("client control", "error", err)
-		return false
+		return err
 	}
 	var msg *api.CastMessage
 	switch payload.Action {
@@ -274,24 +656,45 @@ func (cc *ChromecastControl) ClientControl(payload ClientAction, args ...interfa
 		}
 		*volume.Level = float64(payload.Volume)
 		*volume.Muted = false
-		msg, err = client.Receiver().SetVolume(ctx, &volume)
-	case "getvolume":
-		var volume *controllers.Volume
-		volume, err = client.Receiver().GetVolume(ctx)
-		slog.Debug("Volume", "level", *volume.Level)
-		if len(args) > 0 {
-			if value, ok := args[0].(*controllers.Volume); ok {
-				*value.Level = *volume.Level
-				*value.Muted = *volume.Muted
-			}
-		}
+		msg, err = receiver.SetVolume(ctx, &volume)
 	default:
-		err = fmt.Errorf("unknown command: %s", payload.Action)
+		err = fmt.Errorf("%w: %s", ErrInvalidAction, payload.Action)
 	}
 	if err != nil {
-		slog.Error("media control", "error", err, "command", payload.Action)
-		return false
+		return err
 	}
-	slog.Debug(msg.String())
-	return true
+	if payload.Action == "stop" {
+		o.session.release()
+	}
+	if msg != nil {
+		slog.Debug(msg.String())
+	}
+	return nil
+}
+
+func (o *chromecastOutput) GetVolume(ctx context.Context) (float64, error) {
+	var level float64
+	err := o.session.Do(ctx, func(ctx context.Context, client *cast.Client) error {
+		volume, err := client.Receiver().GetVolume(ctx)
+		if err != nil {
+			return err
+		}
+		if volume == nil || volume.Level == nil {
+			return fmt.Errorf("no volume in receiver status")
+		}
+		level = *volume.Level
+		return nil
+	})
+	return level, err
+}
+
+func (o *chromecastOutput) Status() cast.DisplayStatus {
+	return o.session.Status()
+}
+
+// Close stops following the media session but leaves the session
+// connected for the next card.
+func (o *chromecastOutput) Close() error {
+	o.session.Release()
+	return nil
 }
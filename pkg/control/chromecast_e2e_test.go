@@ -0,0 +1,324 @@
+//go:build !race
+
+// go-cast shares request and status state between its receive loop and
+// callers without locking, so these tests are left out of race builds.
+
+package control
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vkl/go-cast"
+	"github.com/vkl/go-cast/controllers"
+)
+
+func TestChromecastEndToEnd(t *testing.T) {
+	device := newFakeCast(t)
+	castControl := &CastController{}
+	castControl.UpdateCast(device.castInfo("Kitchen"))
+	cc := newTestChromecastControl(t, castControl, nil)
+
+	card := Card{
+		Id:         "card1",
+		Name:       "Songs",
+		Chromecast: "Kitchen",
+		MediaLinks: []MediaLink{
+			{Link: "http://media/1.mp3", ContentType: "audio/mpeg"},
+			{Link: "http://media/2.mp3", ContentType: "audio/mpeg"},
+			{Link: "http://media/3.mp3", ContentType: "audio/mpeg"},
+		},
+	}
+	if err := cc.PlayCard(card); err != nil {
+		t.Fatal(err)
+	}
+	if messages := device.received(fakeCastNsConnection); len(messages) == 0 || messages[0] != "CONNECT" {
+		t.Fatalf("no virtual connection opened: %v", messages)
+	}
+	if messages := strings.Join(device.received(fakeCastNsReceiver), ","); messages != "LAUNCH" {
+		t.Fatalf("unexpected receiver messages: %s", messages)
+	}
+	if messages := strings.Join(device.received(controllers.NamespaceMedia), ","); messages != "LOAD,QUEUE_INSERT" {
+		t.Fatalf("unexpected media messages: %s", messages)
+	}
+	load := device.last("LOAD")["media"].(map[string]interface{})
+	if load["contentId"] != "http://media/1.mp3" || load["metadata"].(map[string]interface{})["title"] != "Songs" {
+		t.Fatalf("unexpected LOAD: %v", load)
+	}
+	appId, state, queue, _, _ := device.state()
+	if appId != cast.AppMedia || state != "PLAYING" || len(queue) != 3 {
+		t.Fatalf("unexpected device state: %s %s %v", appId, state, queue)
+	}
+
+	for _, test := range []struct {
+		action  Action
+		message string
+		state   string
+		index   int
+	}{
+		{PAUSE, "PAUSE", "PAUSED", 0},
+		{PLAY, "PLAY", "PLAYING", 0},
+		{NEXT, "QUEUE_NEXT", "PLAYING", 1},
+		{NEXT, "QUEUE_NEXT", "PLAYING", 2},
+		{PREV, "QUEUE_PREV", "PLAYING", 1},
+	} {
+		if err := cc.Control(test.action); err != nil {
+			t.Fatalf("%s: %v", test.action, err)
+		}
+		if messages := strings.Join(device.received(controllers.NamespaceMedia), ","); messages != test.message {
+			t.Fatalf("%s: unexpected media messages: %s", test.action, messages)
+		}
+		if _, state, _, index, _ := device.state(); state != test.state || index != test.index {
+			t.Fatalf("%s: unexpected device state: %s %d", test.action, state, index)
+		}
+	}
+
+	if err := cc.SetVolume(0.25); err != nil {
+		t.Fatal(err)
+	}
+	if messages := strings.Join(device.received(fakeCastNsReceiver), ","); messages != "SET_VOLUME" {
+		t.Fatalf("unexpected receiver messages: %s", messages)
+	}
+	if volume, err := cc.GetVolume(); err != nil || volume != 0.25 {
+		t.Fatalf("unexpected volume: %v %v", volume, err)
+	}
+	if err := cc.Control(STOP); err != nil {
+		t.Fatal(err)
+	}
+	if _, state, _, _, _ := device.state(); state != "IDLE" {
+		t.Fatalf("device was not stopped: %s", state)
+	}
+
+	// the next card joins the running app over the same connection
+	if err := cc.PlayCard(card); err != nil {
+		t.Fatal(err)
+	}
+	if messages := device.received(fakeCastNsReceiver); len(messages) != 0 || device.connections() != 1 {
+		t.Fatalf("expected the session to be reused: %v, %d connections", messages, device.connections())
+	}
+
+	// a card with its own receiver app switches apps
+	card.ReceiverAppId = "ABCD1234"
+	if err := cc.PlayCard(card); err != nil {
+		t.Fatal(err)
+	}
+	if appId, _, _, _, _ := device.state(); appId != "ABCD1234" {
+		t.Fatalf("receiver app was not launched: %s", appId)
+	}
+	if payload := device.last("LAUNCH"); payload["appId"] != "ABCD1234" {
+		t.Fatalf("unexpected LAUNCH: %v", payload)
+	}
+}
+
+// playbackEvents passes on the playback events only.
+func playbackEvents(events <-chan Event) <-chan Event {
+	playback := make(chan Event, EVENT_BUFFER_SIZE)
+	go func() {
+		defer close(playback)
+		for event := range events {
+			if strings.HasPrefix(event.Type, "playback.") {
+				playback <- event
+			}
+		}
+	}()
+	return playback
+}
+
+func expectPlayback(t *testing.T, events <-chan Event, eventType string) PlaybackEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		if event.Type != eventType {
+			t.Fatalf("got %s event, expected %s", event.Type, eventType)
+		}
+		return event.Data.(PlaybackEvent)
+	case <-time.After(time.Second):
+		t.Fatalf("no %s event", eventType)
+	}
+	return PlaybackEvent{}
+}
+
+func TestCastSessionFollow(t *testing.T) {
+	device := newFakeCast(t)
+	castInfo := device.castInfo("Kitchen")
+	castControl := &CastController{}
+	castControl.UpdateCast(castInfo)
+	bus := NewEventBus()
+	all, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	events := playbackEvents(all)
+	cc := newTestChromecastControl(t, castControl, bus)
+	card := Card{Id: "card1", Chromecast: "Kitchen", MediaLinks: []MediaLink{{Link: "http://media/1.mp3"}}}
+
+	session := cc.sessions.Session(castInfo)
+	follow := func() {
+		t.Helper()
+		session.mutex.Lock()
+		defer session.mutex.Unlock()
+		if err := session.follow(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cc.PlayCard(card); err != nil {
+		t.Fatal(err)
+	}
+	follow()
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %s event while playing", event.Type)
+	default:
+	}
+	device.finish()
+	follow()
+	if event := expectPlayback(t, events, EVENT_PLAYBACK_FINISHED); event.Device != "Kitchen" || event.Reason != "finished" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	if err := cc.PlayCard(card); err != nil {
+		t.Fatal(err)
+	}
+	device.takeOver("ABCD1234")
+	follow()
+	expectPlayback(t, events, EVENT_PLAYBACK_TAKEN_OVER)
+	for i := 0; ; i++ {
+		if output, _ := cc.current(); output == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("taken over output is still in use")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := cc.Control(PAUSE); !errors.Is(err, ErrNoActiveSession) {
+		t.Fatalf("expected no active session, got %v", err)
+	}
+}
+
+func TestCastSessionTakenOverByAnonymousApp(t *testing.T) {
+	device := newFakeCast(t)
+	castInfo := device.castInfo("Kitchen")
+	castControl := &CastController{}
+	castControl.UpdateCast(castInfo)
+	bus := NewEventBus()
+	all, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	events := playbackEvents(all)
+	cc := newTestChromecastControl(t, castControl, bus)
+	card := Card{Id: "card1", Chromecast: "Kitchen", MediaLinks: []MediaLink{{Link: "http://media/1.mp3"}}}
+	if err := cc.PlayCard(card); err != nil {
+		t.Fatal(err)
+	}
+
+	// the app taking over does not say its name
+	device.mutex.Lock()
+	device.anonymous = true
+	device.mutex.Unlock()
+	device.takeOver("ABCD1234")
+	session := cc.sessions.Session(castInfo)
+	session.mutex.Lock()
+	err := session.follow(context.Background())
+	session.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := expectPlayback(t, events, EVENT_PLAYBACK_TAKEN_OVER); event.Reason != "app: ABCD1234" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+}
+
+func TestCastSessionReattach(t *testing.T) {
+	device := newFakeCast(t)
+	device.takeOver(cast.AppMedia)
+	sessions := NewConnectionManager(nil)
+	defer sessions.Close()
+	session := sessions.Session(device.castInfo("Kitchen"))
+	err := session.Do(context.Background(), func(ctx context.Context, client *cast.Client) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.appId != cast.AppMedia {
+		t.Fatalf("running media session was not attached: %q", session.appId)
+	}
+}
+
+func TestCastSessionClosedByDevice(t *testing.T) {
+	device := newFakeCast(t)
+	sessions := NewConnectionManager(nil)
+	defer sessions.Close()
+	session := sessions.Session(device.castInfo("Kitchen"))
+	err := session.Do(context.Background(), func(ctx context.Context, client *cast.Client) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the session reconnects without waiting for the heartbeat to fail
+	device.hangUp()
+	deadline := time.Now().Add(CAST_HEARTBEAT_INTERVAL / 2)
+	for device.connections() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("session did not reconnect after CLOSE")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGroupMemberTakenOver(t *testing.T) {
+	kitchen, bedroom := newFakeCast(t), newFakeCast(t)
+	castControl := &CastController{}
+	castControl.UpdateCast(kitchen.castInfo("Kitchen"))
+	castControl.UpdateCast(bedroom.castInfo("Bedroom"))
+	bus := NewEventBus()
+	all, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	events := playbackEvents(all)
+	cc := newTestChromecastControl(t, castControl, bus)
+	card := Card{
+		Id:          "card1",
+		Chromecast:  "Kitchen",
+		Chromecasts: []string{"Bedroom"},
+		MediaLinks:  []MediaLink{{Link: "http://media/1.mp3"}},
+	}
+	if err := cc.PlayCard(card); err != nil {
+		t.Fatal(err)
+	}
+	kitchen.received(controllers.NamespaceMedia)
+	bedroom.received(controllers.NamespaceMedia)
+
+	bedroom.takeOver("ABCD1234")
+	session := cc.sessions.Session(bedroom.castInfo("Bedroom"))
+	session.mutex.Lock()
+	err := session.follow(context.Background())
+	session.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPlayback(t, events, EVENT_PLAYBACK_TAKEN_OVER)
+	for i := 0; ; i++ {
+		if output, devices := cc.current(); output.Name() == "Kitchen" && len(devices) == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("taken over member is still in the group")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the rest of the group still plays, and the new app is left alone
+	if err := cc.Control(PAUSE); err != nil {
+		t.Fatal(err)
+	}
+	if messages := strings.Join(kitchen.received(controllers.NamespaceMedia), ","); messages != "PAUSE" {
+		t.Fatalf("unexpected kitchen messages: %s", messages)
+	}
+	if messages := bedroom.received(controllers.NamespaceMedia); len(messages) != 0 {
+		t.Fatalf("unexpected bedroom messages: %v", messages)
+	}
+}
@@ -0,0 +1,254 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vkl/go-cast"
+)
+
+// newTestChromecastControl returns a ChromecastControl that does not
+// run discovery.
+func newTestChromecastControl(t *testing.T, castControl *CastController, events *EventBus) *ChromecastControl {
+	cc := &ChromecastControl{
+		castControl: castControl,
+		discovery:   NewDiscoveryManager(castControl, events),
+		events:      events,
+		sessions:    NewConnectionManager(events),
+	}
+	t.Cleanup(cc.sessions.Close)
+	cc.followPlayback()
+	return cc
+}
+
+func TestChromecastControlConcurrent(t *testing.T) {
+	renderer := &fakeRenderer{state: "STOPPED", volume: 30}
+	srv := httptest.NewServer(renderer)
+	defer srv.Close()
+	castInfo, err := fetchRenderer(context.Background(), srv.URL+"/description.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	castControl := &CastController{}
+	if err := castControl.UpdateCast(castInfo); err != nil {
+		t.Fatal(err)
+	}
+	cc := newTestChromecastControl(t, castControl, nil)
+	card := Card{
+		Id:         "card1",
+		Chromecast: castInfo.Name,
+		MediaLinks: []MediaLink{{Link: "http://media/1.mp3"}, {Link: "http://media/2.mp3"}},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				switch (i + j) % 5 {
+				case 0:
+					cc.PlayCard(card)
+				case 1:
+					cc.Control(PAUSE)
+				case 2:
+					cc.Control(NEXT)
+				case 3:
+					cc.GetVolume()
+				case 4:
+					cc.CastStatus()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// commands for the device never interleave; status queries may
+	actions := make([]string, 0)
+	all, _ := renderer.takeActions()
+	for _, action := range all {
+		if action != "GetTransportInfo" && action != "GetVolume" {
+			actions = append(actions, action)
+		}
+	}
+	for i, action := range actions {
+		if action == "SetAVTransportURI" && (i+1 == len(actions) || actions[i+1] != "Play") {
+			t.Fatalf("command interleaved at %d: %v", i, actions)
+		}
+	}
+}
+
+func TestControllersConcurrent(t *testing.T) {
+	cardController, err := NewCardController(t.TempDir() + "/cards.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	castControl := &CastController{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				id := fmt.Sprintf("0a0%d", j%4)
+				name := fmt.Sprintf("Speaker %d", j%3)
+				switch i % 4 {
+				case 0:
+					cardController.AddCard(Card{
+						Id:         id,
+						Chromecast: name,
+						MaxVolume:  1,
+						MediaLinks: []MediaLink{{Link: "http://media/1.mp3"}},
+					})
+				case 1:
+					cardController.DelCard(id)
+					cardController.GetCard(id)
+				case 2:
+					json.NewEncoder(io.Discard).Encode(cardController.GetCards())
+					json.NewEncoder(io.Discard).Encode(castControl.GetCasts())
+				case 3:
+					castControl.UpdateCast(Cast{
+						Name:   name,
+						IPAddr: []byte{192, 168, 1, byte(j % 3)},
+						Port:   8009,
+						Info:   map[string]string{"id": fmt.Sprintf("uuid-%d", j%3)},
+					})
+					cardController.ResolveDevices(castControl)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestChromecastControlErrors(t *testing.T) {
+	castControl := &CastController{}
+	cc := newTestChromecastControl(t, castControl, nil)
+
+	if err := cc.Control(PLAY); !errors.Is(err, ErrNoActiveSession) {
+		t.Fatalf("expected no active session, got %v", err)
+	}
+	if _, err := cc.GetVolume(); !errors.Is(err, ErrNoActiveSession) {
+		t.Fatalf("expected no active session, got %v", err)
+	}
+	if err := cc.ClientControl(ClientAction{Action: "rewind"}); !errors.Is(err, ErrInvalidAction) {
+		t.Fatalf("expected invalid action, got %v", err)
+	}
+	if err := cc.PlayCard(Card{Id: "card1", Chromecast: "Attic"}); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("expected device not found, got %v", err)
+	}
+}
+
+func TestReceiverApp(t *testing.T) {
+	castControl := &CastController{}
+	kitchen := Cast{
+		Name:   "Kitchen",
+		IPAddr: []byte{192, 168, 1, 20},
+		Port:   8009,
+		Info:   map[string]string{"id": "uuid-1", "fn": "Kitchen"},
+	}
+	castControl.UpdateCast(kitchen)
+	if err := castControl.SetReceiverApp("Kitchen", "ABCD1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := castControl.SetReceiverApp("Attic", "ABCD1234"); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("expected device not found, got %v", err)
+	}
+	// discovery does not forget it
+	castControl.UpdateCast(kitchen)
+	castInfo, _ := castControl.GetCastByName("Kitchen")
+	if castInfo.ReceiverAppId != "ABCD1234" {
+		t.Fatalf("receiver app was lost: %+v", castInfo)
+	}
+
+	output := &chromecastOutput{castInfo: castInfo}
+	if app := output.receiverApp(Card{ReceiverAppId: "5678EFAB"}); app != "5678EFAB" {
+		t.Fatalf("card receiver app not used: %s", app)
+	}
+	if app := output.receiverApp(Card{}); app != "ABCD1234" {
+		t.Fatalf("device receiver app not used: %s", app)
+	}
+	output.castInfo.ReceiverAppId = ""
+	if app := output.receiverApp(Card{}); app != cast.AppMedia {
+		t.Fatalf("expected the Default Media Receiver, got %s", app)
+	}
+}
+
+func waitEvent(t *testing.T, events <-chan Event, eventType string) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		if event.Type != eventType {
+			t.Fatalf("got %s event, expected %s", event.Type, eventType)
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("no %s event", eventType)
+	}
+	return Event{}
+}
+
+func TestChromecastControlEvents(t *testing.T) {
+	renderer := &fakeRenderer{state: "STOPPED", volume: 30}
+	srv := httptest.NewServer(renderer)
+	defer srv.Close()
+	castInfo, err := fetchRenderer(context.Background(), srv.URL+"/description.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	castControl := &CastController{}
+	castControl.UpdateCast(castInfo)
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	cc := newTestChromecastControl(t, castControl, bus)
+	cc.statusChanged = make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cc.watchStatus(ctx)
+
+	card := Card{Id: "card1", Name: "Songs", Chromecast: castInfo.Name, MediaLinks: []MediaLink{{Link: "http://media/1.mp3"}}}
+	if err := cc.PlayCard(card); err != nil {
+		t.Fatal(err)
+	}
+	nowPlaying := waitEvent(t, events, EVENT_PLAYER_NOW_PLAYING).Data.(NowPlayingEvent)
+	if nowPlaying.Card != "card1" || nowPlaying.Output != castInfo.Name {
+		t.Fatalf("unexpected now playing: %+v", nowPlaying)
+	}
+	status := waitEvent(t, events, EVENT_PLAYER_STATUS).Data.(PlayerStatus)
+	if status.MediaStatus != "PLAYING" || status.MediaData != "Songs" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if volume := waitEvent(t, events, EVENT_PLAYER_VOLUME).Data.(VolumeEvent); volume.Volume != 0.3 {
+		t.Fatalf("unexpected volume: %+v", volume)
+	}
+
+	if err := cc.SetVolume(0.5); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, events, EVENT_PLAYER_STATUS)
+	if volume := waitEvent(t, events, EVENT_PLAYER_VOLUME).Data.(VolumeEvent); volume.Volume != 0.5 {
+		t.Fatalf("unexpected volume: %+v", volume)
+	}
+
+	// the renderer refuses to skip past the last track
+	if err := cc.Control(NEXT); err == nil {
+		t.Fatal("expected an error")
+	}
+	if failure := waitEvent(t, events, EVENT_ERROR).Data.(ErrorEvent); failure.Source != "next" {
+		t.Fatalf("unexpected error event: %+v", failure)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %s event", event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,199 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	_ "github.com/vkl/rfidplayer/pkg/logging"
+)
+
+// Card types. A card with an empty type plays its media; the others are
+// command cards, doing what their type says when they are put in.
+const (
+	// COMMAND_STOP stops what the player is playing.
+	COMMAND_STOP = "stop"
+	// COMMAND_SHUFFLE turns shuffling the media of the cards played
+	// next on or off.
+	COMMAND_SHUFFLE = "shuffle"
+	// COMMAND_OUTPUT makes the cards played next play on the card's
+	// device instead of their own, or back on their own when they
+	// already do.
+	COMMAND_OUTPUT = "output"
+	// COMMAND_ROOM makes the card's device the one cards without a
+	// device play on, for a player carried from room to room.
+	COMMAND_ROOM = "room"
+	// COMMAND_SLEEP stops playback once the card's sleep minutes have
+	// passed.
+	COMMAND_SLEEP = "sleep"
+	// COMMAND_DISCOVERY looks for devices.
+	COMMAND_DISCOVERY = "discovery"
+	// COMMAND_VOLUME sets the volume to the card's, now and for the
+	// card played next.
+	COMMAND_VOLUME = "volume"
+)
+
+// MAX_SLEEP_MINUTES is the longest sleep timer a card can set.
+const MAX_SLEEP_MINUTES = 12 * 60
+
+var commands = []string{
+	COMMAND_STOP,
+	COMMAND_SHUFFLE,
+	COMMAND_OUTPUT,
+	COMMAND_ROOM,
+	COMMAND_SLEEP,
+	COMMAND_DISCOVERY,
+	COMMAND_VOLUME,
+}
+
+func isCommand(cardType string) bool {
+	for _, command := range commands {
+		if command == cardType {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCommand reports whether the card is a command card.
+func (c Card) IsCommand() bool {
+	return c.Type != ""
+}
+
+// commandState is what command cards change about how the cards played
+// after them are played.
+type commandState struct {
+	shuffle bool
+	// output is where cards play instead of on their own devices, when
+	// its name is set.
+	output CardTarget
+	// volume is the volume the next card starts at, when above 0.
+	volume float64
+	sleep  *time.Timer
+}
+
+// RunCommand does what a command card says. It is published as
+// EVENT_PLAYER_COMMAND.
+func (cc *ChromecastControl) RunCommand(card Card) error {
+	var message string
+	switch card.Type {
+	case COMMAND_STOP:
+		cc.cancelSleep()
+		if err := cc.Control(STOP); err != nil && !errors.Is(err, ErrNoActiveSession) {
+			return err
+		}
+		message = "stopped"
+	case COMMAND_SHUFFLE:
+		cc.mutex.Lock()
+		cc.commands.shuffle = !cc.commands.shuffle
+		shuffle := cc.commands.shuffle
+		cc.mutex.Unlock()
+		message = fmt.Sprintf("shuffle %s", onOff(shuffle))
+	case COMMAND_OUTPUT:
+		targets := card.Targets()
+		if len(targets) == 0 {
+			return fmt.Errorf("%w: card has no device", ErrDeviceNotFound)
+		}
+		cc.mutex.Lock()
+		if cc.commands.output == targets[0] {
+			cc.commands.output = CardTarget{}
+			message = "cards play on their own devices"
+		} else {
+			cc.commands.output = targets[0]
+			message = fmt.Sprintf("cards play on %s", targets[0])
+		}
+		cc.mutex.Unlock()
+	case COMMAND_ROOM:
+		targets := card.Targets()
+		if len(targets) == 0 {
+			return fmt.Errorf("%w: card has no device", ErrDeviceNotFound)
+		}
+		castInfo, ok := cc.castControl.GetCastByTarget(targets[0])
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrDeviceNotFound, targets[0])
+		}
+		if err := cc.SetRoom(castInfo.Name); err != nil {
+			return err
+		}
+		message = fmt.Sprintf("room is %s", castInfo.Name)
+	case COMMAND_SLEEP:
+		duration := time.Duration(card.SleepMinutes) * time.Minute
+		cc.mutex.Lock()
+		if cc.commands.sleep != nil {
+			cc.commands.sleep.Stop()
+		}
+		cc.commands.sleep = time.AfterFunc(duration, cc.sleep)
+		cc.mutex.Unlock()
+		message = fmt.Sprintf("stopping in %d minutes", card.SleepMinutes)
+	case COMMAND_DISCOVERY:
+		cc.StartDiscovery(DISCOVERY_DURATION * time.Second)
+		message = "looking for devices"
+	case COMMAND_VOLUME:
+		cc.mutex.Lock()
+		cc.commands.volume = card.Volume
+		cc.mutex.Unlock()
+		if err := cc.SetVolume(card.Volume); err != nil && !errors.Is(err, ErrNoActiveSession) {
+			return err
+		}
+		message = fmt.Sprintf("volume %.2f", card.Volume)
+	default:
+		return fmt.Errorf("%w: card type %q", ErrInvalidAction, card.Type)
+	}
+	slog.Info("card command", "card", card.Id, "command", card.Type, "message", message)
+	cc.events.Publish(EVENT_PLAYER_COMMAND, CommandEvent{Card: card.Id, Command: card.Type, Message: message})
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// sleep stops playback when the sleep timer goes off.
+func (cc *ChromecastControl) sleep() {
+	cc.mutex.Lock()
+	cc.commands.sleep = nil
+	cc.mutex.Unlock()
+	if err := cc.Control(STOP); err != nil && !errors.Is(err, ErrNoActiveSession) {
+		slog.Error("sleep timer", "error", err)
+		return
+	}
+	slog.Info("sleep timer stopped playback")
+	cc.events.Publish(EVENT_PLAYER_COMMAND, CommandEvent{Command: COMMAND_SLEEP, Message: "stopped"})
+}
+
+func (cc *ChromecastControl) cancelSleep() {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cc.commands.sleep != nil {
+		cc.commands.sleep.Stop()
+		cc.commands.sleep = nil
+	}
+}
+
+// applyCommands returns the card as the command cards played before
+// say to play it, and the volume to start it at, or 0 to leave the
+// volume as it is. The volume is only used once.
+func (cc *ChromecastControl) applyCommands(card Card) (Card, float64) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cc.commands.output.Name != "" {
+		card.Chromecast, card.ChromecastId = cc.commands.output.Name, cc.commands.output.Id
+		card.Chromecasts, card.ChromecastIds = nil, nil
+	}
+	if cc.commands.shuffle && len(card.MediaLinks) > 1 {
+		links := append([]MediaLink{}, card.MediaLinks...)
+		rand.Shuffle(len(links), func(i, j int) { links[i], links[j] = links[j], links[i] })
+		card.MediaLinks = links
+	}
+	volume := cc.commands.volume
+	cc.commands.volume = 0
+	if volume > card.MaxVolume {
+		volume = card.MaxVolume
+	}
+	return card, volume
+}
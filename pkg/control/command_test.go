@@ -0,0 +1,105 @@
+package control
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCommandCards(t *testing.T) {
+	events := NewEventBus()
+	ch, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+	cc := newTestChromecastControl(t, &CastController{}, events)
+	card := Card{
+		Id:         "0a1b",
+		Chromecast: "Kitchen",
+		MaxVolume:  0.5,
+		MediaLinks: []MediaLink{{Link: "http://media/1.mp3"}, {Link: "http://media/2.mp3"}, {Link: "http://media/3.mp3"}},
+	}
+	run := func(command Card) CommandEvent {
+		t.Helper()
+		if err := cc.PlayCard(command); err != nil {
+			t.Fatal(err)
+		}
+		return waitEvent(t, ch, EVENT_PLAYER_COMMAND).Data.(CommandEvent)
+	}
+
+	run(Card{Id: "1a1b", Type: COMMAND_OUTPUT, Chromecast: "Attic"})
+	run(Card{Id: "2a2b", Type: COMMAND_VOLUME, Volume: 0.8})
+	played, volume := cc.applyCommands(card)
+	if played.Chromecast != "Attic" || volume != 0.5 {
+		t.Fatalf("expected the card on Attic at its max volume, got %s at %v", played.Chromecast, volume)
+	}
+	if _, volume := cc.applyCommands(card); volume != 0 {
+		t.Fatalf("expected the volume to be used once, got %v", volume)
+	}
+	if event := run(Card{Id: "1a1b", Type: COMMAND_OUTPUT, Chromecast: "Attic"}); event.Message != "cards play on their own devices" {
+		t.Fatalf("expected the output card to switch back, got %+v", event)
+	}
+	if played, _ := cc.applyCommands(card); played.Chromecast != "Kitchen" {
+		t.Fatalf("expected the card on its own device, got %s", played.Chromecast)
+	}
+
+	run(Card{Id: "3a3b", Type: COMMAND_SHUFFLE})
+	played, _ = cc.applyCommands(card)
+	links := make([]string, 0)
+	for _, link := range played.MediaLinks {
+		links = append(links, link.Link)
+	}
+	sort.Strings(links)
+	if !reflect.DeepEqual(links, []string{"http://media/1.mp3", "http://media/2.mp3", "http://media/3.mp3"}) {
+		t.Fatalf("expected the media shuffled, got %v", played.MediaLinks)
+	}
+	if card.MediaLinks[0].Link != "http://media/1.mp3" {
+		t.Fatal("shuffling changed the stored card")
+	}
+
+	run(Card{Id: "4a4b", Type: COMMAND_SLEEP, SleepMinutes: 30})
+	cc.mutex.Lock()
+	sleeping := cc.commands.sleep != nil
+	cc.mutex.Unlock()
+	if !sleeping {
+		t.Fatal("expected a sleep timer")
+	}
+	run(Card{Id: "5a5b", Type: COMMAND_STOP})
+	cc.mutex.Lock()
+	sleeping = cc.commands.sleep != nil
+	cc.mutex.Unlock()
+	if sleeping {
+		t.Fatal("expected the stop card to cancel the sleep timer")
+	}
+}
+
+func TestRoomCard(t *testing.T) {
+	castControl := &CastController{}
+	castControl.UpdateCast(Cast{
+		Name:   "Kitchen",
+		IPAddr: net.IPv4(192, 168, 1, 20),
+		Port:   8009,
+		Info:   map[string]string{"id": "uuid-kitchen", "fn": "Kitchen"},
+	})
+	cc := newTestChromecastControl(t, castControl, NewEventBus())
+	card := Card{Id: "0a1b", MaxVolume: 1, MediaLinks: []MediaLink{{Link: "http://media/1.mp3"}}}
+	if _, _, err := cc.outputFor(card); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("expected a card without a device to need a room, got %v", err)
+	}
+	if err := cc.RunCommand(Card{Id: "1a1b", Type: COMMAND_ROOM, Chromecast: "Attic"}); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("expected an unknown room to be refused, got %v", err)
+	}
+	if err := cc.RunCommand(Card{Id: "1a1b", Type: COMMAND_ROOM, ChromecastId: "uuid-kitchen"}); err != nil {
+		t.Fatal(err)
+	}
+	if room := cc.CastStatus().Room; room != "Kitchen" {
+		t.Fatalf("expected the status to show Kitchen, got %q", room)
+	}
+	output, devices, err := cc.outputFor(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Name() != "Kitchen" || !reflect.DeepEqual(devices, []string{"uuid-kitchen"}) {
+		t.Fatalf("expected the card to play in the kitchen, got %s %v", output.Name(), devices)
+	}
+}
@@ -0,0 +1,194 @@
+package control
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/vkl/go-cast/discovery"
+	_ "github.com/vkl/rfidplayer/pkg/logging"
+)
+
+const (
+	DISCOVERY_DURATION         = 30
+	DISCOVERY_REFRESH_INTERVAL = 2 * time.Minute
+	DISCOVERY_QUERY_INTERVAL   = 4 * time.Second
+	DEVICE_OFFLINE_TIMEOUT     = 2*DISCOVERY_REFRESH_INTERVAL + DISCOVERY_DURATION*time.Second
+	STATIC_PROBE_TIMEOUT       = 2 * time.Second
+)
+
+// DiscoveryManager keeps the device list up to date. It runs a
+// discovery pass every DISCOVERY_REFRESH_INTERVAL or when triggered,
+// marks devices offline once they have not been seen for
+// DEVICE_OFFLINE_TIMEOUT and publishes a device event for every change.
+type DiscoveryManager struct {
+	castControl *CastController
+	events      *EventBus
+	trigger     chan time.Duration
+	discovering atomic.Bool
+}
+
+func NewDiscoveryManager(castControl *CastController, events *EventBus) *DiscoveryManager {
+	return &DiscoveryManager{
+		castControl: castControl,
+		events:      events,
+		trigger:     make(chan time.Duration, 1),
+	}
+}
+
+// Trigger asks for a discovery pass of the given duration unless one
+// is already running.
+func (d *DiscoveryManager) Trigger(duration time.Duration) {
+	if d.discovering.Load() {
+		slog.Warn("discovery already started early")
+		return
+	}
+	select {
+	case d.trigger <- duration:
+	default:
+	}
+}
+
+func (d *DiscoveryManager) IsDiscovering() bool {
+	return d.discovering.Load()
+}
+
+// Run owns the device list until ctx is done: every change to it is
+// made from this goroutine.
+func (d *DiscoveryManager) Run(ctx context.Context) {
+	service := discovery.NewService(ctx)
+	devices := make(chan Cast)
+	ticker := time.NewTicker(DISCOVERY_REFRESH_INTERVAL)
+	defer ticker.Stop()
+
+	var passDone <-chan struct{}
+	var cancelPass context.CancelFunc
+	startPass := func(duration time.Duration) {
+		if passDone != nil {
+			return
+		}
+		var passCtx context.Context
+		passCtx, cancelPass = context.WithTimeout(ctx, duration)
+		passDone = passCtx.Done()
+		d.discovering.Store(true)
+		slog.Info("Discovery started")
+		go service.Run(passCtx, DISCOVERY_QUERY_INTERVAL)
+		go func() {
+			if err := SearchRenderers(passCtx, devices); err != nil {
+				slog.Error("search renderers", "error", err)
+			}
+		}()
+		go func() {
+			if err := SearchMpd(passCtx, DISCOVERY_QUERY_INTERVAL, devices); err != nil {
+				slog.Error("search mpd", "error", err)
+			}
+		}()
+		go probeStatic(passCtx, d.staticCasts(), devices)
+	}
+
+	d.expire(time.Now())
+	startPass(DISCOVERY_DURATION * time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			if cancelPass != nil {
+				cancelPass()
+			}
+			return
+		case <-ticker.C:
+			startPass(DISCOVERY_DURATION * time.Second)
+		case duration := <-d.trigger:
+			startPass(duration)
+		case client := <-service.Found():
+			d.found(Cast{
+				Name:   client.Name(),
+				IPAddr: client.IP(),
+				Port:   client.Port(),
+				Info:   client.GetInfo(),
+				Kind:   KIND_CHROMECAST,
+			})
+		case device := <-devices:
+			d.found(device)
+		case <-passDone:
+			slog.Info("Discovery complete")
+			cancelPass()
+			passDone, cancelPass = nil, nil
+			d.discovering.Store(false)
+			d.expire(time.Now())
+		}
+	}
+}
+
+func (d *DiscoveryManager) staticCasts() Casts {
+	casts := make(Casts, 0)
+	for _, cast := range d.castControl.GetCasts() {
+		if cast.Static {
+			casts = append(casts, cast)
+		}
+	}
+	return casts
+}
+
+// probeStatic reports static entries as seen when their port accepts
+// connections, as discovery never finds them.
+func probeStatic(ctx context.Context, casts Casts, found chan<- Cast) {
+	for _, cast := range casts {
+		address := net.JoinHostPort(cast.IPAddr.String(), strconv.Itoa(cast.Port))
+		conn, err := net.DialTimeout("tcp", address, STATIC_PROBE_TIMEOUT)
+		if err != nil {
+			slog.Debug("static cast unreachable", "name", cast.Name, "error", err)
+			continue
+		}
+		conn.Close()
+		select {
+		case found <- cast:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *DiscoveryManager) found(cast Cast) {
+	previous, known := d.castControl.GetCastById(cast.Id())
+	if !known {
+		previous, known = d.castControl.GetCastByName(cast.Name)
+	}
+	if err := d.castControl.UpdateCast(cast); err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	current, _ := d.castControl.GetCastByName(cast.Name)
+	event := DeviceEvent{Cast: current, Previous: &previous}
+	switch {
+	case !known:
+		slog.Info("device found", "name", cast.Name, "addr", cast.IPAddr)
+		d.events.Publish(EVENT_DEVICE_FOUND, DeviceEvent{Cast: current})
+	case previous.Name != cast.Name:
+		slog.Info("device renamed", "name", cast.Name, "previous", previous.Name)
+		d.events.Publish(EVENT_DEVICE_RENAMED, event)
+	case !previous.IPAddr.Equal(cast.IPAddr) || previous.Port != cast.Port:
+		slog.Info("device moved", "name", cast.Name, "addr", cast.IPAddr, "previous", previous.IPAddr)
+		d.events.Publish(EVENT_DEVICE_MOVED, event)
+	case !previous.Online:
+		slog.Info("device online", "name", cast.Name)
+		d.events.Publish(EVENT_DEVICE_ONLINE, event)
+	}
+}
+
+func (d *DiscoveryManager) expire(now time.Time) {
+	for _, cast := range d.castControl.GetCasts() {
+		if !cast.Online || cast.Kind == KIND_LOCAL || now.Sub(cast.LastSeen) < DEVICE_OFFLINE_TIMEOUT {
+			continue
+		}
+		if err := d.castControl.SetOffline(cast.Name); err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		slog.Info("device offline", "name", cast.Name, "last_seen", cast.LastSeen)
+		cast.Online = false
+		d.events.Publish(EVENT_DEVICE_OFFLINE, DeviceEvent{Cast: cast})
+	}
+}
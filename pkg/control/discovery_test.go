@@ -0,0 +1,74 @@
+package control
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func expectEvent(t *testing.T, events <-chan Event, eventType string) DeviceEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		if event.Type != eventType {
+			t.Fatalf("got %s event, expected %s", event.Type, eventType)
+		}
+		return event.Data.(DeviceEvent)
+	default:
+		t.Fatalf("no %s event", eventType)
+	}
+	return DeviceEvent{}
+}
+
+func TestDiscoveryManager(t *testing.T) {
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	castControl := &CastController{}
+	d := NewDiscoveryManager(castControl, bus)
+
+	kitchen := Cast{
+		Name:   "Kitchen",
+		IPAddr: net.IPv4(192, 168, 1, 20),
+		Port:   8009,
+		Info:   map[string]string{"id": "uuid-1", "fn": "Kitchen"},
+	}
+	d.found(kitchen)
+	if event := expectEvent(t, events, EVENT_DEVICE_FOUND); !event.Cast.Online {
+		t.Fatalf("found device is not online: %+v", event.Cast)
+	}
+	d.found(kitchen)
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %s event for an unchanged device", event.Type)
+	default:
+	}
+
+	kitchen.IPAddr = net.IPv4(192, 168, 1, 21)
+	d.found(kitchen)
+	event := expectEvent(t, events, EVENT_DEVICE_MOVED)
+	if !event.Previous.IPAddr.Equal(net.IPv4(192, 168, 1, 20)) {
+		t.Fatalf("unexpected previous address: %v", event.Previous.IPAddr)
+	}
+
+	kitchen.Name = "Kitchen speaker"
+	d.found(kitchen)
+	event = expectEvent(t, events, EVENT_DEVICE_RENAMED)
+	if event.Previous.Name != "Kitchen" || len(castControl.GetCasts()) != 1 {
+		t.Fatalf("rename did not replace the device: %+v", castControl.GetCasts())
+	}
+
+	d.expire(time.Now())
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %s event for a device just seen", event.Type)
+	default:
+	}
+	d.expire(time.Now().Add(DEVICE_OFFLINE_TIMEOUT + time.Second))
+	expectEvent(t, events, EVENT_DEVICE_OFFLINE)
+	if cast, _ := castControl.GetCastByName("Kitchen speaker"); cast.Online {
+		t.Fatal("device was not marked offline")
+	}
+	d.found(kitchen)
+	expectEvent(t, events, EVENT_DEVICE_ONLINE)
+}
@@ -0,0 +1,638 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vkl/go-cast"
+	_ "github.com/vkl/rfidplayer/pkg/logging"
+)
+
+const (
+	SSDP_ADDR                 = "239.255.255.250:1900"
+	SSDP_SEARCH_INTERVAL      = 4 * time.Second
+	DLNA_REQUEST_TIMEOUT      = 5 * time.Second
+	DLNA_FOLLOW_INTERVAL      = 2 * time.Second
+	UPNP_MEDIA_RENDERER       = "urn:schemas-upnp-org:device:MediaRenderer:1"
+	UPNP_AV_TRANSPORT         = "urn:schemas-upnp-org:service:AVTransport:1"
+	UPNP_RENDERING_CONTROL    = "urn:schemas-upnp-org:service:RenderingControl:1"
+	SOAP_ENVELOPE_NS          = "http://schemas.xmlsoap.org/soap/envelope/"
+	SOAP_ENCODING_STYLE       = "http://schemas.xmlsoap.org/soap/encoding/"
+	DIDL_LITE_MUSIC_TRACK     = "object.item.audioItem.musicTrack"
+	DLNA_DEFAULT_CONTENT_TYPE = "audio/mpeg"
+)
+
+var ssdpSearchRequest = "M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: " + SSDP_ADDR + "\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"MX: 2\r\n" +
+	"ST: " + UPNP_MEDIA_RENDERER + "\r\n\r\n"
+
+// SearchRenderers sends SSDP M-SEARCH requests for UPnP MediaRenderers
+// until ctx is done and sends every new renderer it finds to found.
+func SearchRenderers(ctx context.Context, found chan<- Cast) error {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	addr, err := net.ResolveUDPAddr("udp4", SSDP_ADDR)
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(SSDP_SEARCH_INTERVAL)
+		defer ticker.Stop()
+		for {
+			if _, err := conn.WriteTo([]byte(ssdpSearchRequest), addr); err != nil {
+				slog.Error("ssdp search", "error", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	seen := make(map[string]bool)
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		location, err := parseSsdpResponse(buf[:n])
+		if err != nil {
+			slog.Debug("ssdp response", "error", err)
+			continue
+		}
+		if seen[location] {
+			continue
+		}
+		seen[location] = true
+		renderer, err := fetchRenderer(ctx, location)
+		if err != nil {
+			slog.Error("fetch renderer", "error", err, "location", location)
+			continue
+		}
+		select {
+		case found <- renderer:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func parseSsdpResponse(data []byte) (string, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if st := resp.Header.Get("ST"); st != "" && st != UPNP_MEDIA_RENDERER {
+		return "", fmt.Errorf("unexpected search target: %s", st)
+	}
+	location := resp.Header.Get("LOCATION")
+	if location == "" {
+		return "", fmt.Errorf("no location in ssdp response")
+	}
+	return location, nil
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	DeviceType   string        `xml:"deviceType"`
+	FriendlyName string        `xml:"friendlyName"`
+	ModelName    string        `xml:"modelName"`
+	UDN          string        `xml:"UDN"`
+	Services     []upnpService `xml:"serviceList>service"`
+	Devices      []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+func (d upnpDevice) findRenderer() (upnpDevice, bool) {
+	if d.DeviceType == UPNP_MEDIA_RENDERER {
+		return d, true
+	}
+	for _, device := range d.Devices {
+		if renderer, ok := device.findRenderer(); ok {
+			return renderer, true
+		}
+	}
+	return upnpDevice{}, false
+}
+
+func (d upnpDevice) controlURL(serviceType string) string {
+	for _, service := range d.Services {
+		if service.ServiceType == serviceType {
+			return service.ControlURL
+		}
+	}
+	return ""
+}
+
+// fetchRenderer reads the device description at location and returns
+// the MediaRenderer it describes as a Cast.
+func fetchRenderer(ctx context.Context, location string) (Cast, error) {
+	ctx, cancel := context.WithTimeout(ctx, DLNA_REQUEST_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return Cast{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Cast{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Cast{}, fmt.Errorf("device description: %s", resp.Status)
+	}
+	root := upnpRoot{}
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return Cast{}, err
+	}
+	device, ok := root.Device.findRenderer()
+	if !ok {
+		return Cast{}, fmt.Errorf("%s is not a media renderer", location)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return Cast{}, err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return Cast{}, err
+		}
+	}
+	resolve := func(ref string) string {
+		if ref == "" {
+			return ""
+		}
+		u, err := base.Parse(ref)
+		if err != nil {
+			return ""
+		}
+		return u.String()
+	}
+	avTransport := resolve(device.controlURL(UPNP_AV_TRANSPORT))
+	if avTransport == "" {
+		return Cast{}, fmt.Errorf("%s has no AVTransport service", device.FriendlyName)
+	}
+
+	port, _ := strconv.Atoi(base.Port())
+	if port == 0 {
+		port = 80
+	}
+	return Cast{
+		Name:   device.FriendlyName,
+		IPAddr: net.ParseIP(base.Hostname()),
+		Port:   port,
+		Kind:   KIND_DLNA,
+		Info: map[string]string{
+			"fn":               device.FriendlyName,
+			"id":               strings.TrimPrefix(device.UDN, "uuid:"),
+			"md":               device.ModelName,
+			"location":         location,
+			"avtransport":      avTransport,
+			"renderingcontrol": resolve(device.controlURL(UPNP_RENDERING_CONTROL)),
+		},
+	}, nil
+}
+
+type soapArg struct {
+	Name  string
+	Value string
+}
+
+// dlnaOutput plays cards on a UPnP/DLNA MediaRenderer. Renderers have
+// no queue of their own, so the card's media links are stepped through
+// here: the link after the one playing is queued with
+// SetNextAVTransportURI where the renderer takes it, and a follow loop
+// plays the next link when the renderer stops at the end of one.
+type dlnaOutput struct {
+	name             string
+	avTransport      string
+	renderingControl string
+	httpClient       *http.Client
+	// steps serializes stepping through the card between commands and
+	// the follow loop.
+	steps   sync.Mutex
+	mutex   sync.Mutex
+	card    Card
+	index   int
+	playing bool
+	// queued is set when the renderer took the next link, so that Next
+	// plays it.
+	queued bool
+	cancel context.CancelFunc
+}
+
+func newDlnaOutput(castInfo Cast) *dlnaOutput {
+	return &dlnaOutput{
+		name:             castInfo.Name,
+		avTransport:      castInfo.Info["avtransport"],
+		renderingControl: castInfo.Info["renderingcontrol"],
+		httpClient:       &http.Client{Timeout: DLNA_REQUEST_TIMEOUT},
+	}
+}
+
+func (o *dlnaOutput) Name() string {
+	return o.name
+}
+
+func (o *dlnaOutput) String() string {
+	return fmt.Sprintf("%s - %s", o.name, o.avTransport)
+}
+
+func (o *dlnaOutput) PlayCard(ctx context.Context, card Card) error {
+	o.steps.Lock()
+	defer o.steps.Unlock()
+	o.mutex.Lock()
+	o.card = card
+	o.index = 0
+	o.playing, o.queued = false, false
+	if o.cancel == nil && len(card.MediaLinks) > 1 {
+		followCtx, cancel := context.WithCancel(context.Background())
+		o.cancel = cancel
+		go o.follow(followCtx)
+	}
+	o.mutex.Unlock()
+	if len(card.MediaLinks) == 0 {
+		return nil
+	}
+	return o.playIndex(ctx, 0)
+}
+
+// playIndex plays the link at index and queues the one after it.
+// Callers hold steps.
+func (o *dlnaOutput) playIndex(ctx context.Context, index int) error {
+	o.mutex.Lock()
+	card := o.card
+	o.mutex.Unlock()
+	if index < 0 || index >= len(card.MediaLinks) {
+		return fmt.Errorf("no media item %d on card %s", index, card.Id)
+	}
+	link := card.MediaLinks[index]
+	metadata := didlLite(card.Name, link.Link, link.ContentType)
+	if _, err := o.call(ctx, o.avTransport, UPNP_AV_TRANSPORT, "SetAVTransportURI",
+		soapArg{"InstanceID", "0"},
+		soapArg{"CurrentURI", link.Link},
+		soapArg{"CurrentURIMetaData", metadata},
+	); err != nil {
+		return err
+	}
+	if _, err := o.call(ctx, o.avTransport, UPNP_AV_TRANSPORT, "Play",
+		soapArg{"InstanceID", "0"},
+		soapArg{"Speed", "1"},
+	); err != nil {
+		return err
+	}
+	o.mutex.Lock()
+	o.index = index
+	o.playing, o.queued = true, false
+	o.mutex.Unlock()
+	o.queueNext(ctx, card, index+1)
+	return nil
+}
+
+// queueNext hands the link at index to the renderer to play after the
+// current one. Renderers that do not take it are stepped on by follow.
+// Callers hold steps.
+func (o *dlnaOutput) queueNext(ctx context.Context, card Card, index int) {
+	if index >= len(card.MediaLinks) {
+		return
+	}
+	link := card.MediaLinks[index]
+	_, err := o.call(ctx, o.avTransport, UPNP_AV_TRANSPORT, "SetNextAVTransportURI",
+		soapArg{"InstanceID", "0"},
+		soapArg{"NextURI", link.Link},
+		soapArg{"NextURIMetaData", didlLite(card.Name, link.Link, link.ContentType)},
+	)
+	if err != nil {
+		slog.Debug("dlna queue next", "error", err, "renderer", o.name)
+		return
+	}
+	o.mutex.Lock()
+	o.queued = true
+	o.mutex.Unlock()
+}
+
+// follow steps through the card as the renderer plays it, until ctx is
+// done.
+func (o *dlnaOutput) follow(ctx context.Context) {
+	ticker := time.NewTicker(DLNA_FOLLOW_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := o.advance(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("dlna follow", "error", err, "renderer", o.name)
+		}
+	}
+}
+
+// advance catches up with a renderer that moved on to the queued link,
+// and plays the next link when the renderer stopped at the end of one.
+func (o *dlnaOutput) advance(ctx context.Context) error {
+	o.steps.Lock()
+	defer o.steps.Unlock()
+	o.mutex.Lock()
+	card, index, playing, queued := o.card, o.index, o.playing, o.queued
+	o.mutex.Unlock()
+	if !playing {
+		return nil
+	}
+	instance := soapArg{"InstanceID", "0"}
+	if queued && index+1 < len(card.MediaLinks) {
+		position, err := o.call(ctx, o.avTransport, UPNP_AV_TRANSPORT, "GetPositionInfo", instance)
+		if err != nil {
+			return err
+		}
+		if uri := position["TrackURI"]; uri != card.MediaLinks[index].Link && uri == card.MediaLinks[index+1].Link {
+			o.mutex.Lock()
+			o.index, o.queued = index+1, false
+			o.mutex.Unlock()
+			o.queueNext(ctx, card, index+2)
+			return nil
+		}
+	}
+	transport, err := o.call(ctx, o.avTransport, UPNP_AV_TRANSPORT, "GetTransportInfo", instance)
+	if err != nil {
+		return err
+	}
+	switch transport["CurrentTransportState"] {
+	case "STOPPED", "NO_MEDIA_PRESENT":
+	default:
+		return nil
+	}
+	if index+1 < len(card.MediaLinks) {
+		return o.playIndex(ctx, index+1)
+	}
+	o.mutex.Lock()
+	o.playing = false
+	o.mutex.Unlock()
+	return nil
+}
+
+func (o *dlnaOutput) Control(ctx context.Context, payload ClientAction) error {
+	o.steps.Lock()
+	defer o.steps.Unlock()
+	instance := soapArg{"InstanceID", "0"}
+	var err error
+	switch payload.Action {
+	case "stop":
+		o.mutex.Lock()
+		o.playing = false
+		o.mutex.Unlock()
+		_, err = o.call(ctx, o.avTransport, UPNP_AV_TRANSPORT, "Stop", instance)
+	case "pause":
+		_, err = o.call(ctx, o.avTransport, UPNP_AV_TRANSPORT, "Pause", instance)
+	case "play":
+		_, err = o.call(ctx, o.avTransport, UPNP_AV_TRANSPORT, "Play", instance, soapArg{"Speed", "1"})
+		if err == nil {
+			o.mutex.Lock()
+			o.playing = len(o.card.MediaLinks) > 0
+			o.mutex.Unlock()
+		}
+	// renderers only know the link playing and the one queued, so
+	// Next is only sent for the queued link, and the ends of the card
+	// are the ends of the playlist
+	case "next":
+		o.mutex.Lock()
+		card, index, queued := o.card, o.index, o.queued
+		o.mutex.Unlock()
+		if index+1 >= len(card.MediaLinks) {
+			return fmt.Errorf("%w: next: the last link of the card is playing", ErrInvalidAction)
+		}
+		if queued {
+			if _, err = o.call(ctx, o.avTransport, UPNP_AV_TRANSPORT, "Next", instance); err == nil {
+				o.mutex.Lock()
+				o.index, o.playing, o.queued = index+1, true, false
+				o.mutex.Unlock()
+				o.queueNext(ctx, card, index+2)
+				return nil
+			}
+			slog.Debug("dlna next", "error", err, "renderer", o.name)
+		}
+		err = o.playIndex(ctx, index+1)
+	case "prev":
+		o.mutex.Lock()
+		index := o.index
+		o.mutex.Unlock()
+		if index <= 0 {
+			return fmt.Errorf("%w: prev: the first link of the card is playing", ErrInvalidAction)
+		}
+		err = o.playIndex(ctx, index-1)
+	case "setvolume":
+		if o.renderingControl == "" {
+			return fmt.Errorf("%s has no RenderingControl service", o.name)
+		}
+		_, err = o.call(ctx, o.renderingControl, UPNP_RENDERING_CONTROL, "SetVolume",
+			instance,
+			soapArg{"Channel", "Master"},
+			soapArg{"DesiredVolume", strconv.Itoa(int(payload.Volume*100 + 0.5))},
+		)
+	default:
+		err = fmt.Errorf("%w: %s", ErrInvalidAction, payload.Action)
+	}
+	return err
+}
+
+func (o *dlnaOutput) GetVolume(ctx context.Context) (float64, error) {
+	if o.renderingControl == "" {
+		return 0, fmt.Errorf("%s has no RenderingControl service", o.name)
+	}
+	resp, err := o.call(ctx, o.renderingControl, UPNP_RENDERING_CONTROL, "GetVolume",
+		soapArg{"InstanceID", "0"},
+		soapArg{"Channel", "Master"},
+	)
+	if err != nil {
+		return 0, err
+	}
+	level, err := strconv.Atoi(resp["CurrentVolume"])
+	if err != nil {
+		return 0, fmt.Errorf("bad volume %q: %w", resp["CurrentVolume"], err)
+	}
+	return float64(level) / 100, nil
+}
+
+// Status maps the renderer transport state onto the media states
+// reported by Cast devices.
+func (o *dlnaOutput) Status() cast.DisplayStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), DLNA_REQUEST_TIMEOUT)
+	defer cancel()
+	status := cast.DisplayStatus{Name: o.name, Status: "DLNA"}
+	resp, err := o.call(ctx, o.avTransport, UPNP_AV_TRANSPORT, "GetTransportInfo",
+		soapArg{"InstanceID", "0"})
+	if err != nil {
+		slog.Error("dlna status", "error", err, "renderer", o.name)
+		return status
+	}
+	switch resp["CurrentTransportState"] {
+	case "PLAYING":
+		status.MediaStatus = "PLAYING"
+	case "PAUSED_PLAYBACK":
+		status.MediaStatus = "PAUSED"
+	case "TRANSITIONING":
+		status.MediaStatus = "BUFFERING"
+	default:
+		status.MediaStatus = "IDLE"
+	}
+	o.mutex.Lock()
+	status.MediaData = o.card.Name
+	o.mutex.Unlock()
+	if volume, err := o.GetVolume(ctx); err == nil {
+		status.Volume = volume
+	}
+	return status
+}
+
+// Close stops following the renderer, leaving it playing.
+func (o *dlnaOutput) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.cancel != nil {
+		o.cancel()
+		o.cancel = nil
+	}
+	return nil
+}
+
+// call invokes a SOAP action on a UPnP service and returns the
+// output arguments of the response.
+func (o *dlnaOutput) call(
+	ctx context.Context,
+	controlURL string,
+	service string,
+	action string,
+	args ...soapArg) (map[string]string, error) {
+
+	body := &bytes.Buffer{}
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
+	fmt.Fprintf(body, `<s:Envelope xmlns:s="%s" s:encodingStyle="%s"><s:Body>`,
+		SOAP_ENVELOPE_NS, SOAP_ENCODING_STYLE)
+	fmt.Fprintf(body, `<u:%s xmlns:u="%s">`, action, service)
+	for _, arg := range args {
+		fmt.Fprintf(body, "<%s>", arg.Name)
+		xml.EscapeText(body, []byte(arg.Value))
+		fmt.Fprintf(body, "</%s>", arg.Name)
+	}
+	fmt.Fprintf(body, "</u:%s></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, controlURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, service, action))
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConnectFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, soapError(action, resp)
+	}
+	values, err := parseSoapResponse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", action, err)
+	}
+	return values, nil
+}
+
+// soapError describes a failed SOAP call. Only a 500 response with an
+// XML body carries a UPnP fault; anything else, such as an HTML error
+// page from a proxy or an empty 404, is reported by its status.
+func soapError(action string, resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusInternalServerError ||
+		(mediaType != "text/xml" && mediaType != "application/xml") {
+		return fmt.Errorf("%s: %s", action, resp.Status)
+	}
+	values, err := parseSoapResponse(resp.Body)
+	if err != nil || values["errorCode"] == "" {
+		return fmt.Errorf("%s: %s", action, resp.Status)
+	}
+	return fmt.Errorf("%s %s: %s %s",
+		action, resp.Status, values["errorCode"], values["errorDescription"])
+}
+
+// parseSoapResponse collects the text of every leaf element in a SOAP
+// response by its local name.
+func parseSoapResponse(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(r)
+	var name string
+	var text []byte
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text = text[:0]
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			if name == t.Name.Local {
+				values[name] = strings.TrimSpace(string(text))
+			}
+			name = ""
+		}
+	}
+}
+
+func didlLite(title, link, contentType string) string {
+	if contentType == "" {
+		contentType = DLNA_DEFAULT_CONTENT_TYPE
+	}
+	escape := func(s string) string {
+		buf := &bytes.Buffer{}
+		xml.EscapeText(buf, []byte(s))
+		return buf.String()
+	}
+	return `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"` +
+		` xmlns:dc="http://purl.org/dc/elements/1.1/"` +
+		` xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">` +
+		`<item id="0" parentID="-1" restricted="1">` +
+		`<dc:title>` + escape(title) + `</dc:title>` +
+		`<upnp:class>` + DIDL_LITE_MUSIC_TRACK + `</upnp:class>` +
+		`<res protocolInfo="http-get:*:` + escape(contentType) + `:*">` + escape(link) + `</res>` +
+		`</item></DIDL-Lite>`
+}
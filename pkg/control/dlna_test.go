@@ -0,0 +1,347 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const fakeRendererDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+    <friendlyName>Kitchen speaker</friendlyName>
+    <modelName>FakeRenderer</modelName>
+    <UDN>uuid:0a1b2c3d</UDN>
+    <serviceList>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+        <controlURL>/AVTransport/control</controlURL>
+      </service>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:RenderingControl:1</serviceType>
+        <controlURL>/RenderingControl/control</controlURL>
+      </service>
+    </serviceList>
+  </device>
+</root>`
+
+type fakeRenderer struct {
+	mutex   sync.Mutex
+	actions []string
+	bodies  []string
+	state   string
+	volume  int
+	uri     string
+	next    string
+	// noNext rejects SetNextAVTransportURI, as many renderers do
+	noNext bool
+}
+
+// fakeRendererArg returns the text of an argument in a SOAP request.
+func fakeRendererArg(body string, name string) string {
+	start := strings.Index(body, "<"+name+">")
+	end := strings.Index(body, "</"+name+">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return body[start+len(name)+2 : end]
+}
+
+func fakeRendererFault(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+		`<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode>`+
+		`<errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, description)
+}
+
+// finish ends the track playing, going on to the queued one if any.
+func (f *fakeRenderer) finish() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.next != "" {
+		f.uri, f.next = f.next, ""
+		return
+	}
+	f.state = "STOPPED"
+}
+
+func (f *fakeRenderer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/description.xml" {
+		io.WriteString(w, fakeRendererDescription)
+		return
+	}
+	soapAction := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	action := soapAction[strings.Index(soapAction, "#")+1:]
+	body, _ := io.ReadAll(r.Body)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.actions = append(f.actions, action)
+	f.bodies = append(f.bodies, string(body))
+	result := ""
+	switch action {
+	case "Play":
+		f.state = "PLAYING"
+	case "Pause":
+		f.state = "PAUSED_PLAYBACK"
+	case "Stop":
+		f.state = "STOPPED"
+	case "SetAVTransportURI":
+		f.uri, f.next = fakeRendererArg(string(body), "CurrentURI"), ""
+	case "SetNextAVTransportURI":
+		if f.noNext {
+			fakeRendererFault(w, 401, "Invalid Action")
+			return
+		}
+		f.next = fakeRendererArg(string(body), "NextURI")
+	case "Next":
+		if f.next == "" {
+			fakeRendererFault(w, 711, "Illegal seek target")
+			return
+		}
+		f.uri, f.next, f.state = f.next, "", "PLAYING"
+	case "GetPositionInfo":
+		result = fmt.Sprintf("<TrackURI>%s</TrackURI>", f.uri)
+	case "SetVolume":
+		var volume int
+		fmt.Sscanf(string(body)[strings.Index(string(body), "<DesiredVolume>"):], "<DesiredVolume>%d", &volume)
+		if volume > 100 {
+			fakeRendererFault(w, 402, "Invalid Args")
+			return
+		}
+		f.volume = volume
+	case "GetVolume":
+		result = fmt.Sprintf("<CurrentVolume>%d</CurrentVolume>", f.volume)
+	case "GetTransportInfo":
+		result = fmt.Sprintf("<CurrentTransportState>%s</CurrentTransportState>", f.state)
+	}
+	fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+		`<u:%sResponse xmlns:u="urn:schemas-upnp-org:service:AVTransport:1">%s</u:%sResponse>`+
+		`</s:Body></s:Envelope>`, action, result, action)
+}
+
+func (f *fakeRenderer) takeActions() ([]string, []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	actions, bodies := f.actions, f.bodies
+	f.actions, f.bodies = nil, nil
+	return actions, bodies
+}
+
+func TestDlnaOutput(t *testing.T) {
+	renderer := &fakeRenderer{state: "NO_MEDIA_PRESENT", volume: 40}
+	srv := httptest.NewServer(renderer)
+	defer srv.Close()
+	ctx := context.Background()
+
+	castInfo, err := fetchRenderer(ctx, srv.URL+"/description.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if castInfo.Name != "Kitchen speaker" || castInfo.Kind != KIND_DLNA || castInfo.Info["id"] != "0a1b2c3d" {
+		t.Fatalf("unexpected renderer: %+v", castInfo)
+	}
+	if castInfo.Info["avtransport"] != srv.URL+"/AVTransport/control" {
+		t.Fatalf("unexpected control url: %s", castInfo.Info["avtransport"])
+	}
+
+	output, ok := newOutput(castInfo, nil).(*dlnaOutput)
+	if !ok {
+		t.Fatal("expected a dlna output")
+	}
+	card := Card{
+		Id:   "card1",
+		Name: "Tom & Jerry",
+		MediaLinks: []MediaLink{
+			{Link: "http://media/1.mp3", ContentType: "audio/mpeg"},
+			{Link: "http://media/2.mp3", ContentType: "audio/mpeg"},
+		},
+	}
+	if err := output.PlayCard(ctx, card); err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	actions, bodies := renderer.takeActions()
+	if strings.Join(actions, ",") != "SetAVTransportURI,Play,SetNextAVTransportURI" {
+		t.Fatalf("unexpected actions: %v", actions)
+	}
+	if !strings.Contains(bodies[0], "<CurrentURI>http://media/1.mp3</CurrentURI>") ||
+		!strings.Contains(bodies[0], "Tom &amp;amp; Jerry") {
+		t.Fatalf("unexpected SetAVTransportURI body: %s", bodies[0])
+	}
+	if status := output.Status(); status.MediaStatus != "PLAYING" || status.Volume != 0.4 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	renderer.takeActions()
+
+	for _, test := range []struct {
+		payload ClientAction
+		actions string
+	}{
+		{ClientAction{Action: "pause"}, "Pause"},
+		{ClientAction{Action: "next"}, "Next"},
+		{ClientAction{Action: "prev"}, "SetAVTransportURI,Play,SetNextAVTransportURI"},
+		{ClientAction{Action: "setvolume", Volume: 0.25}, "SetVolume"},
+		{ClientAction{Action: "stop"}, "Stop"},
+	} {
+		if err := output.Control(ctx, test.payload); err != nil {
+			t.Fatal(test.payload.Action, err)
+		}
+		if actions, _ := renderer.takeActions(); strings.Join(actions, ",") != test.actions {
+			t.Fatalf("%s: unexpected actions: %v", test.payload.Action, actions)
+		}
+	}
+	if volume, err := output.GetVolume(ctx); err != nil || volume != 0.25 {
+		t.Fatalf("unexpected volume: %v %v", volume, err)
+	}
+
+	// nothing is sent past the ends of the card
+	renderer.takeActions()
+	output.index = 1
+	if err := output.Control(ctx, ClientAction{Action: "next"}); !errors.Is(err, ErrInvalidAction) {
+		t.Fatalf("expected an invalid action, got %v", err)
+	}
+	output.index = 0
+	if err := output.Control(ctx, ClientAction{Action: "prev"}); !errors.Is(err, ErrInvalidAction) {
+		t.Fatalf("expected an invalid action, got %v", err)
+	}
+	if actions, _ := renderer.takeActions(); len(actions) != 0 {
+		t.Fatalf("unexpected actions: %v", actions)
+	}
+
+	err = output.Control(ctx, ClientAction{Action: "setvolume", Volume: 1.5})
+	if err == nil || !strings.Contains(err.Error(), "402") {
+		t.Fatalf("expected UPnP error, got %v", err)
+	}
+	if err := output.Control(ctx, ClientAction{Action: "rewind"}); err == nil {
+		t.Fatal("expected error on unknown command")
+	}
+}
+
+func TestDlnaOutputPlaysCard(t *testing.T) {
+	ctx := context.Background()
+	card := Card{
+		Id: "card1",
+		MediaLinks: []MediaLink{
+			{Link: "http://media/1.mp3"},
+			{Link: "http://media/2.mp3"},
+			{Link: "http://media/3.mp3"},
+		},
+	}
+	for _, test := range []struct {
+		name   string
+		noNext bool
+		// steps are the actions taken as each track ends
+		steps []string
+	}{
+		{"queued", false, []string{
+			"GetPositionInfo,SetNextAVTransportURI",
+			"GetPositionInfo",
+			"GetTransportInfo",
+		}},
+		{"stepped", true, []string{
+			"GetTransportInfo,SetAVTransportURI,Play,SetNextAVTransportURI",
+			"GetTransportInfo,SetAVTransportURI,Play",
+			"GetTransportInfo",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			renderer := &fakeRenderer{state: "STOPPED", volume: 40, noNext: test.noNext}
+			srv := httptest.NewServer(renderer)
+			defer srv.Close()
+			castInfo, err := fetchRenderer(ctx, srv.URL+"/description.xml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			output := newOutput(castInfo, nil).(*dlnaOutput)
+			defer output.Close()
+			if err := output.PlayCard(ctx, card); err != nil {
+				t.Fatal(err)
+			}
+			renderer.takeActions()
+			for i, expected := range test.steps {
+				renderer.finish()
+				if err := output.advance(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if actions, _ := renderer.takeActions(); strings.Join(actions, ",") != expected {
+					t.Fatalf("track %d: unexpected actions: %v", i+1, actions)
+				}
+				renderer.mutex.Lock()
+				uri := renderer.uri
+				renderer.mutex.Unlock()
+				if last := len(card.MediaLinks) - 1; uri != card.MediaLinks[min(i+1, last)].Link {
+					t.Fatalf("track %d: renderer is on %s", i+1, uri)
+				}
+			}
+			// the card has ended
+			if output.playing {
+				t.Fatal("expected the card to have ended")
+			}
+			if err := output.advance(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if actions, _ := renderer.takeActions(); len(actions) != 0 {
+				t.Fatalf("unexpected actions after the card ended: %v", actions)
+			}
+		})
+	}
+}
+
+func TestDlnaCallStatus(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		expected    string
+	}{
+		{"html page", http.StatusBadGateway, "text/html", "<html><body>Bad Gateway</body></html>", "Stop: 502 Bad Gateway"},
+		{"empty", http.StatusNotFound, "", "", "Stop: 404 Not Found"},
+		{"html fault", http.StatusInternalServerError, "text/html", "<html><p>oops</p></html>", "Stop: 500 Internal Server Error"},
+		{"upnp fault", http.StatusInternalServerError, `text/xml; charset="utf-8"`,
+			`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail>` +
+				`<UPnPError><errorCode>701</errorCode><errorDescription>Transition not available</errorDescription>` +
+				`</UPnPError></detail></s:Fault></s:Body></s:Envelope>`,
+			"Stop 500 Internal Server Error: 701 Transition not available"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.contentType != "" {
+					w.Header().Set("Content-Type", test.contentType)
+				}
+				w.WriteHeader(test.status)
+				io.WriteString(w, test.body)
+			}))
+			defer srv.Close()
+			output := newDlnaOutput(Cast{Name: "renderer", Info: map[string]string{"avtransport": srv.URL}})
+			_, err := output.call(ctx, output.avTransport, UPNP_AV_TRANSPORT, "Stop", soapArg{"InstanceID", "0"})
+			if err == nil || err.Error() != test.expected {
+				t.Fatalf("expected %q, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestParseSsdpResponse(t *testing.T) {
+	location, err := parseSsdpResponse([]byte("HTTP/1.1 200 OK\r\n" +
+		"CACHE-CONTROL: max-age=1800\r\n" +
+		"LOCATION: http://192.168.1.20:49152/description.xml\r\n" +
+		"ST: urn:schemas-upnp-org:device:MediaRenderer:1\r\n" +
+		"USN: uuid:0a1b2c3d::urn:schemas-upnp-org:device:MediaRenderer:1\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location != "http://192.168.1.20:49152/description.xml" {
+		t.Fatalf("unexpected location: %s", location)
+	}
+}
@@ -0,0 +1,20 @@
+package control
+
+import "errors"
+
+// Errors returned by ChromecastControl, CardController and the outputs. They are wrapped
+// with details, so test for them with errors.Is.
+var (
+	ErrCardNotFound    = errors.New("card not found")
+	ErrDeviceNotFound  = errors.New("device not found")
+	ErrConnectFailed   = errors.New("could not connect to device")
+	ErrAppLaunchFailed = errors.New("could not launch receiver app")
+	ErrLoadFailed      = errors.New("could not load media")
+	ErrNoActiveSession = errors.New("no active session")
+	ErrInvalidAction   = errors.New("invalid action")
+	ErrInvalidCard     = errors.New("invalid card")
+	ErrCardExists      = errors.New("card already exists")
+	ErrCardChanged     = errors.New("card was changed since it was read")
+	ErrCardsChanged    = errors.New("cards were changed outside the player")
+	ErrInvalidBundle   = errors.New("invalid card bundle")
+)
@@ -0,0 +1,141 @@
+package control
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	_ "github.com/vkl/rfidplayer/pkg/logging"
+)
+
+const EVENT_BUFFER_SIZE = 32
+
+const (
+	EVENT_DEVICE_FOUND   = "device.found"
+	EVENT_DEVICE_ONLINE  = "device.online"
+	EVENT_DEVICE_OFFLINE = "device.offline"
+	EVENT_DEVICE_MOVED   = "device.moved"
+	EVENT_DEVICE_RENAMED = "device.renamed"
+
+	EVENT_PLAYBACK_TAKEN_OVER = "playback.taken_over"
+	EVENT_PLAYBACK_FINISHED   = "playback.finished"
+
+	EVENT_PLAYER_STATUS      = "player.status"
+	EVENT_PLAYER_NOW_PLAYING = "player.now_playing"
+	EVENT_PLAYER_VOLUME      = "player.volume"
+	EVENT_PLAYER_COMMAND     = "player.command"
+
+	EVENT_CARD_INSERTED  = "card.inserted"
+	EVENT_CARD_REMOVED   = "card.removed"
+	EVENT_CARDS_RELOADED = "cards.reloaded"
+
+	EVENT_ERROR = "error"
+)
+
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type DeviceEvent struct {
+	Cast     Cast  `json:"cast"`
+	Previous *Cast `json:"previous,omitempty"`
+}
+
+// PlaybackEvent reports that a device stopped playing what the player
+// sent to it, either because its queue ended or because another sender
+// took it over.
+type PlaybackEvent struct {
+	Device string `json:"device"`
+	Reason string `json:"reason"`
+}
+
+// NowPlayingEvent reports a card that started playing.
+type NowPlayingEvent struct {
+	Card   string `json:"card"`
+	Name   string `json:"name"`
+	Output string `json:"output"`
+}
+
+type VolumeEvent struct {
+	Device string  `json:"device"`
+	Volume float64 `json:"volume"`
+}
+
+// CommandEvent reports what a command card did. Card is empty when a
+// sleep timer stops playback.
+type CommandEvent struct {
+	Card    string `json:"card"`
+	Command string `json:"command"`
+	Message string `json:"message"`
+}
+
+// CardEvent reports a card put into or taken out of the player. Name
+// is empty for cards that are not known.
+type CardEvent struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// CardsReloadedEvent lists the ids of the cards that changed when the
+// cards were changed from outside the player.
+type CardsReloadedEvent struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+// ErrorEvent reports a failure nobody asked for directly, such as a
+// card that could not be played.
+type ErrorEvent struct {
+	Source  string `json:"source"`
+	Message string `json:"message"`
+}
+
+// EventBus fans events out to every subscriber. A subscriber that
+// does not keep up loses events rather than blocking the publisher.
+type EventBus struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+func (b *EventBus) Publish(eventType string, data interface{}) {
+	if b == nil {
+		return
+	}
+	event := Event{Type: eventType, Time: time.Now(), Data: data}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			slog.Warn("event dropped", "type", eventType)
+		}
+	}
+}
+
+// Subscribe returns a channel of events and a function that ends the
+// subscription and closes the channel.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, EVENT_BUFFER_SIZE)
+	b.mutex.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mutex.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mutex.Lock()
+			delete(b.subscribers, ch)
+			b.mutex.Unlock()
+			close(ch)
+		})
+	}
+}
@@ -0,0 +1,379 @@
+package control
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/vkl/go-cast/api"
+	"github.com/vkl/go-cast/controllers"
+)
+
+const (
+	fakeCastNsConnection = "urn:x-cast:com.google.cast.tp.connection"
+	fakeCastNsHeartbeat  = "urn:x-cast:com.google.cast.tp.heartbeat"
+	fakeCastNsReceiver   = "urn:x-cast:com.google.cast.receiver"
+)
+
+// fakeCastMessage is a message the fake device received.
+type fakeCastMessage struct {
+	Namespace string
+	Type      string
+	Payload   map[string]interface{}
+}
+
+// fakeCast is a Cast device speaking CastV2 over TLS on localhost. It
+// implements the receiver and media namespaces well enough to launch
+// apps, load and queue media, control playback and change the volume,
+// and records every message it receives.
+type fakeCast struct {
+	t        *testing.T
+	listener net.Listener
+
+	mutex          sync.Mutex
+	conns          []*tls.Conn
+	messages       []fakeCastMessage
+	history        []fakeCastMessage
+	appId          string
+	sessions       int
+	mediaSessionId int
+	playerState    string
+	idleReason     string
+	queue          []string
+	index          int
+	volume         float64
+	// anonymous sends an empty display name in the receiver status.
+	// go-cast itself fails on a missing one.
+	anonymous bool
+}
+
+func newFakeCast(t *testing.T) *fakeCast {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake-cast"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeCast{t: t, listener: listener, volume: 0.5}
+	go f.serve()
+	t.Cleanup(f.close)
+	return f
+}
+
+// castInfo is the discovery entry for the fake device.
+func (f *fakeCast) castInfo(name string) Cast {
+	addr := f.listener.Addr().(*net.TCPAddr)
+	return Cast{
+		Name:   name,
+		IPAddr: addr.IP,
+		Port:   addr.Port,
+		Info:   map[string]string{"id": "uuid-" + name, "fn": name},
+		Kind:   KIND_CHROMECAST,
+	}
+}
+
+func (f *fakeCast) close() {
+	f.listener.Close()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeCast) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn.(*tls.Conn))
+	}
+}
+
+func (f *fakeCast) handle(conn *tls.Conn) {
+	defer conn.Close()
+	// reachability checks connect without a handshake
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	f.mutex.Lock()
+	f.conns = append(f.conns, conn)
+	f.mutex.Unlock()
+	var writeMutex sync.Mutex
+	for {
+		var length uint32
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			return
+		}
+		message := &api.CastMessage{}
+		if err := proto.Unmarshal(packet, message); err != nil {
+			f.t.Errorf("fake cast: %v", err)
+			return
+		}
+		payload := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(message.GetPayloadUtf8()), &payload); err != nil {
+			f.t.Errorf("fake cast: %v", err)
+			return
+		}
+		reply := f.receive(message.GetNamespace(), payload)
+		if reply == nil {
+			continue
+		}
+		if requestId, ok := payload["requestId"]; ok {
+			reply["requestId"] = requestId
+		}
+		// replies come from whoever the request went to
+		writeMutex.Lock()
+		err := f.send(conn, message.GetDestinationId(), message.GetSourceId(), message.GetNamespace(), reply)
+		writeMutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeCast) send(conn *tls.Conn, source, destination, namespace string, payload map[string]interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	message := &api.CastMessage{
+		ProtocolVersion: api.CastMessage_CASTV2_1_0.Enum(),
+		SourceId:        proto.String(source),
+		DestinationId:   proto.String(destination),
+		Namespace:       proto.String(namespace),
+		PayloadType:     api.CastMessage_STRING.Enum(),
+		PayloadUtf8:     proto.String(string(data)),
+	}
+	packet, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint32(len(packet))); err != nil {
+		return err
+	}
+	_, err = conn.Write(packet)
+	return err
+}
+
+// receive records a message and returns the reply, if any.
+func (f *fakeCast) receive(namespace string, payload map[string]interface{}) map[string]interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	messageType, _ := payload["type"].(string)
+	message := fakeCastMessage{Namespace: namespace, Type: messageType, Payload: payload}
+	f.messages = append(f.messages, message)
+	f.history = append(f.history, message)
+	switch namespace {
+	case fakeCastNsHeartbeat:
+		if messageType == "PING" {
+			return map[string]interface{}{"type": "PONG"}
+		}
+	case fakeCastNsReceiver:
+		switch messageType {
+		case "LAUNCH":
+			f.launch(payload["appId"].(string))
+		case "STOP":
+			f.appId = ""
+		case "SET_VOLUME":
+			volume := payload["volume"].(map[string]interface{})
+			if level, ok := volume["level"].(float64); ok {
+				f.volume = level
+			}
+		}
+		return f.receiverStatus()
+	case controllers.NamespaceMedia:
+		switch messageType {
+		case "LOAD":
+			media := payload["media"].(map[string]interface{})
+			f.mediaSessionId++
+			f.queue = []string{media["contentId"].(string)}
+			f.index = 0
+			f.playerState, f.idleReason = "PLAYING", ""
+		case "QUEUE_INSERT":
+			for _, item := range payload["items"].([]interface{}) {
+				media := item.(map[string]interface{})["media"].(map[string]interface{})
+				f.queue = append(f.queue, media["contentId"].(string))
+			}
+		case "QUEUE_NEXT":
+			if f.index+1 < len(f.queue) {
+				f.index++
+			}
+		case "QUEUE_PREV":
+			if f.index > 0 {
+				f.index--
+			}
+		case "PLAY":
+			f.playerState = "PLAYING"
+		case "PAUSE":
+			f.playerState = "PAUSED"
+		case "STOP":
+			f.playerState, f.idleReason = "IDLE", "CANCELLED"
+		}
+		return f.mediaStatus()
+	}
+	return nil
+}
+
+// launch starts an app, ending the media session of the one before.
+// Callers hold the mutex.
+func (f *fakeCast) launch(appId string) {
+	f.appId = appId
+	f.sessions++
+	f.queue = nil
+	f.playerState, f.idleReason = "", ""
+}
+
+func (f *fakeCast) transportId() string {
+	return fmt.Sprintf("transport-%d", f.sessions)
+}
+
+// receiverStatus returns RECEIVER_STATUS. Callers hold the mutex.
+func (f *fakeCast) receiverStatus() map[string]interface{} {
+	applications := make([]interface{}, 0)
+	if f.appId != "" {
+		statusText := "Ready To Cast"
+		if f.playerState == "PLAYING" || f.playerState == "PAUSED" {
+			statusText = "Now Casting"
+		}
+		application := map[string]interface{}{
+			"appId":       f.appId,
+			"displayName": "App " + f.appId,
+			"namespaces":  []interface{}{map[string]interface{}{"name": controllers.NamespaceMedia}},
+			"sessionId":   fmt.Sprintf("session-%d", f.sessions),
+			"statusText":  statusText,
+			"transportId": f.transportId(),
+		}
+		if f.anonymous {
+			application["displayName"] = ""
+		}
+		applications = append(applications, application)
+	}
+	return map[string]interface{}{
+		"type": "RECEIVER_STATUS",
+		"status": map[string]interface{}{
+			"applications": applications,
+			"volume":       map[string]interface{}{"level": f.volume, "muted": false},
+		},
+	}
+}
+
+// mediaStatus returns MEDIA_STATUS. Callers hold the mutex.
+func (f *fakeCast) mediaStatus() map[string]interface{} {
+	status := make([]interface{}, 0)
+	if len(f.queue) > 0 {
+		status = append(status, map[string]interface{}{
+			"mediaSessionId": f.mediaSessionId,
+			"playerState":    f.playerState,
+			"idleReason":     f.idleReason,
+			"currentTime":    0,
+			"media": map[string]interface{}{
+				"contentId": f.queue[f.index],
+				"metadata":  map[string]interface{}{"metadataType": 3},
+			},
+		})
+	}
+	return map[string]interface{}{"type": "MEDIA_STATUS", "status": status}
+}
+
+// takeOver plays something else, as another sender would.
+func (f *fakeCast) takeOver(appId string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.launch(appId)
+}
+
+// hangUp closes the virtual connection of every sender, as a device
+// does when it is going away, leaving the TLS connections open.
+func (f *fakeCast) hangUp() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, conn := range f.conns {
+		f.send(conn, "receiver-0", "sender-0", fakeCastNsConnection, map[string]interface{}{"type": "CLOSE"})
+	}
+}
+
+// finish ends the queue.
+func (f *fakeCast) finish() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.index = len(f.queue) - 1
+	f.playerState, f.idleReason = "IDLE", "FINISHED"
+}
+
+// received returns the types of the messages received in a namespace
+// since the last call, leaving out polling.
+func (f *fakeCast) received(namespace string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	types := make([]string, 0)
+	rest := make([]fakeCastMessage, 0)
+	for _, message := range f.messages {
+		switch {
+		case message.Namespace != namespace:
+			rest = append(rest, message)
+		case message.Type != "GET_STATUS":
+			types = append(types, message.Type)
+		}
+	}
+	f.messages = rest
+	return types
+}
+
+// last returns the payload of the last message of a type.
+func (f *fakeCast) last(messageType string) map[string]interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i := len(f.history) - 1; i >= 0; i-- {
+		if f.history[i].Type == messageType {
+			return f.history[i].Payload
+		}
+	}
+	return nil
+}
+
+// connections returns the number of TLS connections made so far.
+func (f *fakeCast) connections() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.conns)
+}
+
+func (f *fakeCast) state() (appId string, playerState string, queue []string, index int, volume float64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.appId, f.playerState, append([]string{}, f.queue...), f.index, f.volume
+}
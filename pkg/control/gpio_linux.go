@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+package control
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/warthog618/gpiod"
+)
+
+const (
+	OPT_SENSOR_PIN = 17
+	ENCODER_PIN0   = 22
+	ENCODER_PIN1   = 27
+	RFID_RESET_PIN = 26
+	BTN_PIN        = 5
+	RED_LED        = 19
+	GREEN_LED      = 13
+	BLUE_LED       = 6
+)
+
+// GpioHardware is the player wired to the GPIO header of a Raspberry Pi,
+// with the RFID reader on a serial port.
+type GpioHardware struct {
+	Chip       string
+	SerialPort string
+}
+
+func NewGpioHardware() *GpioHardware {
+	return &GpioHardware{Chip: "gpiochip0", SerialPort: "/dev/serial0"}
+}
+
+func gpioHandler(handler LineHandler) gpiod.EventHandler {
+	return func(e gpiod.LineEvent) {
+		event := LineEvent{Timestamp: e.Timestamp}
+		switch e.Type {
+		case gpiod.LineEventRisingEdge:
+			event.Type = LINE_EVENT_RISING_EDGE
+		case gpiod.LineEventFallingEdge:
+			event.Type = LINE_EVENT_FALLING_EDGE
+		}
+		handler(event)
+	}
+}
+
+func (g *GpioHardware) Open(optSensor, button LineHandler) (*PlayerHardware, error) {
+	chip, err := gpiod.NewChip(g.Chip)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("info", "lines", chip.Lines())
+
+	hardware := &PlayerHardware{Reader: NewRfidController(g.SerialPort)}
+
+	hardware.RfidReset, err = chip.RequestLine(
+		RFID_RESET_PIN,
+		gpiod.WithPullUp,
+		gpiod.AsOutput(0),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	hardware.OptSensor, err = chip.RequestLine(
+		OPT_SENSOR_PIN,
+		gpiod.WithPullUp,
+		gpiod.WithEventHandler(gpioHandler(optSensor)),
+		gpiod.WithBothEdges,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	hardware.Encoder, err = chip.RequestLines(
+		[]int{ENCODER_PIN0, ENCODER_PIN1},
+		gpiod.AsInput,
+		gpiod.WithPullUp,
+		gpiod.WithBothEdges,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = chip.RequestLine(
+		BTN_PIN,
+		gpiod.AsInput,
+		gpiod.WithBothEdges,
+		gpiod.WithEventHandler(gpioHandler(button)),
+		gpiod.LineBiasPullDown,
+		gpiod.WithDebounce(10*time.Millisecond),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	hardware.Leds, err = chip.RequestLines(
+		[]int{RED_LED, GREEN_LED, BLUE_LED},
+		gpiod.AsOutput(0, 1, 1),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return hardware, nil
+}
@@ -0,0 +1,182 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vkl/go-cast"
+)
+
+const CAST_GROUP_MODEL = "Google Cast Group"
+
+// GroupError reports the devices of an ad-hoc group a command failed
+// on. The command still went through on the others unless every
+// device failed.
+type GroupError struct {
+	Failed map[string]error
+	Total  int
+}
+
+func (e *GroupError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failures := make([]string, 0, len(names))
+	for _, name := range names {
+		failures = append(failures, fmt.Sprintf("%s: %v", name, e.Failed[name]))
+	}
+	return fmt.Sprintf("failed on %d of %d devices: %s",
+		len(e.Failed), e.Total, strings.Join(failures, "; "))
+}
+
+// Partial reports whether at least one device succeeded.
+func (e *GroupError) Partial() bool {
+	return len(e.Failed) < e.Total
+}
+
+func (e *GroupError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, err := range e.Failed {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// groupOutput plays a card on several devices at once, starting the
+// same queue on each and fanning out transport and volume commands.
+type groupOutput struct {
+	outputs []Output
+	missing []string
+	mutex   sync.Mutex
+	failed  map[string]error
+}
+
+func newGroupOutput(outputs []Output, missing []string) *groupOutput {
+	return &groupOutput{
+		outputs: outputs,
+		missing: missing,
+		failed:  make(map[string]error),
+	}
+}
+
+func (g *groupOutput) Name() string {
+	names := make([]string, 0, len(g.outputs))
+	for _, output := range g.outputs {
+		names = append(names, output.Name())
+	}
+	return strings.Join(names, " + ")
+}
+
+// each runs fn on every device concurrently and collects the failures,
+// counting devices that were never found as failed.
+func (g *groupOutput) each(fn func(output Output) error) error {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	failed := make(map[string]error)
+	for _, name := range g.missing {
+		failed[name] = ErrDeviceNotFound
+	}
+	for _, output := range g.outputs {
+		wg.Add(1)
+		go func(output Output) {
+			defer wg.Done()
+			if err := fn(output); err != nil {
+				mutex.Lock()
+				failed[output.Name()] = err
+				mutex.Unlock()
+			}
+		}(output)
+	}
+	wg.Wait()
+	g.mutex.Lock()
+	g.failed = failed
+	g.mutex.Unlock()
+	if len(failed) == 0 {
+		return nil
+	}
+	return &GroupError{Failed: failed, Total: len(g.outputs) + len(g.missing)}
+}
+
+func (g *groupOutput) PlayCard(ctx context.Context, card Card) error {
+	return g.each(func(output Output) error {
+		return output.PlayCard(ctx, card)
+	})
+}
+
+func (g *groupOutput) Control(ctx context.Context, payload ClientAction) error {
+	return g.each(func(output Output) error {
+		return output.Control(ctx, payload)
+	})
+}
+
+// GetVolume returns the volume of the first device that answers.
+func (g *groupOutput) GetVolume(ctx context.Context) (float64, error) {
+	var err error
+	for _, output := range g.outputs {
+		var volume float64
+		if volume, err = output.GetVolume(ctx); err == nil {
+			return volume, nil
+		}
+	}
+	return 0, err
+}
+
+func (g *groupOutput) Status() cast.DisplayStatus {
+	status := cast.DisplayStatus{Name: g.Name()}
+	g.mutex.Lock()
+	failed := g.failed
+	g.mutex.Unlock()
+	statuses := make([]string, 0, len(g.outputs))
+	for _, output := range g.outputs {
+		if err, ok := failed[output.Name()]; ok {
+			statuses = append(statuses, fmt.Sprintf("%s: failed (%v)", output.Name(), err))
+			continue
+		}
+		member := output.Status()
+		if status.MediaStatus == "" {
+			status.MediaStatus = member.MediaStatus
+			status.MediaData = member.MediaData
+			status.Volume = member.Volume
+		}
+		statuses = append(statuses, fmt.Sprintf("%s: %s", output.Name(), member.Status))
+	}
+	for _, name := range g.missing {
+		statuses = append(statuses, fmt.Sprintf("%s: not found", name))
+	}
+	status.Status = strings.Join(statuses, "; ")
+	return status
+}
+
+// without returns the group without the named Cast device, and the
+// member that was removed. The member is nil when the device is not in
+// the group, and the group is nil when no other device is left.
+func (g *groupOutput) without(name string) (*groupOutput, *chromecastOutput) {
+	var removed *chromecastOutput
+	outputs := make([]Output, 0, len(g.outputs))
+	for _, output := range g.outputs {
+		if member, ok := output.(*chromecastOutput); ok && removed == nil && member.castInfo.Name == name {
+			removed = member
+			continue
+		}
+		outputs = append(outputs, output)
+	}
+	if removed == nil || len(outputs) == 0 {
+		return nil, removed
+	}
+	return newGroupOutput(outputs, g.missing), removed
+}
+
+func (g *groupOutput) Close() error {
+	var err error
+	for _, output := range g.outputs {
+		if closeErr := output.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
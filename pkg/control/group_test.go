@@ -0,0 +1,129 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCardTargets(t *testing.T) {
+	card := Card{Chromecast: "Kitchen", Chromecasts: []string{"Bedroom", "Kitchen", ""}}
+	if targets := fmt.Sprint(card.Targets()); targets != "[Kitchen Bedroom]" {
+		t.Fatalf("unexpected targets: %s", targets)
+	}
+	if targets := (Card{}).Targets(); len(targets) != 0 {
+		t.Fatalf("unexpected targets: %v", targets)
+	}
+}
+
+func TestGroupOutput(t *testing.T) {
+	ctx := context.Background()
+	renderers := make([]*fakeRenderer, 2)
+	outputs := make([]Output, 0)
+	for i := range renderers {
+		renderers[i] = &fakeRenderer{state: "STOPPED", volume: 20}
+		srv := httptest.NewServer(renderers[i])
+		defer srv.Close()
+		castInfo, err := fetchRenderer(ctx, srv.URL+"/description.xml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		castInfo.Name = []string{"Kitchen", "Bedroom"}[i]
+		outputs = append(outputs, newOutput(castInfo, nil))
+	}
+	group := newGroupOutput(outputs, []string{"Attic"})
+	if group.Name() != "Kitchen + Bedroom" {
+		t.Fatalf("unexpected name: %s", group.Name())
+	}
+
+	card := Card{Id: "card1", MediaLinks: []MediaLink{{Link: "http://media/1.mp3"}}}
+	err := group.PlayCard(ctx, card)
+	var groupErr *GroupError
+	if !errors.As(err, &groupErr) || !groupErr.Partial() || groupErr.Total != 3 {
+		t.Fatalf("expected a partial group error, got %v", err)
+	}
+	if !errors.Is(err, ErrDeviceNotFound) || groupErr.Failed["Attic"] == nil {
+		t.Fatalf("expected Attic to be reported missing: %v", err)
+	}
+	for _, renderer := range renderers {
+		if actions, _ := renderer.takeActions(); strings.Join(actions, ",") != "SetAVTransportURI,Play" {
+			t.Fatalf("unexpected actions: %v", actions)
+		}
+	}
+
+	if err := group.Control(ctx, ClientAction{Action: "setvolume", Volume: 0.5}); !errors.As(err, &groupErr) {
+		t.Fatalf("expected a group error, got %v", err)
+	}
+	for _, renderer := range renderers {
+		if renderer.volume != 50 {
+			t.Fatalf("volume was not fanned out: %d", renderer.volume)
+		}
+	}
+	if volume, err := group.GetVolume(ctx); err != nil || volume != 0.5 {
+		t.Fatalf("unexpected volume: %v %v", volume, err)
+	}
+
+	// one of the renderers goes away
+	group.outputs[1].(*dlnaOutput).avTransport = "http://127.0.0.1:1/control"
+	err = group.Control(ctx, ClientAction{Action: "pause"})
+	if !errors.As(err, &groupErr) || !groupErr.Partial() || groupErr.Failed["Bedroom"] == nil {
+		t.Fatalf("expected Bedroom to fail, got %v", err)
+	}
+	status := group.Status()
+	if status.MediaStatus != "PAUSED" ||
+		!strings.Contains(status.Status, "Bedroom: failed") ||
+		!strings.Contains(status.Status, "Attic: not found") {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+// closingOutput records whether it was closed.
+type closingOutput struct {
+	Output
+	name   string
+	closed bool
+}
+
+func (o *closingOutput) Name() string { return o.name }
+
+func (o *closingOutput) Close() error {
+	o.closed = true
+	return nil
+}
+
+func TestCloseUnused(t *testing.T) {
+	t.Setenv("RFIDPLAYER_FAKE_MPV", "1")
+	castInfo := LocalCast()
+	castInfo.Info["player"] = os.Args[0] + " -test.run=^TestFakeMpv$ --"
+	castInfo.Info["socket"] = filepath.Join(t.TempDir(), "mpv.sock")
+	local := newOutput(castInfo, nil).(*localOutput)
+	defer local.Close()
+	card := Card{Id: "card1", MediaLinks: []MediaLink{{Link: "/music/1.mp3"}}}
+	if err := local.PlayCard(context.Background(), card); err != nil {
+		t.Fatal(err)
+	}
+
+	kitchen := &closingOutput{name: "Kitchen"}
+	bedroom := &closingOutput{name: "Bedroom"}
+	previous := newGroupOutput([]Output{local, kitchen, bedroom}, nil)
+	// the group is rebuilt with a new output for Kitchen
+	output := newGroupOutput([]Output{newOutput(castInfo, nil), &closingOutput{name: "Kitchen"}}, nil)
+	closeUnused(previous, output)
+	if kitchen.closed || !bedroom.closed {
+		t.Fatalf("unexpected outputs closed: kitchen %v, bedroom %v", kitchen.closed, bedroom.closed)
+	}
+	if !local.running() {
+		t.Fatal("the local player was closed")
+	}
+
+	// nor is it closed when the next card plays elsewhere
+	closeUnused(local, kitchen)
+	if !local.running() {
+		t.Fatal("the local player was closed")
+	}
+}
@@ -0,0 +1,62 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type LineEventType int
+
+const (
+	LINE_EVENT_RISING_EDGE LineEventType = iota + 1
+	LINE_EVENT_FALLING_EDGE
+)
+
+// LineEvent is an edge on an input line. Timestamps are only meaningful
+// relative to each other.
+type LineEvent struct {
+	Type      LineEventType
+	Timestamp time.Duration
+}
+
+type LineHandler func(LineEvent)
+
+// Line is a single GPIO line.
+type Line interface {
+	Value() (int, error)
+	SetValue(value int) error
+}
+
+// Lines is a group of GPIO lines read and written together.
+type Lines interface {
+	Values(values []int) error
+	SetValues(values []int) error
+}
+
+type RfidCardId []byte
+
+func (rId RfidCardId) Repr() string {
+	return fmt.Sprintf("%x", rId)
+}
+
+// CardReader reads the id of the card in the slot.
+type CardReader interface {
+	ReadCardId(ctx context.Context) (RfidCardId, error)
+}
+
+// PlayerHardware is what the player is wired to. The LEDs are red,
+// green and blue and light up at 0.
+type PlayerHardware struct {
+	OptSensor Line
+	RfidReset Line
+	Encoder   Lines
+	Leds      Lines
+	Reader    CardReader
+}
+
+// Hardware requests the lines of the player. Edges of the card slot
+// sensor and of the button go to the handlers, one at a time.
+type Hardware interface {
+	Open(optSensor, button LineHandler) (*PlayerHardware, error)
+}
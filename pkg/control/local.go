@@ -0,0 +1,349 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vkl/go-cast"
+	_ "github.com/vkl/rfidplayer/pkg/logging"
+)
+
+const (
+	LOCAL_OUTPUT_NAME      = "Local speaker"
+	LOCAL_PLAYER           = "mpv"
+	LOCAL_START_TIMEOUT    = 5 * time.Second
+	LOCAL_REQUEST_TIMEOUT  = 2 * time.Second
+	LOCAL_SOCKET_FILE_NAME = "rfidplayer-mpv.sock"
+)
+
+// LocalOutputAvailable reports whether the local player binary is
+// installed.
+func LocalOutputAvailable() bool {
+	_, err := exec.LookPath(LOCAL_PLAYER)
+	return err == nil
+}
+
+// LocalCast is the device entry cards use to play on the local
+// speaker.
+func LocalCast() Cast {
+	return Cast{
+		Name:   LOCAL_OUTPUT_NAME,
+		IPAddr: net.IPv4(127, 0, 0, 1),
+		Kind:   KIND_LOCAL,
+		Online: true,
+		Info: map[string]string{
+			"fn":     LOCAL_OUTPUT_NAME,
+			"player": LOCAL_PLAYER,
+			"socket": filepath.Join(os.TempDir(), LOCAL_SOCKET_FILE_NAME),
+		},
+	}
+}
+
+type mpvRequest struct {
+	Command   []interface{} `json:"command"`
+	RequestId int           `json:"request_id"`
+}
+
+type mpvResponse struct {
+	Data      json.RawMessage `json:"data"`
+	Error     string          `json:"error"`
+	RequestId int             `json:"request_id"`
+	Event     string          `json:"event"`
+}
+
+// localOutputs are the local outputs by IPC socket, so that one mpv
+// process plays card after card.
+var localOutputs = struct {
+	sync.Mutex
+	outputs map[string]*localOutput
+}{outputs: make(map[string]*localOutput)}
+
+// localOutput plays cards on the box itself through an mpv process it
+// supervises, talking to it over the JSON IPC socket.
+type localOutput struct {
+	name       string
+	player     []string
+	socketPath string
+	mutex      sync.Mutex
+	cmd        *exec.Cmd
+	exited     chan struct{}
+	conn       net.Conn
+	reader     *bufio.Reader
+	requestId  int
+}
+
+// newLocalOutput returns the output playing through the device's
+// socket, creating it on first use. A changed player command is used
+// the next time the player starts.
+func newLocalOutput(castInfo Cast) *localOutput {
+	player := strings.Fields(castInfo.Info["player"])
+	if len(player) == 0 {
+		player = []string{LOCAL_PLAYER}
+	}
+	socketPath := castInfo.Info["socket"]
+	if socketPath == "" {
+		socketPath = filepath.Join(os.TempDir(), LOCAL_SOCKET_FILE_NAME)
+	}
+	localOutputs.Lock()
+	defer localOutputs.Unlock()
+	if output, ok := localOutputs.outputs[socketPath]; ok {
+		output.mutex.Lock()
+		output.player = player
+		output.mutex.Unlock()
+		return output
+	}
+	output := &localOutput{
+		name:       castInfo.Name,
+		player:     player,
+		socketPath: socketPath,
+	}
+	localOutputs.outputs[socketPath] = output
+	return output
+}
+
+func (o *localOutput) Name() string {
+	return o.name
+}
+
+func (o *localOutput) String() string {
+	return fmt.Sprintf("%s - %s", o.name, strings.Join(o.player, " "))
+}
+
+func (o *localOutput) running() bool {
+	if o.cmd == nil {
+		return false
+	}
+	select {
+	case <-o.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// start connects to the player's IPC socket, launching the player
+// first if it is not running and launch is set. Callers hold the
+// mutex.
+func (o *localOutput) start(ctx context.Context, launch bool) error {
+	if o.running() && o.conn != nil {
+		return nil
+	}
+	o.disconnect()
+	if !o.running() {
+		if !launch {
+			return ErrNoActiveSession
+		}
+		os.Remove(o.socketPath)
+		args := append([]string{}, o.player[1:]...)
+		args = append(args,
+			"--idle=yes",
+			"--no-video",
+			"--no-terminal",
+			"--input-ipc-server="+o.socketPath,
+		)
+		cmd := exec.Command(o.player[0], args...)
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("%w: %v", ErrConnectFailed, err)
+		}
+		exited := make(chan struct{})
+		go func() {
+			if err := cmd.Wait(); err != nil {
+				slog.Warn("local player exited", "error", err)
+			}
+			close(exited)
+		}()
+		o.cmd, o.exited = cmd, exited
+		slog.Info("local player started", "pid", cmd.Process.Pid)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, LOCAL_START_TIMEOUT)
+	defer cancel()
+	for {
+		conn, err := net.Dial("unix", o.socketPath)
+		if err == nil {
+			o.conn = conn
+			o.reader = bufio.NewReader(conn)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ErrConnectFailed, err)
+		case <-o.exited:
+			return fmt.Errorf("%w: local player exited", ErrConnectFailed)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (o *localOutput) disconnect() {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+		o.reader = nil
+	}
+}
+
+// command sends one IPC command and waits for its reply, skipping the
+// asynchronous events the player writes to the same socket. The player
+// is launched if it is not running.
+func (o *localOutput) command(ctx context.Context, args ...interface{}) (json.RawMessage, error) {
+	return o.request(ctx, true, args...)
+}
+
+func (o *localOutput) request(ctx context.Context, launch bool, args ...interface{}) (json.RawMessage, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if err := o.start(ctx, launch); err != nil {
+		return nil, err
+	}
+	o.requestId++
+	request, err := json.Marshal(mpvRequest{Command: args, RequestId: o.requestId})
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(LOCAL_REQUEST_TIMEOUT)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	o.conn.SetDeadline(deadline)
+	if _, err := o.conn.Write(append(request, '\n')); err != nil {
+		o.disconnect()
+		return nil, fmt.Errorf("%w: %v", ErrConnectFailed, err)
+	}
+	for {
+		line, err := o.reader.ReadBytes('\n')
+		if err != nil {
+			o.disconnect()
+			return nil, fmt.Errorf("%w: %v", ErrConnectFailed, err)
+		}
+		response := mpvResponse{}
+		if err := json.Unmarshal(line, &response); err != nil {
+			return nil, err
+		}
+		if response.Event != "" || response.RequestId != o.requestId {
+			continue
+		}
+		if response.Error != "success" {
+			return nil, fmt.Errorf("%v: %s", args[0], response.Error)
+		}
+		return response.Data, nil
+	}
+}
+
+// getProperty reads a property of the player. It does not launch the
+// player, failing with ErrNoActiveSession when it is not running.
+func (o *localOutput) getProperty(ctx context.Context, name string, value interface{}) error {
+	data, err := o.request(ctx, false, "get_property", name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+func (o *localOutput) PlayCard(ctx context.Context, card Card) error {
+	for i, link := range card.MediaLinks {
+		mode := "append"
+		if i == 0 {
+			mode = "replace"
+		}
+		if _, err := o.command(ctx, "loadfile", link.Link, mode); err != nil {
+			return err
+		}
+	}
+	if len(card.MediaLinks) == 0 {
+		_, err := o.command(ctx, "stop")
+		return err
+	}
+	_, err := o.command(ctx, "set_property", "pause", false)
+	return err
+}
+
+func (o *localOutput) Control(ctx context.Context, payload ClientAction) error {
+	var err error
+	switch payload.Action {
+	case "stop":
+		_, err = o.command(ctx, "stop")
+	case "pause":
+		_, err = o.command(ctx, "set_property", "pause", true)
+	case "play":
+		_, err = o.command(ctx, "set_property", "pause", false)
+	case "next":
+		_, err = o.command(ctx, "playlist-next")
+	case "prev":
+		_, err = o.command(ctx, "playlist-prev")
+	case "setvolume":
+		_, err = o.command(ctx, "set_property", "volume", payload.Volume*100)
+	default:
+		err = fmt.Errorf("%w: %s", ErrInvalidAction, payload.Action)
+	}
+	return err
+}
+
+func (o *localOutput) GetVolume(ctx context.Context) (float64, error) {
+	var volume float64
+	if err := o.getProperty(ctx, "volume", &volume); err != nil {
+		return 0, err
+	}
+	return volume / 100, nil
+}
+
+func (o *localOutput) Status() cast.DisplayStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), LOCAL_REQUEST_TIMEOUT)
+	defer cancel()
+	status := cast.DisplayStatus{Name: o.name, Status: LOCAL_PLAYER}
+	var idle, pause bool
+	err := o.getProperty(ctx, "idle-active", &idle)
+	if errors.Is(err, ErrNoActiveSession) {
+		status.MediaStatus = "IDLE"
+		return status
+	}
+	if err != nil {
+		slog.Error("local status", "error", err)
+		return status
+	}
+	o.getProperty(ctx, "pause", &pause)
+	switch {
+	case idle:
+		status.MediaStatus = "IDLE"
+	case pause:
+		status.MediaStatus = "PAUSED"
+	default:
+		status.MediaStatus = "PLAYING"
+		o.getProperty(ctx, "media-title", &status.MediaData)
+	}
+	status.Volume, _ = o.GetVolume(ctx)
+	return status
+}
+
+// Close asks the player to quit and kills it if it does not.
+func (o *localOutput) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if !o.running() {
+		return nil
+	}
+	if o.conn != nil {
+		request, _ := json.Marshal(mpvRequest{Command: []interface{}{"quit"}})
+		o.conn.Write(append(request, '\n'))
+	}
+	o.disconnect()
+	select {
+	case <-o.exited:
+	case <-time.After(LOCAL_REQUEST_TIMEOUT):
+		o.cmd.Process.Kill()
+		<-o.exited
+	}
+	os.Remove(o.socketPath)
+	return nil
+}
@@ -0,0 +1,171 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFakeMpv is not a real test: the local output tests run the test
+// binary itself as the player with RFIDPLAYER_FAKE_MPV set, and it then
+// serves a tiny subset of the mpv JSON IPC protocol.
+func TestFakeMpv(t *testing.T) {
+	if os.Getenv("RFIDPLAYER_FAKE_MPV") != "1" {
+		t.Skip("helper process")
+	}
+	var socketPath string
+	for _, arg := range os.Args {
+		if strings.HasPrefix(arg, "--input-ipc-server=") {
+			socketPath = strings.TrimPrefix(arg, "--input-ipc-server=")
+		}
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.Exit(2)
+	}
+	playlist := []string{}
+	pos, pause, volume := -1, false, 100.0
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			os.Exit(2)
+		}
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			request := struct {
+				Command   []interface{} `json:"command"`
+				RequestId int           `json:"request_id"`
+			}{}
+			json.Unmarshal(scanner.Bytes(), &request)
+			var data interface{}
+			result := "success"
+			switch request.Command[0] {
+			case "loadfile":
+				if request.Command[2] == "replace" {
+					playlist, pos = nil, 0
+				}
+				playlist = append(playlist, request.Command[1].(string))
+			case "stop":
+				playlist, pos = nil, -1
+			case "playlist-next":
+				if pos+1 >= len(playlist) {
+					result = "error running command"
+				} else {
+					pos++
+				}
+			case "playlist-prev":
+				if pos <= 0 {
+					result = "error running command"
+				} else {
+					pos--
+				}
+			case "set_property":
+				switch request.Command[1] {
+				case "pause":
+					pause = request.Command[2].(bool)
+				case "volume":
+					volume = request.Command[2].(float64)
+				}
+			case "get_property":
+				switch request.Command[1] {
+				case "pause":
+					data = pause
+				case "volume":
+					data = volume
+				case "idle-active":
+					data = pos < 0
+				case "media-title":
+					data = playlist[pos]
+				case "playlist-pos":
+					data = pos
+				}
+			case "quit":
+				os.Exit(0)
+			}
+			conn.Write([]byte("{\"event\":\"property-change\"}\n"))
+			response, _ := json.Marshal(map[string]interface{}{
+				"data": data, "error": result, "request_id": request.RequestId,
+			})
+			conn.Write(append(response, '\n'))
+		}
+		conn.Close()
+	}
+}
+
+func TestLocalOutput(t *testing.T) {
+	t.Setenv("RFIDPLAYER_FAKE_MPV", "1")
+	castInfo := LocalCast()
+	castInfo.Info["player"] = os.Args[0] + " -test.run=^TestFakeMpv$ --"
+	castInfo.Info["socket"] = filepath.Join(t.TempDir(), "mpv.sock")
+	output, ok := newOutput(castInfo, nil).(*localOutput)
+	if !ok {
+		t.Fatal("expected a local output")
+	}
+	defer output.Close()
+	ctx := context.Background()
+
+	if status := output.Status(); status.MediaStatus != "IDLE" || output.running() {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	card := Card{
+		Id: "card1",
+		MediaLinks: []MediaLink{
+			{Link: "/music/1.mp3"},
+			{Link: "/music/2.mp3"},
+		},
+	}
+	if err := output.PlayCard(ctx, card); err != nil {
+		t.Fatal(err)
+	}
+	if status := output.Status(); status.MediaStatus != "PLAYING" || status.MediaData != "/music/1.mp3" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if err := output.Control(ctx, ClientAction{Action: "next"}); err != nil {
+		t.Fatal(err)
+	}
+	var pos int
+	if err := output.getProperty(ctx, "playlist-pos", &pos); err != nil || pos != 1 {
+		t.Fatalf("unexpected playlist position: %d %v", pos, err)
+	}
+	if err := output.Control(ctx, ClientAction{Action: "next"}); err == nil {
+		t.Fatal("expected error at the end of the playlist")
+	}
+	if err := output.Control(ctx, ClientAction{Action: "pause"}); err != nil {
+		t.Fatal(err)
+	}
+	if status := output.Status(); status.MediaStatus != "PAUSED" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if err := output.Control(ctx, ClientAction{Action: "setvolume", Volume: 0.35}); err != nil {
+		t.Fatal(err)
+	}
+	if volume, err := output.GetVolume(ctx); err != nil || volume != 0.35 {
+		t.Fatalf("unexpected volume: %v %v", volume, err)
+	}
+
+	// the player is restarted when it dies
+	output.cmd.Process.Kill()
+	<-output.exited
+	if err := output.PlayCard(ctx, card); err != nil {
+		t.Fatal(err)
+	}
+	if status := output.Status(); status.MediaStatus != "PLAYING" {
+		t.Fatalf("unexpected status after restart: %+v", status)
+	}
+
+	// the next card plays on the same player
+	if newOutput(castInfo, nil) != Output(output) {
+		t.Fatal("expected the local output to be shared")
+	}
+
+	// polling the status does not bring a closed player back
+	output.Close()
+	if status := output.Status(); status.MediaStatus != "IDLE" || output.running() {
+		t.Fatalf("unexpected status after close: %+v", status)
+	}
+}
@@ -0,0 +1,445 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/vkl/go-cast"
+	_ "github.com/vkl/rfidplayer/pkg/logging"
+)
+
+const (
+	MPD_SERVICE         = "_mpd._tcp"
+	MPD_DEFAULT_PORT    = 6600
+	MPD_REQUEST_TIMEOUT = 5 * time.Second
+	MPD_RETRY_DELAY     = 1 * time.Second
+)
+
+// SearchMpd looks up MPD servers announced over zeroconf until ctx is
+// done and sends every one it finds to found.
+func SearchMpd(ctx context.Context, interval time.Duration, found chan<- Cast) error {
+	entries := make(chan *mdns.ServiceEntry, 10)
+	go func() {
+		for entry := range entries {
+			name := strings.Split(entry.Name, "."+MPD_SERVICE)[0]
+			name = strings.ReplaceAll(name, `\ `, " ")
+			mpd := Cast{
+				Name:   name,
+				IPAddr: entry.AddrV4,
+				Port:   entry.Port,
+				Kind:   KIND_MPD,
+				Info: map[string]string{
+					"fn": name,
+				},
+			}
+			select {
+			case found <- mpd:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	defer close(entries)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := mdns.Query(&mdns.QueryParam{
+			Service:     MPD_SERVICE,
+			Domain:      "local",
+			Timeout:     interval / 2,
+			Entries:     entries,
+			DisableIPv6: true,
+		})
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// mpdError is an ACK response from the server.
+type mpdError struct {
+	Command string
+	Message string
+}
+
+func (e *mpdError) Error() string {
+	return fmt.Sprintf("mpd %s: %s", e.Command, e.Message)
+}
+
+type mpdConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialMpd(ctx context.Context, address string, password string) (*mpdConn, error) {
+	dialer := net.Dialer{Timeout: MPD_REQUEST_TIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	c := &mpdConn{conn: conn, reader: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(MPD_REQUEST_TIMEOUT))
+	greeting, err := c.reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "OK MPD ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected mpd greeting: %q", greeting)
+	}
+	if password != "" {
+		if _, err := c.command(time.Now().Add(MPD_REQUEST_TIMEOUT), "password", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func mpdQuote(arg string) string {
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	arg = strings.ReplaceAll(arg, `"`, `\"`)
+	return `"` + arg + `"`
+}
+
+func mpdCommandLine(name string, args ...string) string {
+	line := name
+	for _, arg := range args {
+		line += " " + mpdQuote(arg)
+	}
+	return line + "\n"
+}
+
+// command sends one command and reads its "key: value" response lines
+// up to the closing OK.
+func (c *mpdConn) command(deadline time.Time, name string, args ...string) (map[string]string, error) {
+	c.conn.SetDeadline(deadline)
+	if _, err := c.conn.Write([]byte(mpdCommandLine(name, args...))); err != nil {
+		return nil, err
+	}
+	return c.response(name)
+}
+
+// commandList sends the commands as one command list. The server runs
+// them in order and stops at the first that fails, whose ACK is
+// returned.
+func (c *mpdConn) commandList(deadline time.Time, commands [][]string) error {
+	request := "command_list_ok_begin\n"
+	for _, command := range commands {
+		request += mpdCommandLine(command[0], command[1:]...)
+	}
+	request += "command_list_end\n"
+	c.conn.SetDeadline(deadline)
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		return err
+	}
+	_, err := c.response("command_list")
+	return err
+}
+
+// response reads the "key: value" lines of a response up to the
+// closing OK, skipping the list_OK that end each command of a list.
+func (c *mpdConn) response(name string) (map[string]string, error) {
+	values := make(map[string]string)
+	for {
+		response, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		response = strings.TrimSuffix(response, "\n")
+		switch {
+		case response == "OK":
+			return values, nil
+		case response == "list_OK":
+		case strings.HasPrefix(response, "ACK "):
+			message := response
+			if i := strings.Index(response, "} "); i >= 0 {
+				message = response[i+2:]
+			}
+			// the ACK names the command that failed: {add}
+			if i, j := strings.Index(response, "{"), strings.Index(response, "}"); i >= 0 && j > i+1 {
+				name = response[i+1 : j]
+			}
+			return nil, &mpdError{Command: name, Message: message}
+		default:
+			if key, value, ok := strings.Cut(response, ": "); ok {
+				if _, exists := values[key]; !exists {
+					values[key] = value
+				}
+			}
+		}
+	}
+}
+
+func (c *mpdConn) Close() error {
+	return c.conn.Close()
+}
+
+// mpdOutput plays cards on a Music Player Daemon. Media links are
+// passed to MPD as they are, so they may be library paths as well as
+// stream URLs. The player status is followed with the idle command on a
+// second connection.
+type mpdOutput struct {
+	name     string
+	address  string
+	password string
+	mutex    sync.Mutex
+	conn     *mpdConn
+	watching bool
+	cancel   context.CancelFunc
+	status   cast.DisplayStatus
+}
+
+func newMpdOutput(castInfo Cast) *mpdOutput {
+	return &mpdOutput{
+		name:     castInfo.Name,
+		address:  mpdAddress(castInfo),
+		password: castInfo.Info["password"],
+		status:   cast.DisplayStatus{Name: castInfo.Name},
+	}
+}
+
+func mpdAddress(castInfo Cast) string {
+	port := castInfo.Port
+	if port == 0 {
+		port = MPD_DEFAULT_PORT
+	}
+	return net.JoinHostPort(castInfo.IPAddr.String(), strconv.Itoa(port))
+}
+
+// missingMpdMedia returns the paths an MPD device has neither a song
+// nor a directory for in its music library.
+func missingMpdMedia(ctx context.Context, castInfo Cast, paths []string) ([]string, error) {
+	conn, err := dialMpd(ctx, mpdAddress(castInfo), castInfo.Info["password"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConnectFailed, err)
+	}
+	defer conn.Close()
+	missing := make([]string, 0)
+	for _, path := range paths {
+		_, err := conn.command(time.Now().Add(MPD_REQUEST_TIMEOUT), "lsinfo", path)
+		var ackErr *mpdError
+		switch {
+		case errors.As(err, &ackErr):
+			missing = append(missing, path)
+		case err != nil:
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+func (o *mpdOutput) Name() string {
+	return o.name
+}
+
+func (o *mpdOutput) String() string {
+	return fmt.Sprintf("%s - %s", o.name, o.address)
+}
+
+// command runs a command on the shared connection.
+func (o *mpdOutput) command(ctx context.Context, name string, args ...string) (map[string]string, error) {
+	var values map[string]string
+	err := o.do(ctx, func(conn *mpdConn, deadline time.Time) (err error) {
+		values, err = conn.command(deadline, name, args...)
+		return err
+	})
+	return values, err
+}
+
+// do runs fn on the shared connection, redialing once if the server
+// has dropped it in the meantime.
+func (o *mpdOutput) do(ctx context.Context, fn func(conn *mpdConn, deadline time.Time) error) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if !o.watching {
+		o.watch()
+	}
+	deadline := time.Now().Add(MPD_REQUEST_TIMEOUT)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	for attempt := 0; ; attempt++ {
+		if o.conn == nil {
+			conn, err := dialMpd(ctx, o.address, o.password)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrConnectFailed, err)
+			}
+			o.conn = conn
+		}
+		err := fn(o.conn, deadline)
+		var ackErr *mpdError
+		if err == nil || errors.As(err, &ackErr) {
+			return err
+		}
+		o.conn.Close()
+		o.conn = nil
+		if attempt > 0 {
+			return fmt.Errorf("%w: %v", ErrConnectFailed, err)
+		}
+	}
+}
+
+// watch starts following the player state. Callers hold the mutex.
+func (o *mpdOutput) watch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	o.cancel = cancel
+	o.watching = true
+	go func() {
+		for {
+			if err := o.idleLoop(ctx); err != nil && ctx.Err() == nil {
+				slog.Warn("mpd idle", "error", err, "output", o.name)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(MPD_RETRY_DELAY):
+			}
+		}
+	}()
+}
+
+func (o *mpdOutput) idleLoop(ctx context.Context) error {
+	conn, err := dialMpd(ctx, o.address, o.password)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+	for {
+		if err := o.refreshStatus(conn); err != nil {
+			return err
+		}
+		if _, err := conn.command(time.Time{}, "idle", "player", "mixer", "playlist"); err != nil {
+			return err
+		}
+	}
+}
+
+func (o *mpdOutput) refreshStatus(conn *mpdConn) error {
+	deadline := time.Now().Add(MPD_REQUEST_TIMEOUT)
+	values, err := conn.command(deadline, "status")
+	if err != nil {
+		return err
+	}
+	song, err := conn.command(deadline, "currentsong")
+	if err != nil {
+		return err
+	}
+	status := cast.DisplayStatus{Name: o.name, Status: "MPD"}
+	switch values["state"] {
+	case "play":
+		status.MediaStatus = "PLAYING"
+	case "pause":
+		status.MediaStatus = "PAUSED"
+	default:
+		status.MediaStatus = "IDLE"
+	}
+	switch {
+	case song["Title"] != "":
+		status.MediaData = fmt.Sprintf("%s : %s", song["Artist"], song["Title"])
+	default:
+		status.MediaData = song["file"]
+	}
+	if volume, err := strconv.Atoi(values["volume"]); err == nil && volume >= 0 {
+		status.Volume = float64(volume) / 100
+	}
+	o.mutex.Lock()
+	o.status = status
+	o.mutex.Unlock()
+	return nil
+}
+
+// PlayCard replaces the queue with the card's links in one command
+// list. MPD stops at a link it cannot add, so the queue is then cleared
+// rather than left with part of the card.
+func (o *mpdOutput) PlayCard(ctx context.Context, card Card) error {
+	commands := [][]string{{"clear"}}
+	for _, link := range card.MediaLinks {
+		commands = append(commands, []string{"add", link.Link})
+	}
+	if len(card.MediaLinks) > 0 {
+		commands = append(commands, []string{"play", "0"})
+	}
+	err := o.do(ctx, func(conn *mpdConn, deadline time.Time) error {
+		return conn.commandList(deadline, commands)
+	})
+	var ackErr *mpdError
+	if errors.As(err, &ackErr) && ackErr.Command == "add" {
+		if _, clearErr := o.command(ctx, "clear"); clearErr != nil {
+			slog.Warn("mpd clear", "error", clearErr, "output", o.name)
+		}
+	}
+	return err
+}
+
+func (o *mpdOutput) Control(ctx context.Context, payload ClientAction) error {
+	var err error
+	switch payload.Action {
+	case "stop":
+		_, err = o.command(ctx, "stop")
+	case "pause":
+		_, err = o.command(ctx, "pause", "1")
+	case "play":
+		// resumes when paused and starts the queue when stopped
+		_, err = o.command(ctx, "play")
+	case "next":
+		_, err = o.command(ctx, "next")
+	case "prev":
+		_, err = o.command(ctx, "previous")
+	case "setvolume":
+		_, err = o.command(ctx, "setvol", strconv.Itoa(int(payload.Volume*100+0.5)))
+	default:
+		err = fmt.Errorf("%w: %s", ErrInvalidAction, payload.Action)
+	}
+	return err
+}
+
+func (o *mpdOutput) GetVolume(ctx context.Context) (float64, error) {
+	values, err := o.command(ctx, "status")
+	if err != nil {
+		return 0, err
+	}
+	volume, err := strconv.Atoi(values["volume"])
+	if err != nil || volume < 0 {
+		return 0, fmt.Errorf("%s has no mixer", o.name)
+	}
+	return float64(volume) / 100, nil
+}
+
+func (o *mpdOutput) Status() cast.DisplayStatus {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.status
+}
+
+func (o *mpdOutput) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.cancel != nil {
+		o.cancel()
+		o.cancel = nil
+	}
+	o.watching = false
+	if o.conn != nil {
+		err := o.conn.Close()
+		o.conn = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMpd serves enough of the MPD protocol for mpdOutput, logging
+// every command it receives on the main connection.
+type fakeMpd struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	commands []string
+	playlist []string
+	pos      int
+	state    string
+	volume   int
+	version  int
+	changed  chan struct{}
+}
+
+func newFakeMpd(t *testing.T) *fakeMpd {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeMpd{
+		listener: listener,
+		state:    "stop",
+		volume:   50,
+		changed:  make(chan struct{}),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return f
+}
+
+func (f *fakeMpd) notify() {
+	f.version++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeMpd) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprint(conn, "OK MPD 0.23.5\n")
+	// like MPD, idle reports changes made since the previous idle
+	seen := 0
+	var list []string
+	inList := false
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "command_list_ok_begin":
+			list, inList = nil, true
+			continue
+		case line == "command_list_end":
+			inList = false
+			response := "OK\n"
+			for i, command := range list {
+				result := f.execute(command, i)
+				if strings.HasPrefix(result, "ACK") {
+					response = result
+					break
+				}
+				fmt.Fprint(conn, result+"list_OK\n")
+			}
+			fmt.Fprint(conn, response)
+			continue
+		case inList:
+			list = append(list, line)
+			continue
+		case line == "idle" || strings.HasPrefix(line, "idle "):
+			f.mutex.Lock()
+			for f.version == seen {
+				changed := f.changed
+				f.mutex.Unlock()
+				<-changed
+				f.mutex.Lock()
+			}
+			seen = f.version
+			f.mutex.Unlock()
+			fmt.Fprint(conn, "changed: player\nOK\n")
+			continue
+		}
+		response := f.execute(line, 0)
+		if !strings.HasPrefix(response, "ACK") {
+			response += "OK\n"
+		}
+		fmt.Fprint(conn, response)
+	}
+}
+
+// execute runs one command, the index-th of its command list, and
+// returns its response without the closing OK.
+func (f *fakeMpd) execute(line string, index int) string {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.Trim(arg, `"`)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	response := ""
+	switch name {
+	case "status":
+		return fmt.Sprintf("volume: %d\nstate: %s\n", f.volume, f.state)
+	case "currentsong":
+		if f.state != "stop" {
+			response = fmt.Sprintf("file: %s\n", f.playlist[f.pos])
+		}
+		return response
+	case "lsinfo":
+		if strings.Contains(arg, "missing") {
+			return fmt.Sprintf("ACK [50@%d] {lsinfo} No such directory\n", index)
+		}
+		return fmt.Sprintf("file: %s\n", arg)
+	}
+	f.commands = append(f.commands, line)
+	switch name {
+	case "clear":
+		f.playlist, f.pos, f.state = nil, 0, "stop"
+	case "add":
+		if strings.Contains(arg, "missing") {
+			response = fmt.Sprintf("ACK [50@%d] {add} No such directory\n", index)
+		} else {
+			f.playlist = append(f.playlist, arg)
+		}
+	case "play":
+		if arg != "" {
+			f.pos, _ = strconv.Atoi(arg)
+		}
+		f.state = "play"
+	case "pause":
+		if arg == "1" {
+			f.state = "pause"
+		} else {
+			f.state = "play"
+		}
+	case "stop":
+		f.state = "stop"
+	case "next":
+		if f.pos+1 >= len(f.playlist) {
+			response = fmt.Sprintf("ACK [55@%d] {next} Not playing\n", index)
+		} else {
+			f.pos++
+		}
+	case "previous":
+		if f.pos > 0 {
+			f.pos--
+		}
+	case "setvol":
+		f.volume, _ = strconv.Atoi(arg)
+	}
+	f.notify()
+	return response
+}
+
+func (f *fakeMpd) takeCommands() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	commands := f.commands
+	f.commands = nil
+	return commands
+}
+
+func TestMpdOutput(t *testing.T) {
+	server := newFakeMpd(t)
+	addr := server.listener.Addr().(*net.TCPAddr)
+	output, ok := newOutput(Cast{
+		Name:   "Living room",
+		IPAddr: addr.IP,
+		Port:   addr.Port,
+		Kind:   KIND_MPD,
+	}, nil).(*mpdOutput)
+	if !ok {
+		t.Fatal("expected an mpd output")
+	}
+	defer output.Close()
+	ctx := context.Background()
+
+	card := Card{
+		Id: "card1",
+		MediaLinks: []MediaLink{
+			{Link: "Audiobooks/Chapter 1.mp3"},
+			{Link: `Audiobooks/"Chapter" 2.mp3`},
+		},
+	}
+	if err := output.PlayCard(ctx, card); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"clear",
+		`add "Audiobooks/Chapter 1.mp3"`,
+		`add "Audiobooks/\"Chapter\" 2.mp3"`,
+		`play "0"`,
+	}
+	if commands := server.takeCommands(); strings.Join(commands, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected commands: %q", commands)
+	}
+	waitStatus := func(mediaStatus string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for output.Status().MediaStatus != mediaStatus {
+			if time.Now().After(deadline) {
+				t.Fatalf("status %+v, expected %s", output.Status(), mediaStatus)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitStatus("PLAYING")
+	if status := output.Status(); status.MediaData != "Audiobooks/Chapter 1.mp3" || status.Volume != 0.5 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	for _, test := range []struct {
+		payload ClientAction
+		command string
+		status  string
+	}{
+		{ClientAction{Action: "pause"}, `pause "1"`, "PAUSED"},
+		{ClientAction{Action: "play"}, "play", "PLAYING"},
+		{ClientAction{Action: "next"}, "next", "PLAYING"},
+		{ClientAction{Action: "prev"}, "previous", "PLAYING"},
+		{ClientAction{Action: "setvolume", Volume: 0.3}, `setvol "30"`, "PLAYING"},
+		{ClientAction{Action: "stop"}, "stop", "IDLE"},
+		// play starts a stopped queue again, as pause 0 would not
+		{ClientAction{Action: "play"}, "play", "PLAYING"},
+	} {
+		if err := output.Control(ctx, test.payload); err != nil {
+			t.Fatal(test.payload.Action, err)
+		}
+		if commands := server.takeCommands(); len(commands) != 1 || commands[0] != test.command {
+			t.Fatalf("%s: unexpected commands: %q", test.payload.Action, commands)
+		}
+		waitStatus(test.status)
+	}
+	if volume, err := output.GetVolume(ctx); err != nil || volume != 0.3 {
+		t.Fatalf("unexpected volume: %v %v", volume, err)
+	}
+
+	server.mutex.Lock()
+	server.pos = 1
+	server.mutex.Unlock()
+	err := output.Control(ctx, ClientAction{Action: "next"})
+	if err == nil || err.Error() != "mpd next: Not playing" {
+		t.Fatalf("expected ACK error, got %v", err)
+	}
+
+	// a link that cannot be added leaves the queue empty
+	card.MediaLinks = append(card.MediaLinks, MediaLink{Link: "Audiobooks/missing.mp3"})
+	err = output.PlayCard(ctx, card)
+	if err == nil || err.Error() != "mpd add: No such directory" {
+		t.Fatalf("expected ACK error, got %v", err)
+	}
+	server.mutex.Lock()
+	playlist, state := server.playlist, server.state
+	server.mutex.Unlock()
+	if len(playlist) != 0 || state != "stop" {
+		t.Fatalf("unexpected queue after failed add: %q %s", playlist, state)
+	}
+
+	// a dropped connection is redialed
+	output.mutex.Lock()
+	output.conn.Close()
+	output.mutex.Unlock()
+	if err := output.Control(ctx, ClientAction{Action: "play"}); err != nil {
+		t.Fatal(err)
+	}
+}
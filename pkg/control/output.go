@@ -0,0 +1,39 @@
+package control
+
+import (
+	"context"
+
+	"github.com/vkl/go-cast"
+)
+
+const (
+	KIND_CHROMECAST = "chromecast"
+	KIND_DLNA       = "dlna"
+	KIND_LOCAL      = "local"
+	KIND_MPD        = "mpd"
+)
+
+// Output is a playback device a card can be sent to.
+type Output interface {
+	Name() string
+	PlayCard(ctx context.Context, card Card) error
+	Control(ctx context.Context, payload ClientAction) error
+	GetVolume(ctx context.Context) (float64, error)
+	Status() cast.DisplayStatus
+	Close() error
+}
+
+// newOutput returns the output for a device. Cast devices share their
+// connection through sessions.
+func newOutput(castInfo Cast, sessions *ConnectionManager) Output {
+	switch castInfo.Kind {
+	case KIND_DLNA:
+		return newDlnaOutput(castInfo)
+	case KIND_LOCAL:
+		return newLocalOutput(castInfo)
+	case KIND_MPD:
+		return newMpdOutput(castInfo)
+	default:
+		return newChromecastOutput(castInfo, sessions)
+	}
+}
@@ -1,6 +1,3 @@
-//go:build linux
-// +build linux
-
 package control
 
 import (
@@ -11,18 +8,9 @@ import (
 	"time"
 
 	_ "github.com/vkl/rfidplayer/pkg/logging"
-	"github.com/warthog618/gpiod"
 )
 
 const (
-	OPT_SENSOR_PIN      = 17
-	ENCODER_PIN0        = 22
-	ENCODER_PIN1        = 27
-	RFID_RESET_PIN      = 26
-	BTN_PIN             = 5
-	RED_LED             = 19
-	GREEN_LED           = 13
-	BLUE_LED            = 6
 	BTN_PLAY_PUSH_DELAY = 1000 * time.Millisecond
 	BTN_NEXT_PUSH_DELAY = 3000 * time.Millisecond
 	BTN_PREV_PUSH_DELAY = 6000 * time.Millisecond
@@ -31,7 +19,9 @@ const (
 type PlayerController struct {
 	chromecastController *ChromecastControl
 	cardController       *CardController
+	events               *EventBus
 	mutex                sync.Mutex
+	insertedCard         string
 	volume               int
 	maxVolume            int
 	event                chan interface{}
@@ -39,13 +29,16 @@ type PlayerController struct {
 	ledCtx               context.Context
 	cancel               context.CancelFunc
 	ledCancel            context.CancelFunc
-	optPin               *gpiod.Line
-	encPins              *gpiod.Lines
-	rgbPins              *gpiod.Lines
-	rfidResetPin         *gpiod.Line
-	rfidController       *RfidController
+	optPin               Line
+	encPins              Lines
+	rgbPins              Lines
+	rfidResetPin         Line
+	cardReader           CardReader
 	btnLastRisingTime    time.Duration
 	btnLastFallenTime    time.Duration
+	// insertedCommand is set while the card put in is a command card,
+	// which leaves playback alone when it is taken out.
+	insertedCommand bool
 }
 
 type EncoderEvent struct{}
@@ -54,30 +47,45 @@ func (p *PlayerController) ReadAndPlayCard() {
 	p.rfidResetPin.SetValue(1)
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	cardId, err := p.rfidController.ReadCardId(ctx)
+	cardId, err := p.cardReader.ReadCardId(ctx)
 	if err != nil {
 		slog.Error(err.Error())
+		p.events.Publish(EVENT_ERROR, ErrorEvent{Source: "card reader", Message: err.Error()})
 		return
 	}
 	slog.Debug(cardId.Repr())
-	var card Card
-	var ok bool
-	if card, ok = p.cardController.Cards[cardId.Repr()]; !ok {
+	p.mutex.Lock()
+	p.insertedCard = cardId.Repr()
+	p.mutex.Unlock()
+	card, ok := p.cardController.GetCard(cardId.Repr())
+	p.events.Publish(EVENT_CARD_INSERTED, CardEvent{Id: cardId.Repr(), Name: card.Name})
+	if !ok {
 		slog.Warn("no such card", "cardId", cardId.Repr())
 		return
 	}
-	p.maxVolume = int(card.MaxVolume * 100)
+	if card.IsCommand() {
+		p.runCommand(card)
+		return
+	}
 	cardReady := make(chan bool)
 	cardError := make(chan error)
 	ctxTimeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Second)
 	go func() {
 		for {
-			if p.chromecastController.PlayCard(card) {
+			// a pulled card is only handled after this returns, so
+			// stop retrying once the sensor says it is gone
+			if pulled, _ := p.optPin.Value(); pulled == 0 {
+				cardError <- fmt.Errorf("card '%s' pulled before it played", cardId.Repr())
+				cancelTimeout()
+				return
+			}
+			err := p.chromecastController.PlayCard(card)
+			if err == nil {
 				goto DONE
 			}
 			select {
 			case <-ctxTimeout.Done():
-				cardError <- fmt.Errorf("could not play card '%s' by timeout", cardId.Repr())
+				cardError <- fmt.Errorf("could not play card '%s' by timeout: %w", cardId.Repr(), err)
 				cancelTimeout()
 				return
 			default:
@@ -100,45 +108,100 @@ func (p *PlayerController) ReadAndPlayCard() {
 			goto CARD_READY
 		case err := <-cardError:
 			slog.Error(err.Error())
+			p.events.Publish(EVENT_ERROR, ErrorEvent{Source: "player", Message: err.Error()})
 			vals[0] = 0
 			p.rgbPins.SetValues(vals)
 			return
 		}
 	}
 CARD_READY:
-	volume, ok := p.chromecastController.GetVolume()
-	if ok {
+	volume, err := p.chromecastController.GetVolume()
+	p.mutex.Lock()
+	if err == nil {
 		p.volume = int(volume * 100)
 	}
+	p.maxVolume = int(card.MaxVolume * 100)
 	p.ctx, p.cancel = context.WithCancel(context.Background())
-	go p.Encoder()
+	go p.Encoder(p.ctx)
+	p.mutex.Unlock()
 	p.rgbPins.SetValues([]int{1, 0, 1})
 }
 
-func (p *PlayerController) OptSensorHandler(e gpiod.LineEvent) {
+// runCommand does what a command card says, lighting the red LED when
+// it fails.
+func (p *PlayerController) runCommand(card Card) {
+	p.mutex.Lock()
+	p.insertedCommand = true
+	p.mutex.Unlock()
+	if err := p.chromecastController.RunCommand(card); err != nil {
+		slog.Error("card command", "error", err, "card", card.Id, "command", card.Type)
+		p.events.Publish(EVENT_ERROR, ErrorEvent{Source: "card command", Message: err.Error()})
+		vals := make([]int, 3)
+		p.rgbPins.Values(vals)
+		vals[0] = 0
+		p.rgbPins.SetValues(vals)
+	}
+}
+
+func (p *PlayerController) OptSensorHandler(e LineEvent) {
 	switch e.Type {
-	case gpiod.LineEventRisingEdge:
+	case LINE_EVENT_RISING_EDGE:
 		slog.Debug("card inserted")
 		p.ReadAndPlayCard()
-	case gpiod.LineEventFallingEdge:
+	case LINE_EVENT_FALLING_EDGE:
 		slog.Debug("card pulled")
+		p.mutex.Lock()
+		cardId, command := p.insertedCard, p.insertedCommand
+		p.insertedCard, p.insertedCommand = "", false
+		p.mutex.Unlock()
+		if cardId != "" {
+			p.events.Publish(EVENT_CARD_REMOVED, CardEvent{Id: cardId})
+		}
 		p.rfidResetPin.SetValue(0)
-		p.chromecastController.Control(STOP)
-		if p.cancel != nil {
-			p.cancel()
-			p.cancel = nil
+		if command {
+			return
 		}
+		p.chromecastController.Control(STOP)
+		p.releaseEncoder()
 		p.rgbPins.SetValues([]int{0, 1, 1})
 	}
 }
 
-func (p *PlayerController) Encoder() {
-	encCount := p.volume
+func (p *PlayerController) releaseEncoder() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+}
+
+// FollowPlayback goes idle when the queue of the card ends and turns
+// the LEDs off when another sender takes the device over.
+func (p *PlayerController) FollowPlayback(events <-chan Event) {
+	for event := range events {
+		switch event.Type {
+		case EVENT_PLAYBACK_TAKEN_OVER:
+			slog.Info("playback taken over", "device", event.Data.(PlaybackEvent).Device)
+			p.releaseEncoder()
+			p.rgbPins.SetValues([]int{1, 1, 1})
+		case EVENT_PLAYBACK_FINISHED:
+			slog.Info("playback finished", "device", event.Data.(PlaybackEvent).Device)
+			p.releaseEncoder()
+			p.rgbPins.SetValues([]int{0, 1, 1})
+		}
+	}
+}
+
+func (p *PlayerController) Encoder(ctx context.Context) {
+	p.mutex.Lock()
+	encCount, volume, maxVolume := p.volume, p.volume, p.maxVolume
+	p.mutex.Unlock()
 	values := make([]int, 2)
 	var encState, newState int
 	for {
 		select {
-		case <-p.ctx.Done():
+		case <-ctx.Done():
 			slog.Debug("close encoder function")
 			return
 		default:
@@ -177,25 +240,28 @@ func (p *PlayerController) Encoder() {
 			encState = newState
 		}
 		time.Sleep(1 * time.Millisecond)
-		if encCount > p.maxVolume {
-			encCount = p.maxVolume
+		if encCount > maxVolume {
+			encCount = maxVolume
 		} else if encCount < 0 {
 			encCount = 0
 		}
-		if encCount%5 == 0 && p.volume != encCount {
-			p.volume = encCount
-			p.chromecastController.SetVolume(float64(p.volume) / 100)
+		if encCount%5 == 0 && volume != encCount {
+			volume = encCount
+			p.mutex.Lock()
+			p.volume = volume
+			p.mutex.Unlock()
+			p.chromecastController.SetVolume(float64(volume) / 100)
 		}
 	}
 }
 
 // One-button interface
-func (p *PlayerController) BtnHandler(e gpiod.LineEvent) {
-	if e.Type == gpiod.LineEventRisingEdge {
+func (p *PlayerController) BtnHandler(e LineEvent) {
+	if e.Type == LINE_EVENT_RISING_EDGE {
 		p.btnLastRisingTime = e.Timestamp
 		p.ledCtx, p.ledCancel = context.WithCancel(context.Background())
 		go LedControl(p.ledCtx, p.rgbPins)
-	} else if e.Type == gpiod.LineEventFallingEdge {
+	} else if e.Type == LINE_EVENT_FALLING_EDGE {
 		btnPushTime := e.Timestamp - p.btnLastRisingTime
 		if p.ledCancel != nil {
 			p.ledCancel()
@@ -225,66 +291,30 @@ func (p *PlayerController) BtnHandler(e gpiod.LineEvent) {
 func NewPlayerController(
 	chromecastController *ChromecastControl,
 	cardController *CardController,
+	events *EventBus,
+	hardware Hardware,
 ) (*PlayerController, error) {
 
 	player := &PlayerController{
 		chromecastController: chromecastController,
 		cardController:       cardController,
+		events:               events,
 		mutex:                sync.Mutex{},
 		event:                make(chan interface{}),
-		rfidController:       NewRfidController("/dev/serial0"),
-	}
-
-	// ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
-	// defer cancel()
-	// rfidController.ReadCard(ctx)
-
-	chip, _ := gpiod.NewChip("gpiochip0")
-	slog.Debug("info", "lines", chip.Lines())
-	var err error
-
-	player.rfidResetPin, err = chip.RequestLine(
-		RFID_RESET_PIN,
-		gpiod.WithPullUp,
-		gpiod.AsOutput(0),
-	)
-
-	player.optPin, err = chip.RequestLine(
-		OPT_SENSOR_PIN,
-		gpiod.WithPullUp,
-		gpiod.WithEventHandler(player.OptSensorHandler),
-		gpiod.WithBothEdges,
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	player.encPins, err = chip.RequestLines(
-		[]int{ENCODER_PIN0, ENCODER_PIN1},
-		gpiod.AsInput,
-		gpiod.WithPullUp,
-		gpiod.WithBothEdges,
-	)
-	if err != nil {
-		return nil, err
 	}
 
-	_, err = chip.RequestLine(
-		BTN_PIN,
-		gpiod.AsInput,
-		gpiod.WithBothEdges,
-		gpiod.WithEventHandler(player.BtnHandler),
-		gpiod.LineBiasPullDown,
-		gpiod.WithDebounce(10*time.Millisecond),
-	)
+	lines, err := hardware.Open(player.OptSensorHandler, player.BtnHandler)
 	if err != nil {
 		return nil, err
 	}
+	player.optPin = lines.OptSensor
+	player.rfidResetPin = lines.RfidReset
+	player.encPins = lines.Encoder
+	player.rgbPins = lines.Leds
+	player.cardReader = lines.Reader
 
-	player.rgbPins, err = chip.RequestLines(
-		[]int{RED_LED, GREEN_LED, BLUE_LED},
-		gpiod.AsOutput(0, 1, 1),
-	)
+	playbackEvents, _ := events.Subscribe()
+	go player.FollowPlayback(playbackEvents)
 
 	// check if card already inserted
 	// and read and play card
@@ -297,7 +327,7 @@ func NewPlayerController(
 
 }
 
-func LedControl(ctx context.Context, leds *gpiod.Lines) {
+func LedControl(ctx context.Context, leds Lines) {
 	ticker := time.NewTicker(10 * time.Millisecond)
 	count := 0
 	maxCount := 20
@@ -0,0 +1,261 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// SCENARIO_TIMEOUT is how long an expectation waits for the player.
+// It is longer than the player's one second between retries.
+const SCENARIO_TIMEOUT = 3 * time.Second
+
+// A scenario in testdata/scenarios is a script of what happens to the
+// player, one step per line, with # starting a comment:
+//
+//	discover              the speaker turns up on the network
+//	insert <card id>      put a card into the slot
+//	remove                pull the card
+//	press <duration>      press the button that long
+//	turn <steps>          turn the encoder, clockwise for +10
+//	wait <duration>       let the player run
+//	expect actions ...    transport commands sent since the last check
+//	expect volume ...     volume levels set since the last check
+//	expect leds <lit>     the lit LED: red, green, blue or off
+//	expect reader on|off  whether the card reader is powered
+//
+// The speaker is a fake DLNA renderer at volume 30. Card 0a1b plays
+// three tracks on it with a max volume of 0.5, card 0c0d one track.
+// Card 1a1b is a volume card setting 0.2 and card 2a2b a stop card.
+type scenario struct {
+	t           *testing.T
+	simulator   *Simulator
+	renderer    *fakeRenderer
+	castInfo    Cast
+	castControl *CastController
+	actions     []string
+	volumes     []string
+}
+
+func newScenario(t *testing.T) *scenario {
+	renderer := &fakeRenderer{state: "STOPPED", volume: 30}
+	srv := httptest.NewServer(renderer)
+	t.Cleanup(srv.Close)
+	castInfo, err := fetchRenderer(context.Background(), srv.URL+"/description.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cardController, err := NewCardController(t.TempDir() + "/cards.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cardController.AddCard(Card{
+		Id:         "0a1b",
+		Name:       "Songs",
+		Chromecast: castInfo.Name,
+		MaxVolume:  0.5,
+		MediaLinks: []MediaLink{
+			{Link: "http://media/1.mp3"},
+			{Link: "http://media/2.mp3"},
+			{Link: "http://media/3.mp3"},
+		},
+	})
+	cardController.AddCard(Card{
+		Id:         "0c0d",
+		Name:       "Story",
+		Chromecast: castInfo.Name,
+		MaxVolume:  1,
+		MediaLinks: []MediaLink{{Link: "http://media/4.mp3"}},
+	})
+	cardController.AddCard(Card{Id: "1a1b", Name: "Quiet", Type: COMMAND_VOLUME, Volume: 0.2})
+	cardController.AddCard(Card{Id: "2a2b", Name: "Stop", Type: COMMAND_STOP})
+	castControl := &CastController{}
+	events := NewEventBus()
+	simulator := NewSimulator()
+	t.Cleanup(simulator.Close)
+	cc := newTestChromecastControl(t, castControl, events)
+	if _, err := NewPlayerController(cc, cardController, events, simulator); err != nil {
+		t.Fatal(err)
+	}
+	return &scenario{
+		t:           t,
+		simulator:   simulator,
+		renderer:    renderer,
+		castInfo:    castInfo,
+		castControl: castControl,
+	}
+}
+
+// collect moves what the renderer was asked to do into the actions and
+// volumes still to be checked. Status queries are left out.
+func (s *scenario) collect() {
+	actions, bodies := s.renderer.takeActions()
+	for i, action := range actions {
+		switch action {
+		case "GetTransportInfo", "GetPositionInfo", "GetVolume":
+		case "SetVolume":
+			var volume int
+			body := bodies[i][strings.Index(bodies[i], "<DesiredVolume>"):]
+			fmt.Sscanf(body, "<DesiredVolume>%d", &volume)
+			s.volumes = append(s.volumes, strconv.Itoa(volume))
+		default:
+			s.actions = append(s.actions, action)
+		}
+	}
+}
+
+// eventually polls until check is true or the scenario times out. It
+// does not wait for the edges to be handled, as a card being read
+// holds up the ones after it.
+func (s *scenario) eventually(check func() bool) bool {
+	deadline := time.Now().Add(SCENARIO_TIMEOUT)
+	for !check() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// expectCalls checks the calls in got against want and forgets them.
+func (s *scenario) expectCalls(kind string, got *[]string, want []string) error {
+	s.eventually(func() bool {
+		s.collect()
+		return len(*got) >= len(want)
+	})
+	calls := *got
+	*got = nil
+	if strings.Join(calls, " ") != strings.Join(want, " ") {
+		return fmt.Errorf("expected %s %v, got %v", kind, want, calls)
+	}
+	return nil
+}
+
+func ledsLit(values []int) string {
+	lit := make([]string, 0)
+	for i, name := range []string{"red", "green", "blue"} {
+		if values[i] == 0 {
+			lit = append(lit, name)
+		}
+	}
+	if len(lit) == 0 {
+		return "off"
+	}
+	return strings.Join(lit, "+")
+}
+
+func (s *scenario) step(fields []string) error {
+	arg := ""
+	if len(fields) > 1 {
+		arg = fields[1]
+	}
+	switch fields[0] {
+	case "discover":
+		return s.castControl.UpdateCast(s.castInfo)
+	case "insert":
+		return s.simulator.InsertCard(arg)
+	case "remove":
+		s.simulator.RemoveCard()
+	case "press":
+		duration, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		s.simulator.PressButton(duration)
+	case "turn":
+		steps, err := strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		s.simulator.TurnEncoder(steps)
+	case "wait":
+		duration, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		time.Sleep(duration)
+	case "expect":
+		return s.expect(arg, fields[2:])
+	default:
+		return fmt.Errorf("unknown step %q", fields[0])
+	}
+	return nil
+}
+
+func (s *scenario) expect(what string, want []string) error {
+	switch what {
+	case "actions":
+		return s.expectCalls("actions", &s.actions, want)
+	case "volume":
+		return s.expectCalls("volume", &s.volumes, want)
+	case "leds":
+		var lit string
+		if !s.eventually(func() bool {
+			lit = ledsLit(s.simulator.State().Leds)
+			return lit == strings.Join(want, " ")
+		}) {
+			return fmt.Errorf("expected leds %s, got %s", strings.Join(want, " "), lit)
+		}
+	case "reader":
+		var power bool
+		if !s.eventually(func() bool {
+			power = s.simulator.State().ReaderPower
+			return power == (strings.Join(want, " ") == "on")
+		}) {
+			return fmt.Errorf("expected reader %s, got power %t", strings.Join(want, " "), power)
+		}
+	default:
+		return fmt.Errorf("unknown expectation %q", what)
+	}
+	return nil
+}
+
+func (s *scenario) run(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := s.step(fields); err != nil {
+			s.t.Fatalf("%s:%d: %s: %v", filepath.Base(path), line, strings.Join(fields, " "), err)
+		}
+	}
+	// nothing is left unchecked
+	s.simulator.Settle()
+	time.Sleep(100 * time.Millisecond)
+	s.collect()
+	if len(s.actions) > 0 || len(s.volumes) > 0 {
+		s.t.Fatalf("%s: unchecked actions %v, volume %v", filepath.Base(path), s.actions, s.volumes)
+	}
+}
+
+func TestPlayerScenarios(t *testing.T) {
+	paths, err := filepath.Glob("testdata/scenarios/*.scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no scenarios")
+	}
+	for _, path := range paths {
+		path := path
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".scenario"), func(t *testing.T) {
+			newScenario(t).run(path)
+		})
+	}
+}
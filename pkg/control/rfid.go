@@ -15,12 +15,6 @@ const (
 	RFID_PACKET_LEN = 16
 )
 
-type RfidCardId []byte
-
-func (rId RfidCardId) Repr() string {
-	return fmt.Sprintf("%x", rId)
-}
-
 type RfidController struct {
 	serialPort string
 }
@@ -0,0 +1,268 @@
+package control
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	SIMULATOR_ENCODER_STEP = 10 * time.Millisecond
+	SIMULATOR_EDGE_QUEUE   = 64
+)
+
+// encoderStates is the Gray code sequence of the encoder pins turning
+// clockwise, which turns the volume up.
+var encoderStates = [][]int{{0, 0}, {1, 0}, {1, 1}, {0, 1}}
+
+// virtualLines are GPIO lines kept in memory. A single virtual line is
+// a group of one.
+type virtualLines struct {
+	mutex   sync.Mutex
+	values  []int
+	changed func(values []int)
+}
+
+func newVirtualLines(values ...int) *virtualLines {
+	return &virtualLines{values: append([]int{}, values...)}
+}
+
+func (l *virtualLines) Value() (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.values[0], nil
+}
+
+func (l *virtualLines) SetValue(value int) error {
+	return l.SetValues([]int{value})
+}
+
+func (l *virtualLines) Values(values []int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	copy(values, l.values)
+	return nil
+}
+
+func (l *virtualLines) SetValues(values []int) error {
+	l.mutex.Lock()
+	copy(l.values, values)
+	current := append([]int{}, l.values...)
+	changed := l.changed
+	l.mutex.Unlock()
+	if changed != nil {
+		changed(current)
+	}
+	return nil
+}
+
+// SimulatorState is what can be seen of the simulated player.
+type SimulatorState struct {
+	Card        string `json:"card"`
+	Leds        []int  `json:"leds"`
+	ReaderPower bool   `json:"reader_power"`
+}
+
+// simulatorEdge is an edge waiting for the event loop.
+type simulatorEdge struct {
+	handler LineHandler
+	event   LineEvent
+}
+
+// Simulator is virtual player hardware: a card slot with its reader, the
+// button, the volume encoder and the LEDs, driven from code instead of
+// GPIO. Line values change at once, while the edges go to the player
+// one at a time from an event loop, as they do from the GPIO one.
+type Simulator struct {
+	mutex     sync.Mutex
+	start     time.Time
+	elapsed   time.Duration
+	optSensor LineHandler
+	button    LineHandler
+	edges     chan simulatorEdge
+	closed    bool
+	pending   int
+	settled   *sync.Cond
+	slot      sync.Mutex
+	cardId    RfidCardId
+	opt       *virtualLines
+	reset     *virtualLines
+	encoder   *virtualLines
+	leds      *virtualLines
+	encState  int
+}
+
+func NewSimulator() *Simulator {
+	s := &Simulator{
+		start:   time.Now(),
+		edges:   make(chan simulatorEdge, SIMULATOR_EDGE_QUEUE),
+		opt:     newVirtualLines(0),
+		reset:   newVirtualLines(0),
+		encoder: newVirtualLines(encoderStates[0]...),
+		leds:    newVirtualLines(0, 1, 1),
+	}
+	s.settled = sync.NewCond(&sync.Mutex{})
+	go s.run()
+	return s
+}
+
+func (s *Simulator) Open(optSensor, button LineHandler) (*PlayerHardware, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.optSensor, s.button = optSensor, button
+	return &PlayerHardware{
+		OptSensor: s.opt,
+		RfidReset: s.reset,
+		Encoder:   s.encoder,
+		Leds:      s.leds,
+		Reader:    s,
+	}, nil
+}
+
+// Close stops the event loop. Edges still queued are delivered first.
+func (s *Simulator) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.edges)
+	}
+}
+
+func (s *Simulator) run() {
+	for edge := range s.edges {
+		edge.handler(edge.event)
+		s.settled.L.Lock()
+		s.pending--
+		s.settled.Broadcast()
+		s.settled.L.Unlock()
+	}
+}
+
+// Settle waits until the player has handled every edge so far.
+func (s *Simulator) Settle() {
+	s.settled.L.Lock()
+	defer s.settled.L.Unlock()
+	for s.pending > 0 {
+		s.settled.Wait()
+	}
+}
+
+// OnLeds calls fn with the LED values whenever the player sets them.
+func (s *Simulator) OnLeds(fn func(values []int)) {
+	s.leds.mutex.Lock()
+	defer s.leds.mutex.Unlock()
+	s.leds.changed = fn
+}
+
+// now is the time since the simulator started, moved forward by the
+// button presses so timestamps never go back. Callers hold the mutex.
+func (s *Simulator) now() time.Duration {
+	return time.Since(s.start) + s.elapsed
+}
+
+// edge queues an edge for the player. Callers hold the mutex, which
+// keeps the edges in the order of the line changes.
+func (s *Simulator) edge(handler LineHandler, eventType LineEventType, timestamp time.Duration) {
+	if handler == nil || s.closed {
+		return
+	}
+	s.settled.L.Lock()
+	s.pending++
+	s.settled.L.Unlock()
+	s.edges <- simulatorEdge{handler: handler, event: LineEvent{Type: eventType, Timestamp: timestamp}}
+}
+
+// InsertCard puts the card with the given id into the slot, taking out
+// the card that was there.
+func (s *Simulator) InsertCard(id string) error {
+	cardId, err := hex.DecodeString(id)
+	if err != nil || len(cardId) == 0 {
+		return fmt.Errorf("invalid card id %q: the reader only sees hex ids", id)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removeCard()
+	s.slot.Lock()
+	s.cardId = cardId
+	s.slot.Unlock()
+	s.opt.SetValue(1)
+	s.edge(s.optSensor, LINE_EVENT_RISING_EDGE, s.now())
+	return nil
+}
+
+// RemoveCard takes the card out of the slot.
+func (s *Simulator) RemoveCard() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removeCard()
+}
+
+func (s *Simulator) removeCard() {
+	s.slot.Lock()
+	inserted := s.cardId != nil
+	s.cardId = nil
+	s.slot.Unlock()
+	if !inserted {
+		return
+	}
+	s.opt.SetValue(0)
+	s.edge(s.optSensor, LINE_EVENT_FALLING_EDGE, s.now())
+}
+
+// PressButton presses the button for the given duration. The press is
+// not waited out; only the timestamps of the edges are that far apart.
+func (s *Simulator) PressButton(duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pressed := s.now()
+	s.edge(s.button, LINE_EVENT_RISING_EDGE, pressed)
+	s.elapsed += duration
+	s.edge(s.button, LINE_EVENT_FALLING_EDGE, pressed+duration)
+}
+
+// TurnEncoder turns the encoder by the given number of steps, clockwise
+// when positive. Each step holds long enough for the player to see it.
+func (s *Simulator) TurnEncoder(steps int) {
+	direction := 1
+	if steps < 0 {
+		direction, steps = -1, -steps
+	}
+	for i := 0; i < steps; i++ {
+		s.mutex.Lock()
+		s.encState = (s.encState + direction + len(encoderStates)) % len(encoderStates)
+		s.encoder.SetValues(encoderStates[s.encState])
+		s.mutex.Unlock()
+		time.Sleep(SIMULATOR_ENCODER_STEP)
+	}
+}
+
+func (s *Simulator) State() SimulatorState {
+	leds := make([]int, 3)
+	s.leds.Values(leds)
+	power, _ := s.reset.Value()
+	s.slot.Lock()
+	defer s.slot.Unlock()
+	return SimulatorState{
+		Card:        s.cardId.Repr(),
+		Leds:        leds,
+		ReaderPower: power == 1,
+	}
+}
+
+// ReadCardId reads the card in the slot. The reader only answers while
+// the player powers it.
+func (s *Simulator) ReadCardId(ctx context.Context) (RfidCardId, error) {
+	if power, _ := s.reset.Value(); power == 0 {
+		return nil, errors.New("card reader is not powered")
+	}
+	s.slot.Lock()
+	defer s.slot.Unlock()
+	if s.cardId == nil {
+		return nil, errors.New("no card in the slot")
+	}
+	return append(RfidCardId{}, s.cardId...), nil
+}
@@ -0,0 +1,106 @@
+package control
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSimulatorCardSlot(t *testing.T) {
+	simulator := NewSimulator()
+	defer simulator.Close()
+	var edges []LineEventType
+	hardware, err := simulator.Open(func(e LineEvent) {
+		edges = append(edges, e.Type)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := simulator.InsertCard("not hex"); err == nil {
+		t.Fatal("expected an error for a card id the reader can not see")
+	}
+	if err := simulator.InsertCard("0a1b2c"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := hardware.OptSensor.Value(); value != 1 {
+		t.Fatal("card sensor is not set")
+	}
+	if _, err := hardware.Reader.ReadCardId(context.Background()); err == nil {
+		t.Fatal("expected the reader to be off")
+	}
+	hardware.RfidReset.SetValue(1)
+	cardId, err := hardware.Reader.ReadCardId(context.Background())
+	if err != nil || cardId.Repr() != "0a1b2c" {
+		t.Fatalf("unexpected card id: %v %v", cardId.Repr(), err)
+	}
+
+	// inserting another card takes the first one out
+	simulator.InsertCard("0d0e")
+	simulator.RemoveCard()
+	simulator.RemoveCard()
+	simulator.Settle()
+	expected := []LineEventType{
+		LINE_EVENT_RISING_EDGE,
+		LINE_EVENT_FALLING_EDGE, LINE_EVENT_RISING_EDGE,
+		LINE_EVENT_FALLING_EDGE,
+	}
+	if len(edges) != len(expected) {
+		t.Fatalf("unexpected edges: %v", edges)
+	}
+	for i := range expected {
+		if edges[i] != expected[i] {
+			t.Fatalf("unexpected edges: %v", edges)
+		}
+	}
+	if _, err := hardware.Reader.ReadCardId(context.Background()); err == nil {
+		t.Fatal("expected an empty slot")
+	}
+}
+
+func TestSimulatorButton(t *testing.T) {
+	simulator := NewSimulator()
+	defer simulator.Close()
+	var events []LineEvent
+	simulator.Open(nil, func(e LineEvent) {
+		events = append(events, e)
+	})
+	simulator.PressButton(2 * time.Second)
+	simulator.PressButton(100 * time.Millisecond)
+	simulator.Settle()
+	if len(events) != 4 {
+		t.Fatalf("unexpected events: %v", events)
+	}
+	if events[0].Type != LINE_EVENT_RISING_EDGE || events[1].Type != LINE_EVENT_FALLING_EDGE {
+		t.Fatalf("unexpected events: %v", events)
+	}
+	if pushed := events[1].Timestamp - events[0].Timestamp; pushed != 2*time.Second {
+		t.Fatalf("unexpected push time: %s", pushed)
+	}
+	if events[2].Timestamp < events[1].Timestamp {
+		t.Fatal("timestamps went back")
+	}
+}
+
+func TestSimulatorEncoder(t *testing.T) {
+	simulator := NewSimulator()
+	defer simulator.Close()
+	hardware, _ := simulator.Open(nil, nil)
+	values := make([]int, 2)
+	state := func() int {
+		hardware.Encoder.Values(values)
+		return values[0]<<1 | values[1]
+	}
+	// one clockwise turn goes 0, 2, 3, 1 and back to 0
+	var states []int
+	for i := 0; i < 4; i++ {
+		simulator.TurnEncoder(1)
+		states = append(states, state())
+	}
+	if states[0] != 2 || states[1] != 3 || states[2] != 1 || states[3] != 0 {
+		t.Fatalf("unexpected clockwise states: %v", states)
+	}
+	simulator.TurnEncoder(-1)
+	if state() != 1 {
+		t.Fatalf("unexpected counterclockwise state: %d", state())
+	}
+}
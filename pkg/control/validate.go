@@ -0,0 +1,259 @@
+package control
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// receiverAppIdPattern matches Cast application ids such as CC1AD845.
+var receiverAppIdPattern = regexp.MustCompile(`^[0-9A-Fa-f]{8}$`)
+
+// mediaContentTypes are the content types outside audio/ and video/
+// that the outputs play.
+var mediaContentTypes = []string{
+	"application/dash+xml",
+	"application/ogg",
+	"application/vnd.apple.mpegurl",
+	"application/x-mpegurl",
+}
+
+// FieldError is what is wrong with one field of a card. Field is the
+// JSON name, with the index for list items, as in media_links[1].link.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists everything wrong with a card. It matches
+// ErrInvalidCard with errors.Is.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Field + ": " + field.Message
+	}
+	return fmt.Sprintf("%s: %s", ErrInvalidCard, strings.Join(messages, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidCard
+}
+
+func (e *ValidationError) add(field string, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks that the card can be played: its id is what the reader
+// reports, its media links are URLs of media the outputs play, and its
+// max volume lets the encoder turn the volume up. Command cards are
+// checked for what their command needs instead. The devices are only
+// checked against castControl when it is not nil.
+func (c Card) Validate(castControl *CastController) error {
+	return c.validate(castControl, castControl)
+}
+
+// validateLoaded is Validate for cards that come from outside the API,
+// such as an edited card file or an imported bundle. Devices
+// castControl does not know yet do not make the card invalid; they are
+// returned, and ResolveDevices fills them in once they are found.
+func (c Card) validateLoaded(castControl *CastController) ([]string, error) {
+	return c.unknownDevices(castControl), c.validate(castControl, nil)
+}
+
+// validate checks the card, telling the kind of its devices from
+// castControl and failing devices that known does not have, when it is
+// not nil.
+func (c Card) validate(castControl *CastController, known *CastController) error {
+	e := &ValidationError{}
+	switch {
+	case c.Id == "":
+		e.add("id", "is required")
+	case strings.ToLower(c.Id) != c.Id:
+		e.add("id", "must be lower case, as the reader reports it")
+	default:
+		if _, err := hex.DecodeString(c.Id); err != nil {
+			e.add("id", "must be the hex id the reader reports, such as 0a1b2c3d")
+		}
+	}
+	switch {
+	case c.Type == "":
+		c.validateMedia(e, castControl, known)
+	case !isCommand(c.Type):
+		e.add("type", "must be empty for a media card or one of %s", strings.Join(commands, ", "))
+	default:
+		c.validateCommand(e, known)
+	}
+	if c.ReceiverAppId != "" && !receiverAppIdPattern.MatchString(c.ReceiverAppId) {
+		e.add("receiver_app_id", "must be an application id of 8 hex digits, such as CC1AD845")
+	}
+	if c.Artwork != "" {
+		if err := validateLink(c.Artwork, false); err != nil {
+			e.add("artwork", "%v", err)
+		}
+	}
+	for i, tag := range c.Tags {
+		field := fmt.Sprintf("tags[%d]", i)
+		switch {
+		case strings.TrimSpace(tag) == "":
+			e.add(field, "is empty")
+		case strings.TrimSpace(tag) != tag:
+			e.add(field, "must not start or end with spaces")
+		case strings.Contains(tag, ","):
+			e.add(field, "must not contain commas, which separate tags in filters")
+		case hasTag(c.Tags[:i], tag):
+			e.add(field, "%q is already a tag of the card", tag)
+		}
+	}
+	if len(e.Fields) > 0 {
+		return e
+	}
+	return nil
+}
+
+// validateMedia checks what a media card needs to play.
+func (c Card) validateMedia(e *ValidationError, castControl *CastController, known *CastController) {
+	if c.MaxVolume <= 0 || c.MaxVolume > 1 {
+		e.add("maxvolume", "must be above 0 and at most 1")
+	}
+	if len(c.MediaLinks) == 0 {
+		e.add("media_links", "at least one is required")
+	}
+	libraryPaths := c.playsOnMpd(castControl)
+	for i, link := range c.MediaLinks {
+		field := fmt.Sprintf("media_links[%d]", i)
+		if err := validateLink(link.Link, libraryPaths); err != nil {
+			e.add(field+".link", "%v", err)
+		}
+		if link.ContentType != "" && !isMediaContentType(link.ContentType) {
+			e.add(field+".content_type", "%q is not an audio or video type", link.ContentType)
+		}
+	}
+	// a card without devices plays in the room the player is in
+	if c.Chromecast == "" && len(c.Chromecasts) > 0 {
+		e.add("chromecast", "is required for a card with chromecasts")
+	} else if c.Chromecast != "" && known != nil && !knownDevice(known, c.Chromecast) {
+		e.add("chromecast", "no device named %q", c.Chromecast)
+	}
+	for i, name := range c.Chromecasts {
+		field := fmt.Sprintf("chromecasts[%d]", i)
+		switch {
+		case name == "":
+			e.add(field, "is empty")
+		case name == c.Chromecast:
+			e.add(field, "%q is already the card's device", name)
+		case known != nil && !knownDevice(known, name):
+			e.add(field, "no device named %q", name)
+		}
+	}
+}
+
+// validateCommand checks what a command card needs for its command,
+// failing devices that known does not have when it is not nil.
+func (c Card) validateCommand(e *ValidationError, known *CastController) {
+	switch c.Type {
+	case COMMAND_OUTPUT, COMMAND_ROOM:
+		if c.Chromecast == "" {
+			e.add("chromecast", "is required for an %s card", c.Type)
+		} else if known != nil && !knownDevice(known, c.Chromecast) {
+			e.add("chromecast", "no device named %q", c.Chromecast)
+		}
+	case COMMAND_SLEEP:
+		if c.SleepMinutes <= 0 || c.SleepMinutes > MAX_SLEEP_MINUTES {
+			e.add("sleep_minutes", "must be from 1 to %d", MAX_SLEEP_MINUTES)
+		}
+	case COMMAND_VOLUME:
+		if c.Volume <= 0 || c.Volume > 1 {
+			e.add("volume", "must be above 0 and at most 1")
+		}
+	}
+}
+
+// playsOnMpd reports whether the card may play on an MPD device, which
+// takes paths relative to its music directory. A card without a device
+// plays in the room, which may be one, as may a device castControl
+// does not tell about.
+func (c Card) playsOnMpd(castControl *CastController) bool {
+	if c.Chromecast == "" || castControl == nil {
+		return true
+	}
+	castInfo, ok := castControl.GetCastByName(c.Chromecast)
+	return !ok || castInfo.Kind == KIND_MPD
+}
+
+// validateLink accepts http and https URLs, file URLs, and absolute
+// paths the local players open. Paths relative to the MPD music
+// directory are accepted when libraryPaths is set.
+func validateLink(link string, libraryPaths bool) error {
+	if link == "" {
+		return errors.New("is required")
+	}
+	if strings.HasPrefix(link, "/") {
+		return nil
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return errors.New("is not a URL")
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return errors.New("has no host")
+		}
+	case "file":
+		if u.Path == "" {
+			return errors.New("has no path")
+		}
+	case "":
+		if libraryPaths && u.Path != "" {
+			return nil
+		}
+		return errors.New("must be an absolute URL, such as http://host/song.mp3")
+	default:
+		return fmt.Errorf("scheme %q is not supported", u.Scheme)
+	}
+	return nil
+}
+
+func isMediaContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "audio/") || strings.HasPrefix(mediaType, "video/") {
+		return true
+	}
+	for _, known := range mediaContentTypes {
+		if mediaType == known {
+			return true
+		}
+	}
+	return false
+}
+
+func knownDevice(castControl *CastController, name string) bool {
+	_, ok := castControl.GetCastByName(name)
+	return ok
+}
+
+// unknownDevices returns the devices of the card castControl does not
+// know, if it is not nil.
+func (c Card) unknownDevices(castControl *CastController) []string {
+	unknown := make([]string, 0)
+	if castControl == nil {
+		return unknown
+	}
+	for _, name := range append([]string{c.Chromecast}, c.Chromecasts...) {
+		if name != "" && !knownDevice(castControl, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown
+}
@@ -1,51 +1,178 @@
+// updateCardTable lists the cards grouped by their first tag, the
+// cards without tags last.
 function updateCardTable(cards) {
     const cardsTable = document.getElementById("cards");
     const rows = cardsTable.querySelectorAll("tr:not(:first-child)");
     rows.forEach((row) => {
         cardsTable.removeChild(row);
     })
-    Object.entries(cards).forEach(([id, card]) => {
+    const collection = card => (card.tags || [])[0] || "";
+    const entries = Object.entries(cards).sort(([idA, cardA], [idB, cardB]) => {
+        const [a, b] = [collection(cardA), collection(cardB)];
+        if (a != b) {
+            return a == "" ? 1 : b == "" ? -1 : a.localeCompare(b);
+        }
+        return cardA.name.localeCompare(cardB.name) || idA.localeCompare(idB);
+    });
+    let group = null;
+    entries.forEach(([id, card]) => {
+        if (collection(card) !== group) {
+            group = collection(card);
+            const groupRow = document.createElement("tr");
+            groupRow.className = "group";
+            groupRow.innerHTML = `<th colspan="8">`+(group || "No collection")+`</th>`;
+            cardsTable.appendChild(groupRow);
+        }
         const newRow = document.createElement("tr")
         links = ""
-        for (entry of card.media_links) {
+        for (entry of card.media_links || []) {
             links += entry.link+"; "+entry.content_type + "\n</br>"
         }
+        if (card.type) {
+            links = "Command card: "+card.type;
+        }
+        newRow.dataset.receiverAppId = card.receiver_app_id || "";
         newRow.innerHTML = `<td>
                 <input id="`+id+`" type="checkbox"/></td>
                 <td>`+id+`</td>
                 <td>`+card.name+`</td>
-                <td>`+card.chromecast+`</td>
+                <td data-chromecast="`+card.chromecast+`" data-chromecasts="`+(card.chromecasts || []).join(",")+`">`+
+                    [card.chromecast || (card.type ? "" : "(room)")].concat(card.chromecasts || []).join(" + ")+`</td>
                 <td><div class="wrapper">`+links+`</div></td><td>
                 <a class="play" onclick="playCard(this)" href="javascript:void(0)">play</a>
                 <a class="edit" onclick="editCard(this)" href="javascript:void(0)">edit</a></td>
-                <td>`+card.maxvolume+`</td>`;
+                <td>`+card.maxvolume+`</td>
+                <td>`+(card.tags || []).join(", ")+`</td>`;
         cardsTable.appendChild(newRow);
     });
+    searchCards();
+}
+
+// searchCards hides the cards not matching the search, and the groups
+// left empty.
+function searchCards() {
+    const search = document.getElementById("search").value.trim().toLowerCase();
+    let groupRow = null;
+    let groupEmpty = true;
+    for (const row of document.getElementById("cards").querySelectorAll("tr:not(:first-child)")) {
+        if (row.classList.contains("group")) {
+            if (groupRow) {
+                groupRow.classList.toggle("hidden", groupEmpty);
+            }
+            groupRow = row;
+            groupEmpty = true;
+            continue;
+        }
+        const matches = row.textContent.toLowerCase().includes(search);
+        row.classList.toggle("hidden", !matches);
+        groupEmpty = groupEmpty && !matches;
+    }
+    if (groupRow) {
+        groupRow.classList.toggle("hidden", groupEmpty);
+    }
 }
 
+async function getTags() {
+    const response = await fetch("/api/v1/tags");
+    if (await showError(response)) {
+        return;
+    }
+    const tags = await response.json();
+    const tagFilter = document.getElementById("tagfilter");
+    for (const option of Array.from(tagFilter.options).slice(1)) {
+        if (!(option.value in tags)) {
+            tagFilter.removeChild(option);
+        }
+    }
+    for (const tag of Object.keys(tags).sort()) {
+        let option = Array.from(tagFilter.options).find(option => option.value === tag);
+        if (!option) {
+            option = document.createElement("option");
+            option.value = tag;
+            tagFilter.appendChild(option);
+        }
+        option.textContent = tag+" ("+tags[tag]+")";
+    }
+}
+
+// changeCards makes a change to all checked cards.
+async function changeCards(change) {
+    const ids = Array.from(document.getElementById("cards")
+        .querySelectorAll('input[type="checkbox"]:checked'), card => card.id);
+    if (ids.length == 0) {
+        showMessage("Check the cards to change first");
+        return;
+    }
+    const response = await fetch("/api/v1/cards/bulk", {
+        method: "POST",
+        headers: {
+            "Content-Type": "application/json",
+        },
+        body: JSON.stringify(Object.assign({"ids": ids}, change))
+    });
+    if (await showError(response)) {
+        return;
+    }
+    await getCards();
+}
+
+// editCard opens the editor on the card as it is stored. Its ETag is
+// kept so that saving does not overwrite changes made meanwhile.
 async function editCard(element) {
     const divCardData = document.getElementById("editcard");
-    divCardData.classList.toggle("hidden");
     const cardId = element
         .closest("tr")
         .querySelector("input").id;
-    const cardName = element
-        .closest("tr")
-        .querySelector("td:nth-child(3)").textContent
-    const cardChromecast = element
-        .closest("tr")
-        .querySelector("td:nth-child(4)").textContent
-    const cardMediaLinks = element
-        .closest("tr")
-        .querySelector("td:nth-child(5)").textContent
-    const maxVolume = element
-        .closest("tr")
-        .querySelector("td:nth-child(7)").textContent
-    divCardData.querySelector("#media_links").value = cardMediaLinks
-    divCardData.querySelector("#id").value = cardId
-    divCardData.querySelector("#chromecast").value = cardChromecast
-    divCardData.querySelector("#name").value = cardName
-    divCardData.querySelector("#maxvolume").value = maxVolume
+    const response = await fetch("/api/v1/cards/"+cardId);
+    if (await showError(response)) {
+        return;
+    }
+    const card = await response.json();
+    cleanEditCard();
+    divCardData.dataset.cardId = card.id;
+    divCardData.dataset.etag = response.headers.get("ETag");
+    divCardData.querySelector("#media_links").value = (card.media_links || [])
+        .map(entry => entry.link+"; "+entry.content_type).join("\n");
+    divCardData.querySelector("#id").value = card.id;
+    divCardData.querySelector("#chromecast").value = card.chromecast;
+    for (const option of divCardData.querySelector("#chromecasts").options) {
+        option.selected = (card.chromecasts || []).includes(option.value);
+    }
+    divCardData.querySelector("#name").value = card.name;
+    divCardData.querySelector("#maxvolume").value = card.maxvolume;
+    divCardData.querySelector("#receiver_app_id").value = card.receiver_app_id || "";
+    divCardData.querySelector("#tags").value = (card.tags || []).join(", ");
+    divCardData.querySelector("#type").value = card.type || "";
+    divCardData.querySelector("#sleep_minutes").value = card.sleep_minutes || "";
+    divCardData.querySelector("#volume").value = card.volume || "";
+    divCardData.classList.remove("hidden");
+}
+
+// showError displays the message of a failed API request for a few
+// seconds. It returns true when the response was an error.
+async function showError(response) {
+    if (response.ok) {
+        return false;
+    }
+    let message = response.statusText;
+    try {
+        const body = await response.json();
+        message = body.message || body.error || message;
+    } catch (error) {
+        console.error('Error:', error);
+    }
+    showMessage(message);
+    return true;
+}
+
+function showMessage(message) {
+    const errorBox = document.getElementById("error");
+    errorBox.textContent = message;
+    errorBox.classList.remove("hidden");
+    clearTimeout(errorBox.timeout);
+    errorBox.timeout = setTimeout(() => {
+        errorBox.classList.add("hidden");
+    }, 5000);
 }
 
 async function playCard(element) {
@@ -56,13 +183,10 @@ async function playCard(element) {
         const castName = element
             .closest("tr")
             .querySelector("td:nth-child(4)").textContent;
-        const response = await fetch("/api/cards/"+cardId, {
-            method: "POST",
-            headers: {
-            "Content-Type": "application/json",
-            },
-            body: JSON.stringify({})
+        const response = await fetch("/api/v1/cards/"+cardId+"/play", {
+            method: "POST"
         });
+        await showError(response);
     } catch (error) {
         console.error('Error:', error);
     }
@@ -80,26 +204,78 @@ async function castControl(element) {
         "action": action,
         "volume": parseFloat(volume)
     };
-    const response = await fetch("/api/casts", {
-        method: "PUT",
+    const response = await fetch("/api/v1/player/actions", {
+        method: "POST",
         headers: {
           "Content-Type": "application/json",
         },
         body: JSON.stringify(payload)
     });
+    await showError(response);
 }
 
 function optionExists(selectElement, valueToCheck) {
     return Array.from(selectElement.options).some(option => option.value === valueToCheck);
 }
 
-function updateStatus() {
-    setInterval(getStatus, 5000);
+// followEvents keeps the page up to date from the player's event
+// stream. The browser reconnects by itself; what was missed meanwhile
+// is fetched again.
+function followEvents() {
+    const events = new EventSource("/api/v1/events");
+    events.onopen = () => {
+        getCasts();
+    };
+    events.onmessage = (message) => {
+        const event = JSON.parse(message.data);
+        switch (event.type) {
+        case "player.status":
+            updateStatusTable(event.data);
+            break;
+        case "player.volume":
+            const volume = document.getElementById("volume");
+            if (volume && document.activeElement != volume) {
+                volume.value = event.data.volume.toFixed(2);
+            }
+            break;
+        case "player.now_playing":
+            markCard("playing", event.data.card);
+            break;
+        case "card.inserted":
+            markCard("inserted", event.data.id);
+            break;
+        case "card.removed":
+            markCard("inserted", null);
+            break;
+        case "cards.reloaded":
+            getCards();
+            break;
+        case "player.command":
+            showMessage("Command card: "+event.data.message);
+            break;
+        case "error":
+            showMessage(event.data.source+": "+event.data.message);
+            break;
+        default:
+            if (event.type.startsWith("device.")) {
+                getCasts();
+            }
+        }
+    };
+}
+
+// markCard moves a class to the row of the card, or clears it when
+// cardId is null.
+function markCard(className, cardId) {
+    for (const row of document.querySelectorAll("#cards tr")) {
+        const input = row.querySelector("input");
+        row.classList.toggle(className, input != null && input.id === cardId);
+    }
 }
 
 async function getStatus() {
     try {
-        const response = await fetch('/api/status');
+        const response = await fetch('/api/v1/player');
         if (!response.ok) {
             throw new Error('Network response was not ok');
         }
@@ -111,6 +287,10 @@ async function getStatus() {
 }
 
 function updateStatusTable(cast) {
+    const room = document.getElementById("room");
+    if (document.activeElement != room) {
+        room.value = cast.room || "";
+    }
     const castStatusTable = document.getElementById("castStatus");
     const rows = castStatusTable.querySelectorAll("tr");
     rows.forEach((row) => {
@@ -131,14 +311,27 @@ function updateStatusTable(cast) {
     castStatusTable.appendChild(newRow);
 }
 
+async function setRoom(event) {
+    const response = await fetch("/api/v1/player/room", {
+        method: "PUT",
+        headers: {
+            "Content-Type": "application/json",
+        },
+        body: JSON.stringify({"room": event.target.value})
+    });
+    await showError(response);
+}
+
 async function getCards() {
     try {
-        const response = await fetch('/api/cards');
+        const tag = document.getElementById("tagfilter").value;
+        const response = await fetch('/api/v1/cards?tag='+encodeURIComponent(tag));
         if (!response.ok) {
             throw new Error('Network response was not ok');
         }
         const cards = await response.json();
         updateCardTable(cards)
+        await getTags();
     } catch (error) {
         console.error('Error:', error);
     }
@@ -150,11 +343,20 @@ async function addCard(event) {
     for (const input of divCardData.querySelectorAll("input, textarea, select")) {
         if (input.tagName == "TEXTAREA") {
             payload[input.id] = []
+            if (input.value.trim() == "") {
+                continue;
+            }
             for (media_link of input.value.trim().split("\n")) {
-                tokens = media_link.split(";")
-                payload[input.id].push({"link": tokens[0], "content_type": tokens[1]});
+                tokens = media_link.split(";").map(token => token.trim())
+                payload[input.id].push({"link": tokens[0], "content_type": tokens[1] || ""});
             }
-        } else if (input.id == "maxvolume") {
+        } else if (input.multiple) {
+            payload[input.id] = Array.from(input.selectedOptions).map(option => option.value);
+        } else if (input.id == "tags") {
+            payload[input.id] = input.value.split(",").map(tag => tag.trim()).filter(tag => tag != "");
+        } else if (input.id == "sleep_minutes") {
+            payload[input.id] = parseInt(input.value) || 0;
+        } else if (input.id == "maxvolume" || input.id == "volume") {
             payload[input.id] = parseFloat(input.value);
         } else {
             payload[input.id] = input.value;
@@ -162,35 +364,121 @@ async function addCard(event) {
     }
     console.log(JSON.stringify(payload));
     try {
-        const response = await fetch("/api/cards", {
+        clearFieldErrors();
+        const response = await saveCard(divCardData, payload);
+        if (response.status == 422) {
+            const body = await response.json();
+            showFieldErrors(body.fields || []);
+            return;
+        }
+        if (await showError(response)) {
+            return;
+        }
+        cleanEditCard();
+        await getCards();
+    } catch (error) {
+        console.error('Error:', error);
+    }
+    document.getElementById("editcard").classList.toggle("hidden");
+}
+
+// saveCard creates the card, or replaces the one being edited. A card
+// given a new id is moved to it first, keeping everything else.
+async function saveCard(divCardData, payload) {
+    const cardId = divCardData.dataset.cardId;
+    if (!cardId) {
+        return fetch("/api/v1/cards", {
             method: "POST",
             headers: {
-            "Content-Type": "application/json",
+                "Content-Type": "application/json",
             },
             body: JSON.stringify(payload)
         });
-        const cards = await response.json();
-        cleanEditCard();
-        updateCardTable(cards);
-    } catch (error) {
-        console.error('Error:', error);
     }
-    document.getElementById("editcard").classList.toggle("hidden");
+    let etag = divCardData.dataset.etag;
+    if (payload.id != cardId) {
+        const response = await fetch("/api/v1/cards/"+cardId+"/move", {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+                "If-Match": etag,
+            },
+            body: JSON.stringify({"id": payload.id})
+        });
+        if (!response.ok) {
+            return response;
+        }
+        divCardData.dataset.cardId = payload.id;
+        divCardData.dataset.etag = etag = response.headers.get("ETag");
+    }
+    const response = await fetch("/api/v1/cards/"+payload.id, {
+        method: "PUT",
+        headers: {
+            "Content-Type": "application/json",
+            "If-Match": etag,
+        },
+        body: JSON.stringify(payload)
+    });
+    if (response.ok) {
+        divCardData.dataset.etag = response.headers.get("ETag");
+    }
+    return response;
 }
 
 async function delCard(event) {
     const cardsData = document.getElementById("cards")
         .querySelectorAll('input[type="checkbox"]:checked');
     for (const card of cardsData) {
-        const response = await fetch("/api/cards/" + card.id, {
-            method: "DELETE",
-            headers: {
-                "Content-Type": "application/json",
-            }
+        const response = await fetch("/api/v1/cards/" + card.id, {
+            method: "DELETE"
         });
-        const cards = await response.json();
-        updateCardTable(cards);
+        await showError(response);
     }
+    await getCards();
+}
+
+// exportCards downloads a bundle of the checked cards, or of all cards
+// when none is checked.
+function exportCards(event) {
+    const ids = Array.from(document.getElementById("cards")
+        .querySelectorAll('input[type="checkbox"]:checked'), card => card.id);
+    window.location = "/api/v1/export?ids="+encodeURIComponent(ids.join(","));
+}
+
+async function importCards(event) {
+    const file = document.getElementById("bundle").files[0];
+    if (!file) {
+        showMessage("Choose a card bundle to import");
+        return;
+    }
+    const strategy = document.getElementById("strategy").value;
+    const response = await fetch("/api/v1/import?strategy="+strategy, {
+        method: "POST",
+        headers: {
+            "Content-Type": "application/zip",
+        },
+        body: file
+    });
+    if (await showError(response)) {
+        return;
+    }
+    const result = await response.json();
+    let message = "Imported "+(result.added.length+result.overwritten.length+
+        Object.keys(result.renamed).length)+" cards";
+    if (result.skipped.length > 0) {
+        message += ", skipped "+result.skipped.join(", ");
+    }
+    for (const [id, newId] of Object.entries(result.renamed)) {
+        message += ", "+id+" as "+newId;
+    }
+    for (const [id, error] of Object.entries(result.invalid)) {
+        message += "; "+id+" not imported: "+error;
+    }
+    if (result.missing_media.length > 0) {
+        message += "; missing media: "+result.missing_media.join(", ");
+    }
+    showMessage(message);
+    await getCards();
 }
 
 function cleanEditCard() {
@@ -199,38 +487,76 @@ function cleanEditCard() {
         if (chElement.tagName == "SELECT") {
             return;
         }
-        chElement.value = '';
+        chElement.value = chElement.defaultValue;
     })
+    editCardDiv.querySelector("#type").value = "";
+    delete editCardDiv.dataset.cardId;
+    delete editCardDiv.dataset.etag;
+    clearFieldErrors();
+}
+
+// showFieldErrors puts the server's complaints next to the inputs of
+// the card editor. Fields of list items, such as media_links[1].link,
+// name the line of the item.
+function showFieldErrors(fields) {
+    const editCardDiv = document.getElementById("editcard");
+    for (const fieldError of fields) {
+        const [, name, index, part] = fieldError.field.match(/^(\w+)(?:\[(\d+)\])?(?:\.(\w+))?$/) || [];
+        const input = editCardDiv.querySelector("#"+(name || "id"));
+        let message = fieldError.message;
+        if (part) {
+            message = part+" "+message;
+        }
+        if (index !== undefined) {
+            message = "line "+(parseInt(index)+1)+": "+message;
+        }
+        if (!input) {
+            showMessage(fieldError.field+": "+message);
+            continue;
+        }
+        input.classList.add("invalid");
+        const error = document.createElement("div");
+        error.className = "field-error";
+        error.textContent = message;
+        input.insertAdjacentElement("afterend", error);
+    }
+}
+
+function clearFieldErrors() {
+    const editCardDiv = document.getElementById("editcard");
+    editCardDiv.querySelectorAll(".field-error").forEach((error) => error.remove());
+    editCardDiv.querySelectorAll(".invalid").forEach((input) => input.classList.remove("invalid"));
 }
 
 async function updateCasts() {
-    payload = {"action": "refresh"};
-    const response = await fetch("/api/casts", {
-        method: "POST",
-        headers: {
-          "Content-Type": "application/json",
-        },
-        body: JSON.stringify(payload)
+    const response = await fetch("/api/v1/devices/discovery", {
+        method: "POST"
     });
-    const id = setInterval(getCasts, 5000);
-    setTimeout(() => {
-        clearInterval(id);
-    }, 20000);
+    await showError(response);
 }
 
 async function getCasts() {
     try {
-        const response = await fetch('/api/casts');
+        const response = await fetch('/api/v1/devices');
         if (!response.ok) {
             throw new Error('Network response was not ok');
         }
         const casts = await response.json();
-        const selectCast = document.getElementById("chromecast")
-        for (const cast of casts) {
-            if (!optionExists(selectCast, cast.name)) {
-                const newOption = document.createElement("option")
-                newOption.value = newOption.textContent = cast.name;
-                selectCast.appendChild(newOption)
+        for (const selectCast of document.querySelectorAll("#chromecast, #chromecasts, #bulkchromecast, #room")) {
+            for (const cast of casts) {
+                let option = Array.from(selectCast.options).find(option => option.value === cast.name);
+                if (!option) {
+                    option = document.createElement("option")
+                    option.value = cast.name;
+                    selectCast.appendChild(option)
+                }
+                option.textContent = cast.name;
+                if (cast.Info && cast.Info.md == "Google Cast Group") {
+                    option.textContent += " (group)";
+                }
+                if (!cast.online) {
+                    option.textContent += " (offline)";
+                }
             }
         }
     } catch (error) {
@@ -241,18 +567,19 @@ async function getCasts() {
 window.addEventListener("load", async (event) => {
     await getCards();
     await getCasts();
-    // await updateCasts();
-    updateStatus();
+    followEvents();
     const addCardBtn = document.getElementById("addcard");
     const delCardBtn = document.getElementById("delcard");
     const updateCastBtn = document.getElementById("updatecc");
     const updateCardsListBtn = document.getElementById("updatecards");
 
     document.getElementById("closeBtn").addEventListener("click", () =>{
+        clearFieldErrors();
         document.getElementById("editcard").classList.toggle("hidden");
     })
 
     document.getElementById("newcard").addEventListener("click", () => {
+        cleanEditCard();
         document.getElementById("editcard").classList.toggle("hidden");
     })
 
@@ -261,4 +588,25 @@ window.addEventListener("load", async (event) => {
     delCardBtn.addEventListener("click", delCard);
     updateCastBtn.addEventListener("click", updateCasts);
     updateCardsListBtn.addEventListener("click", getCards);
+    document.getElementById("exportcards").addEventListener("click", exportCards);
+    document.getElementById("importcards").addEventListener("click", importCards);
+    document.getElementById("search").addEventListener("input", searchCards);
+    document.getElementById("room").addEventListener("change", setRoom);
+    document.getElementById("tagfilter").addEventListener("change", getCards);
+    document.getElementById("bulkretarget").addEventListener("click", () => {
+        changeCards({"chromecast": document.getElementById("bulkchromecast").value});
+    });
+    document.getElementById("bulkvolume").addEventListener("click", () => {
+        changeCards({"maxvolume": parseFloat(document.getElementById("bulkmaxvolume").value)});
+    });
+    for (const [button, field] of [["bulkaddtag", "add_tags"], ["bulkremovetag", "remove_tags"]]) {
+        document.getElementById(button).addEventListener("click", () => {
+            const tag = document.getElementById("bulktag").value.trim();
+            if (tag == "") {
+                showMessage("Enter the tag first");
+                return;
+            }
+            changeCards({[field]: [tag]});
+        });
+    }
 });
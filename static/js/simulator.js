@@ -0,0 +1,107 @@
+// The LEDs of the player light up at 0.
+const ledNames = ["red", "green", "blue"];
+
+async function showError(response) {
+    if (response.ok) {
+        return false;
+    }
+    let message = response.statusText;
+    try {
+        const body = await response.json();
+        message = body.message || body.error || message;
+    } catch (error) {
+        console.error('Error:', error);
+    }
+    const errorBox = document.getElementById("error");
+    errorBox.textContent = message;
+    errorBox.classList.remove("hidden");
+    clearTimeout(errorBox.timeout);
+    errorBox.timeout = setTimeout(() => {
+        errorBox.classList.add("hidden");
+    }, 5000);
+    return true;
+}
+
+function updateState(state) {
+    state.leds.forEach((value, i) => {
+        document.getElementById("led-"+ledNames[i]).classList.toggle("lit", value == 0);
+    });
+    document.getElementById("slot").textContent = state.card ? "card "+state.card : "no card";
+}
+
+async function getState() {
+    try {
+        const response = await fetch("/api/v1/simulator");
+        if (!response.ok) {
+            throw new Error('Network response was not ok');
+        }
+        updateState(await response.json());
+    } catch (error) {
+        console.error('Error:', error);
+    }
+}
+
+async function simulate(method, path, payload) {
+    try {
+        const response = await fetch("/api/v1/simulator"+path, {
+            method: method,
+            headers: {
+            "Content-Type": "application/json",
+            },
+            body: JSON.stringify(payload || {})
+        });
+        if (!await showError(response)) {
+            updateState(await response.json());
+        }
+    } catch (error) {
+        console.error('Error:', error);
+    }
+}
+
+async function getCards() {
+    try {
+        const response = await fetch("/api/v1/cards");
+        if (!response.ok) {
+            throw new Error('Network response was not ok');
+        }
+        const cards = await response.json();
+        const select = document.getElementById("cards");
+        Object.entries(cards).forEach(([id, card]) => {
+            const option = document.createElement("option");
+            option.value = id;
+            option.textContent = card.name ? card.name+" ("+id+")" : id;
+            select.appendChild(option);
+        });
+        document.getElementById("cardid").value = select.value;
+        select.addEventListener("change", () => {
+            document.getElementById("cardid").value = select.value;
+        });
+    } catch (error) {
+        console.error('Error:', error);
+    }
+}
+
+window.addEventListener("load", async (event) => {
+    await getCards();
+    await getState();
+    setInterval(getState, 500);
+    document.getElementById("insert").addEventListener("click", () => {
+        simulate("PUT", "/card", {"id": document.getElementById("cardid").value});
+    });
+    document.getElementById("remove").addEventListener("click", () => {
+        simulate("DELETE", "/card");
+    });
+    for (const button of document.querySelectorAll(".press")) {
+        button.addEventListener("click", () => {
+            simulate("POST", "/button", {"duration_ms": parseInt(button.dataset.duration)});
+        });
+    }
+    document.getElementById("pressfor").addEventListener("click", () => {
+        simulate("POST", "/button", {"duration_ms": parseInt(document.getElementById("duration").value)});
+    });
+    for (const button of document.querySelectorAll(".turn")) {
+        button.addEventListener("click", () => {
+            simulate("POST", "/encoder", {"steps": parseInt(button.dataset.steps)});
+        });
+    }
+});